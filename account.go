@@ -0,0 +1,390 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Password changes for logged in users, and password resets through a link sent by mail for those who forgot.
+
+const (
+	resetTokenTimeout  = time.Hour
+	resetTokenInterval = time.Minute //Least time between two reset mails to the same user
+)
+
+var BoltBucketPasswordResets = []byte("password_resets") //SHA-256 of the token to passwordReset
+
+var (
+	ErrInvalidResetToken = errors.New("The reset link is invalid or has expired")
+	ErrResetTooSoon      = errors.New("A reset link was sent very recently")
+)
+
+//A passwordReset is a pending reset. Only the hash of the token is stored, so a copy of the database can not be used to reset passwords.
+type passwordReset struct {
+	User    string
+	Created time.Time
+}
+
+func resetTokenKey(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+//newPasswordReset creates a single-use token that lets whoever has it set a new password for the user.
+func newPasswordReset(username string) (token string, err error) {
+	token = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	err = stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketPasswordResets)
+		now := time.Now()
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var pr passwordReset
+			if json.Unmarshal(v, &pr) != nil || now.Sub(pr.Created) > resetTokenTimeout {
+				c.Delete() //Clean up expired tokens while we are at it.
+				continue
+			}
+			if pr.User == username && now.Sub(pr.Created) < resetTokenInterval {
+				return ErrResetTooSoon
+			}
+		}
+		data, err := json.Marshal(passwordReset{User: username, Created: now})
+		if err != nil {
+			return err
+		}
+		return b.Put(resetTokenKey(token), data)
+	})
+	return
+}
+
+//checkPasswordReset returns the user a token belongs to, without using it up.
+func checkPasswordReset(token string) (username string, err error) {
+	err = stateDB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(BoltBucketPasswordResets).Get(resetTokenKey(token))
+		var pr passwordReset
+		if data == nil || json.Unmarshal(data, &pr) != nil || time.Since(pr.Created) > resetTokenTimeout {
+			return ErrInvalidResetToken
+		}
+		username = pr.User
+		return nil
+	})
+	return
+}
+
+//takePasswordReset uses up a token, and every other pending token of the same user.
+func takePasswordReset(token string) (username string, err error) {
+	err = stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketPasswordResets)
+		data := b.Get(resetTokenKey(token))
+		var pr passwordReset
+		if data == nil || json.Unmarshal(data, &pr) != nil || time.Since(pr.Created) > resetTokenTimeout {
+			return ErrInvalidResetToken
+		}
+		username = pr.User
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var other passwordReset
+			if json.Unmarshal(v, &other) != nil || other.User == username {
+				c.Delete()
+			}
+		}
+		return nil
+	})
+	return
+}
+
+//changePassword sets a new password for the user after checking it against the policy.
+//The returned error is worded for the user.
+func changePassword(user User, password, confirm string) error {
+	if password != confirm {
+		return errors.New("The passwords do not match.")
+	}
+	if err := passwordPolicy.Check(user.Name, password); err != nil {
+		return err
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	user.MustChangePassword = false
+	switch err := users.Update(user); err {
+	case nil:
+		return nil
+	case ErrReadOnly, ErrNotSupported:
+		return errors.New("Passwords can not be changed here. Please contact your administrator.")
+	default:
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Changing password")
+		return errors.New("Unable to change the password. Please try again later.")
+	}
+}
+
+var (
+	passwordChangeContent = template.Must(template.New("password_change").Parse(`
+	<form method="POST" action="/proxy/account/password">
+		<input type="password" name="current" placeholder="Current password" autocomplete="current-password" required>
+		<input type="password" name="password" placeholder="New password" autocomplete="new-password" required>
+		<input type="password" name="confirm" placeholder="Repeat new password" autocomplete="new-password" required>
+		<input type="submit" value="Change password">
+	</form>`))
+
+	forgotContent = template.Must(template.New("forgot").Parse(`
+	<p>Enter your username and we will send a link to set a new password to the email address of your account.</p>
+	<form method="POST" action="/proxy/forgot">
+		<input type="text" name="username" placeholder="Username" autocomplete="username" required>
+		<input type="submit" value="Send link">
+	</form>`))
+
+	resetContent = template.Must(template.New("reset").Parse(`
+	<p>Choose a new password for {{.User}}.</p>
+	<form method="POST" action="/proxy/reset">
+		<input type="hidden" name="token" value="{{.Token}}">
+		<input type="password" name="password" placeholder="New password" autocomplete="new-password" required>
+		<input type="password" name="confirm" placeholder="Repeat new password" autocomplete="new-password" required>
+		<input type="submit" value="Set password">
+	</form>`))
+
+	newPasswordContent = template.Must(template.New("new_password").Parse(`
+	<p>An administrator has asked you to choose a new password before you continue.</p>
+	<form method="POST" action="/proxy/login/password">
+		<input type="password" name="password" placeholder="New password" autocomplete="new-password" required>
+		<input type="password" name="confirm" placeholder="Repeat new password" autocomplete="new-password" required>
+		<input type="submit" value="Set password">
+	</form>`))
+)
+
+//forgotLink is added to the login page when password resets are possible.
+const forgotLink = `<p><a href="/proxy/forgot">Forgot your password?</a></p>`
+
+const resetMailBody = `Hello %s,
+
+Someone, hopefully you, asked to reset the password of your account.
+Follow this link within an hour to choose a new password:
+
+%s
+
+If you did not ask for this, you can ignore this message. Your password has not been changed.
+`
+
+func getAccountPassword(w http.ResponseWriter, r *http.Request) {
+	if _, ok := loggedInUser(r); !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	renderer.Render(w, Page{
+		Title:   "Change Password",
+		Content: renderContent(passwordChangeContent, nil),
+	})
+}
+
+func postAccountPassword(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	page := Page{
+		Title:   "Change Password",
+		Content: renderContent(passwordChangeContent, nil),
+	}
+	addr := clientAddress(r)
+	if wait, locked := throttle.Attempt(user.Name, addr); wait > 0 {
+		renderThrottled(w, page, wait, locked)
+		return
+	}
+
+	r.ParseForm()
+	switch upgraded, err := authenticate(r.Context(), user.Name, r.PostFormValue("current")); err.(type) {
+	case nil:
+		throttle.Release(user.Name, addr)
+		user = upgraded //Authenticating may have upgraded the hash.
+	case BackendError:
+		throttle.Release(user.Name, addr)
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Authenticating user")
+		page.Message = "The password can not be changed right now. Please try again later."
+		renderer.Render(w, page)
+		return
+	default:
+		failLogin(r, user.Name, "Wrong current password when changing the password")
+		page.Message = "The current password is wrong."
+		renderer.Render(w, page)
+		return
+	}
+	if err := changePassword(user, r.PostFormValue("password"), r.PostFormValue("confirm")); err != nil {
+		page.Message = err.Error()
+		renderer.Render(w, page)
+		return
+	}
+	logger.WithFields(logrus.Fields{"user": user.Name, "client": r.RemoteAddr}).Info("Password changed")
+	audit(r, EventPasswordChange, user.Name, "", "")
+	page.Message = "Your password has been changed."
+	renderer.Render(w, page)
+}
+
+func getForgot(w http.ResponseWriter, r *http.Request) {
+	renderer.Render(w, Page{
+		Title:   "Forgot Password",
+		Content: renderContent(forgotContent, nil),
+	})
+}
+
+func postForgot(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	username := r.PostFormValue("username")
+	page := Page{
+		Title:   "Forgot Password",
+		Content: renderContent(forgotContent, nil),
+		//The same answer whether or not the user exists, so the form can not be used to find usernames.
+		Message: "If the account exists and has an email address, a link to reset the password has been sent to it.",
+	}
+	if wait, locked := throttle.Check(username, clientAddress(r)); wait > 0 {
+		renderThrottled(w, page, wait, locked)
+		return
+	}
+
+	user, err := users.Get(username)
+	if err != nil || user.Email == "" {
+		renderer.Render(w, page)
+		return
+	}
+	token, err := newPasswordReset(user.Name)
+	if err == nil {
+		link := strings.TrimSuffix(config.PublicURL, "/") + "/proxy/reset?token=" + url.QueryEscape(token)
+		err = mailer.Send(user.Email, "Reset your password", fmt.Sprintf(resetMailBody, user.Name, link))
+	}
+	if err != nil && err != ErrResetTooSoon {
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Sending password reset mail")
+	} else if err == nil {
+		logger.WithFields(logrus.Fields{"user": user.Name, "client": r.RemoteAddr}).Info("Password reset mail sent")
+	}
+	renderer.Render(w, page)
+}
+
+func getReset(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	username, err := checkPasswordReset(token)
+	if err != nil {
+		renderer.Render(w, Page{
+			Title:   "Reset Password",
+			Content: renderContent(forgotContent, nil),
+			Message: err.Error() + ". Please ask for a new one.",
+		})
+		return
+	}
+	renderer.Render(w, Page{
+		Title:   "Reset Password",
+		Content: renderContent(resetContent, map[string]string{"User": username, "Token": token}),
+	})
+}
+
+func postReset(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	token := r.PostFormValue("token")
+	username, err := checkPasswordReset(token)
+	var user User
+	if err == nil {
+		user, err = users.Get(username)
+	}
+	if err != nil {
+		renderer.Render(w, Page{
+			Title:   "Reset Password",
+			Content: renderContent(forgotContent, nil),
+			Message: ErrInvalidResetToken.Error() + ". Please ask for a new one.",
+		})
+		return
+	}
+
+	//The link came by mail, which confirms the address as well.
+	user.Unverified = false
+
+	//The token is only used up once the new password has been accepted, so a typo does not waste it.
+	if err := changePassword(user, r.PostFormValue("password"), r.PostFormValue("confirm")); err != nil {
+		renderer.Render(w, Page{
+			Title:   "Reset Password",
+			Content: renderContent(resetContent, map[string]string{"User": username, "Token": token}),
+			Message: err.Error(),
+		})
+		return
+	}
+	takePasswordReset(token)
+	throttle.Succeed(username) //Whoever can read the mail of the user may lift a lockout.
+	logger.WithFields(logrus.Fields{"user": username, "client": r.RemoteAddr}).Info("Password reset")
+	audit(r, EventPasswordReset, username, "", "Through a link sent by mail")
+
+	page := loginPage()
+	page.Message = "Your password has been changed. You can now log in."
+	renderer.Render(w, page)
+}
+
+//passwordChangeRequired holds back the login of a user an admin has asked to choose a new password.
+//The user stays pending, like while the second factor is missing, until postLoginPassword.
+func passwordChangeRequired(w http.ResponseWriter, r *http.Request, session *sessions.Session, username string) bool {
+	user, err := users.Get(username)
+	if err != nil || !user.MustChangePassword {
+		return false
+	}
+	session.Values["pending"] = username
+	session.Values["pending_since"] = time.Now().Unix()
+	session.Values["pending_password"] = true
+	session.Save(r, w)
+	return true
+}
+
+//pendingPasswordChange returns the user that has logged in, but still has to choose a new password.
+func pendingPasswordChange(r *http.Request) (string, bool) {
+	session, _ := store.Get(r, "auth")
+	username, ok := pendingUser(r)
+	forced, _ := session.Values["pending_password"].(bool)
+	return username, ok && forced
+}
+
+func renderNewPassword(w http.ResponseWriter, message string) {
+	renderer.Render(w, Page{
+		Title:   "Choose a New Password",
+		Content: renderContent(newPasswordContent, nil),
+		Message: message,
+	})
+}
+
+func getLoginPassword(w http.ResponseWriter, r *http.Request) {
+	if _, ok := pendingPasswordChange(r); !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	renderNewPassword(w, "")
+}
+
+func postLoginPassword(w http.ResponseWriter, r *http.Request) {
+	username, ok := pendingPasswordChange(r)
+	var user User
+	var err error
+	if ok {
+		user, err = users.Get(username)
+	}
+	if !ok || err != nil {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	if err := changePassword(user, r.PostFormValue("password"), r.PostFormValue("confirm")); err != nil {
+		renderNewPassword(w, err.Error())
+		return
+	}
+	logger.WithFields(logrus.Fields{"user": username, "client": r.RemoteAddr}).Info("Password changed at login")
+	audit(r, EventPasswordChange, username, "", "Required by an admin")
+
+	session, _ := store.Get(r, "auth")
+	delete(session.Values, "pending")
+	delete(session.Values, "pending_since")
+	delete(session.Values, "pending_password")
+	completeLogin(w, r, session, username)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPasswordReset(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stateDB = db
+	ensureBuckets(stateDB, BoltBucketPasswordResets)
+
+	token, err := newPasswordReset("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newPasswordReset("alice"); err != ErrResetTooSoon {
+		t.Errorf("Second reset right away: %v. Expected ErrResetTooSoon", err)
+	}
+	other, err := newPasswordReset("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user, err := checkPasswordReset(token); err != nil || user != "alice" {
+		t.Errorf("checkPasswordReset = %q, %v. Expected alice", user, err)
+	}
+	if user, err := takePasswordReset(token); err != nil || user != "alice" {
+		t.Errorf("takePasswordReset = %q, %v. Expected alice", user, err)
+	}
+	if _, err := takePasswordReset(token); err != ErrInvalidResetToken {
+		t.Errorf("Token used twice: %v. Expected ErrInvalidResetToken", err)
+	}
+	if _, err := checkPasswordReset("made up"); err != ErrInvalidResetToken {
+		t.Errorf("Made up token: %v. Expected ErrInvalidResetToken", err)
+	}
+	if user, err := checkPasswordReset(other); err != nil || user != "bob" {
+		t.Errorf("Token of bob lost when alice reset: %q, %v", user, err)
+	}
+}
+
+func TestDirMailer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dm := &DirMailer{Dir: dir, From: "AuthProx <authprox@example.com>"}
+	if err := dm.Send("alice@example.com\r\nBcc: eve@example.com", "Hi", "Body"); err != ErrInvalidAddress {
+		t.Errorf("Header injection: %v. Expected ErrInvalidAddress", err)
+	}
+	if err := dm.Send("Alice <alice@example.com>", "Reset your password", "Follow the link"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("%d files written, expected 1", len(files))
+	}
+	msg, _ := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	for _, want := range []string{"To: Alice <alice@example.com>\r\n", "Subject: Reset your password\r\n", "\r\n\r\nFollow the link"} {
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("Message lacks %q:\n%s", want, msg)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//The admin console at /proxy/admin. Admins can find users and change their accounts.
+//Everything goes through the UserManager, so backends that can not store a change say so.
+
+var adminUsersContent = template.Must(template.New("admin_users").Parse(`
+	<p>
+		<a href="/proxy/admin">Users</a>
+		<a href="/proxy/admin/lockouts">Lockouts</a>
+		<a href="/proxy/admin/tokens">API tokens</a>
+		<a href="/proxy/admin/audit">Audit log</a>
+		{{if .Invites}}<a href="/proxy/admin/invites">Invites</a>{{end}}
+		{{if .Approval}}<a href="/proxy/admin/registrations">Registrations</a>{{end}}
+	</p>
+	<form method="GET" action="/proxy/admin">
+		<input type="search" name="q" value="{{.Query}}" placeholder="Name or email">
+		<input type="submit" value="Search">
+	</form>
+	<table class="admin">
+	{{range .Users}}
+		<tr>
+			<td>{{.Name}}{{if .Admin}} (admin){{end}}</td>
+			<td>{{.Email}}</td>
+			<td>
+				{{- if .Disabled}}disabled{{else if .Pending}}waiting for approval{{else if .Unverified}}not confirmed{{else}}active{{end -}}
+				{{- if .MustChangePassword}}, must change password{{end -}}
+				{{- if .Expired}}, expired{{else if not .ExpiresAt.IsZero}}, expires {{.ExpiresAt.Format "2006-01-02 15:04"}}{{end -}}
+			</td>
+			<td>
+				<form method="POST" action="/proxy/admin/users">
+					<input type="hidden" name="user" value="{{.Name}}">
+					<input type="hidden" name="csrf" value="{{$.CSRF}}">
+					{{if .Pending}}<button type="submit" name="action" value="approve">Approve</button>{{end}}
+					{{if .Admin}}<button type="submit" name="action" value="demote">Revoke admin</button>
+					{{else}}<button type="submit" name="action" value="promote">Make admin</button>{{end}}
+					{{if .Disabled}}<button type="submit" name="action" value="enable">Enable</button>
+					{{else}}<button type="submit" name="action" value="disable">Disable</button>{{end}}
+					{{if not .MustChangePassword}}<button type="submit" name="action" value="reset">Force password change</button>{{end}}
+					<input type="date" name="expires">
+					<button type="submit" name="action" value="expire">Set expiry</button>
+					<button type="submit" name="action" value="delete" onclick="return confirm('Delete {{.Name}}? This can not be undone.')">Delete</button>
+				</form>
+			</td>
+		</tr>
+	{{else}}
+		<tr><td>No users found.</td></tr>
+	{{end}}
+	</table>`))
+
+var ErrInvalidExpiry = errors.New("Invalid expiry. Expected a date like 2006-01-02, or never")
+
+//parseExpiry reads an expiry as admins give it. The account works through the whole of a plain date.
+//Empty or never means the account does not expire.
+func parseExpiry(s string) (time.Time, error) {
+	switch s = strings.TrimSpace(s); s {
+	case "", "never":
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return time.Time{}, ErrInvalidExpiry
+	}
+	return day.AddDate(0, 0, 1), nil
+}
+
+//searchUsers returns the users whose name or email address contains the query, ignoring case.
+func searchUsers(list []User, query string) []User {
+	query = strings.ToLower(strings.TrimSpace(query))
+	if query == "" {
+		return list
+	}
+	var found []User
+	for _, u := range list {
+		if strings.Contains(strings.ToLower(u.Name), query) || strings.Contains(strings.ToLower(u.Email), query) {
+			found = append(found, u)
+		}
+	}
+	return found
+}
+
+func renderAdmin(w http.ResponseWriter, r *http.Request, query, message string) {
+	list, err := users.List()
+	if err != nil {
+		logger.WithField("err", err).Error("Listing users")
+		message = "Unable to list users: " + err.Error()
+	}
+	page := pages.Get(AdminPage)
+	page.Content += renderContent(adminUsersContent, map[string]interface{}{
+		"Users":    searchUsers(list, query),
+		"Query":    query,
+		"CSRF":     csrfToken(w, r),
+		"Invites":  registrationMode == RegistrationInvite,
+		"Approval": registrationMode == RegistrationApproval,
+	})
+	page.Message = message
+	renderer.Render(w, page)
+}
+
+func getAdmin(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(r); !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	renderAdmin(w, r, r.URL.Query().Get("q"), "")
+}
+
+func postAdminUser(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	name, action := r.PostFormValue("user"), r.PostFormValue("action")
+	user, err := users.Get(name)
+	if err != nil {
+		http.Error(w, "No such user.", http.StatusNotFound)
+		return
+	}
+	if name == admin.Name && (action == "demote" || action == "disable" || action == "delete") {
+		renderAdmin(w, r, "", "You can not lock yourself out. Ask another admin to do this.")
+		return
+	}
+
+	var done string
+	switch action {
+	case "promote":
+		user.Admin, done = true, "is now an admin"
+	case "demote":
+		user.Admin, done = false, "is no longer an admin"
+	case "disable":
+		user.Disabled, done = true, "has been disabled"
+	case "enable":
+		user.Disabled, done = false, "has been enabled"
+	case "reset":
+		user.MustChangePassword, done = true, "has to choose a new password at the next login"
+	case "expire":
+		if user.ExpiresAt, err = parseExpiry(r.PostFormValue("expires")); err != nil {
+			renderAdmin(w, r, "", err.Error()+".")
+			return
+		}
+		done = "does not expire"
+		if !user.ExpiresAt.IsZero() {
+			done = "expires " + user.ExpiresAt.Format("2006-01-02 15:04")
+		}
+	case "approve":
+		done = "has been approved"
+	case "delete":
+		done = "has been deleted"
+	default:
+		http.Error(w, "Unknown action.", http.StatusBadRequest)
+		return
+	}
+	switch action {
+	case "approve":
+		err = approveUser(user)
+	case "delete":
+		err = deleteUser(name)
+	default:
+		err = users.Update(user)
+	}
+
+	switch err {
+	case nil:
+		logger.WithFields(logrus.Fields{"admin": admin.Name, "user": name, "action": action}).Info("User changed by admin")
+		audit(r, EventAdmin, name, admin.Name, name+" "+done)
+		renderAdmin(w, r, "", name+" "+done+".")
+	case ErrReadOnly, ErrNotSupported:
+		renderAdmin(w, r, "", "The user store does not support this.")
+	default:
+		logger.WithFields(logrus.Fields{"admin": admin.Name, "user": name, "action": action, "err": err}).Error("Changing user")
+		renderAdmin(w, r, "", "Unable to change "+name+": "+err.Error())
+	}
+}
+
+//deleteUser removes an account together with the state kept about it elsewhere.
+func deleteUser(username string) error {
+	if err := users.Delete(username); err != nil {
+		return err
+	}
+	if err := deletePasskeys(username); err != nil {
+		logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Removing passkeys of deleted user")
+	}
+	if err := deleteAPITokens(username); err != nil {
+		logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Revoking tokens of deleted user")
+	}
+	if err := deleteSessions(username); err != nil {
+		logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Removing sessions of deleted user")
+	}
+	throttle.Unlock(userThrottleKey(username))
+	return nil
+}
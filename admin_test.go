@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSearchUsers(t *testing.T) {
+	list := []User{
+		{Name: "alice", Email: "alice@example.com"},
+		{Name: "bob", Email: "bob@Example.org"},
+		{Name: "carol"},
+	}
+	for query, want := range map[string]int{"": 3, "ALI": 1, "example": 2, ".org": 1, "dave": 0} {
+		if got := searchUsers(list, query); len(got) != want {
+			t.Errorf("searchUsers(%q) found %d users, expected %d", query, len(got), want)
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	store = sessions.NewCookieStore(securecookie.GenerateRandomKey(64))
+	handler := CSRFMW{http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+
+	rec := httptest.NewRecorder()
+	token := csrfToken(rec, httptest.NewRequest("GET", "/proxy/admin", nil))
+	cookie := rec.Header().Get("Set-Cookie")
+	if token == "" || cookie == "" {
+		t.Fatal("No token was stored in the session")
+	}
+
+	post := func(token string, withCookie bool) int {
+		r := httptest.NewRequest("POST", "/proxy/admin/users", strings.NewReader(url.Values{csrfField: {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if withCookie {
+			r.Header.Set("Cookie", strings.SplitN(cookie, ";", 2)[0])
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	if code := post(token, true); code != http.StatusOK {
+		t.Errorf("Post with the token: %d", code)
+	}
+	if code := post("forged", true); code != http.StatusForbidden {
+		t.Errorf("Post with a wrong token: %d", code)
+	}
+	if code := post(token, false); code != http.StatusForbidden {
+		t.Errorf("Post without a session: %d", code)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	if e, err := parseExpiry("never"); err != nil || !e.IsZero() {
+		t.Errorf("never = %v, %v", e, err)
+	}
+	e, err := parseExpiry("2030-06-15")
+	if err != nil || e.Format("2006-01-02 15:04") != "2030-06-16 00:00" {
+		t.Errorf("A plain date should expire at the end of the day: %v, %v", e, err)
+	}
+	if _, err := parseExpiry("next week"); err != ErrInvalidExpiry {
+		t.Errorf("Garbage: %v. Expected ErrInvalidExpiry", err)
+	}
+}
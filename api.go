@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+//The admin API under /proxy/api/v1, for provisioning accounts from scripts.
+//Callers send an API token with the admin scope as a bearer token. Everything else is JSON.
+
+//apiUser is how a User is shown through the API. Hashes and secrets are left out.
+type apiUser struct {
+	Name               string     `json:"name"`
+	Email              string     `json:"email,omitempty"`
+	Admin              bool       `json:"admin"`
+	Disabled           bool       `json:"disabled"`
+	Pending            bool       `json:"pending"`
+	Unverified         bool       `json:"unverified"`
+	MustChangePassword bool       `json:"must_change_password"`
+	TOTP               bool       `json:"totp"`
+	CreatedAt          *time.Time `json:"created_at,omitempty"`
+	ExpiresAt          *time.Time `json:"expires_at,omitempty"`
+}
+
+//timeOrNil leaves zero times out of the JSON.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func newAPIUser(u User) apiUser {
+	return apiUser{
+		Name:               u.Name,
+		Email:              u.Email,
+		Admin:              u.Admin,
+		Disabled:           u.Disabled,
+		Pending:            u.Pending,
+		Unverified:         u.Unverified,
+		MustChangePassword: u.MustChangePassword,
+		TOTP:               len(u.TOTPSecret) > 0,
+		CreatedAt:          timeOrNil(u.CreatedAt),
+		ExpiresAt:          timeOrNil(u.ExpiresAt),
+	}
+}
+
+//apiUserChange is the body of a create or update. Fields left out are not changed.
+type apiUserChange struct {
+	Name               string  `json:"name"`
+	Password           *string `json:"password"`
+	Email              *string `json:"email"`
+	Admin              *bool   `json:"admin"`
+	Disabled           *bool   `json:"disabled"`
+	Pending            *bool   `json:"pending"`
+	MustChangePassword *bool   `json:"must_change_password"`
+	ExpiresAt          *string `json:"expires_at"` //A time, a date or never, as parseExpiry takes it
+}
+
+//apply copies the given fields to the user and checks the new email address and expiry.
+func (c apiUserChange) apply(user *User) error {
+	if c.Email != nil {
+		if *c.Email != "" {
+			if _, err := mail.ParseAddress(*c.Email); err != nil {
+				return ErrInvalidAddress
+			}
+		}
+		user.Email = *c.Email
+	}
+	if c.Admin != nil {
+		user.Admin = *c.Admin
+	}
+	if c.Disabled != nil {
+		user.Disabled = *c.Disabled
+	}
+	if c.Pending != nil {
+		user.Pending = *c.Pending
+	}
+	if c.MustChangePassword != nil {
+		user.MustChangePassword = *c.MustChangePassword
+	}
+	if c.ExpiresAt != nil {
+		expires, err := parseExpiry(*c.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		user.ExpiresAt = expires
+	}
+	return nil
+}
+
+type apiContextKey int
+
+const apiAdminKey apiContextKey = 0
+
+//APIAuthMW lets requests through that carry a token with the admin scope of a user who is still an active admin.
+type APIAuthMW struct {
+	Wrapped http.Handler
+}
+
+func (a APIAuthMW) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="authprox"`)
+		apiError(w, http.StatusUnauthorized, "An API token is required.")
+		return
+	}
+	token, err := checkAPIToken(strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"method": r.Method,
+			"url":    r.URL,
+			"client": r.RemoteAddr,
+		}).Info("API token rejected.")
+		w.Header().Set("WWW-Authenticate", `Bearer realm="authprox", error="invalid_token"`)
+		apiError(w, http.StatusUnauthorized, ErrInvalidToken.Error()+".")
+		return
+	}
+	admin, err := users.Get(token.User)
+	if err != nil || !admin.Admin || !admin.Active() || !token.HasScope(ScopeAdmin) {
+		apiError(w, http.StatusForbidden, "Only admins may do this.")
+		return
+	}
+	a.Wrapped.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiAdminKey, admin)))
+}
+
+//apiAdmin returns the admin whose token let the request through.
+func apiAdmin(r *http.Request) User {
+	admin, _ := r.Context().Value(apiAdminKey).(User)
+	return admin
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+//apiUserError answers with the status that fits an error from the UserManager or the password policy.
+func apiUserError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrUnknownUser:
+		apiError(w, http.StatusNotFound, "No such user.")
+	case ErrUserExists:
+		apiError(w, http.StatusConflict, "The user already exists.")
+	case ErrReadOnly, ErrNotSupported:
+		apiError(w, http.StatusNotImplemented, "The user store does not support this.")
+	case ErrInvalidAddress:
+		apiError(w, http.StatusBadRequest, "The email address is not valid.")
+	case ErrInvalidExpiry:
+		apiError(w, http.StatusBadRequest, err.Error()+".")
+	default:
+		if _, ok := err.(PolicyViolation); ok {
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		logger.WithField("err", err).Error("API request failed")
+		apiError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func setupAPIHandlers(api *mux.Router) {
+	handle := func(path, method string, h http.HandlerFunc) {
+		api.Path(path).Methods(method).Handler(LoggingMW(APIAuthMW{h}))
+	}
+	handle("/users", "GET", apiListUsers)
+	handle("/users", "POST", apiCreateUser)
+	handle("/users/export", "GET", apiExportUsers) //Before /users/{name}, which would match it too
+	handle("/users/import", "POST", apiImportUsers)
+	handle("/users/{name}", "GET", apiGetUser)
+	handle("/users/{name}", "PATCH", apiUpdateUser)
+	handle("/users/{name}", "DELETE", apiDeleteUser)
+	handle("/sessions", "GET", apiListSessions)
+	handle("/audit", "GET", apiListAudit)
+}
+
+func apiListUsers(w http.ResponseWriter, r *http.Request) {
+	list, err := users.List()
+	if err != nil {
+		apiUserError(w, err)
+		return
+	}
+	res := []apiUser{}
+	for _, u := range searchUsers(list, r.URL.Query().Get("q")) {
+		res = append(res, newAPIUser(u))
+	}
+	writeJSON(w, res)
+}
+
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	user, err := users.Get(mux.Vars(r)["name"])
+	if err != nil {
+		apiUserError(w, ErrUnknownUser)
+		return
+	}
+	writeJSON(w, newAPIUser(user))
+}
+
+func apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	var req apiUserChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || req.Password == nil {
+		apiError(w, http.StatusBadRequest, "A name and password are required.")
+		return
+	}
+	user := User{Name: req.Name}
+	if err := req.apply(&user); err != nil {
+		apiUserError(w, err)
+		return
+	}
+	if err := passwordPolicy.Check(req.Name, *req.Password); err != nil {
+		apiUserError(w, err)
+		return
+	}
+	if err := users.Register(user, *req.Password); err != nil {
+		apiUserError(w, err)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": apiAdmin(r).Name, "user": user.Name}).Info("User created through API")
+	audit(r, EventAdmin, user.Name, apiAdmin(r).Name, "Created through the API")
+	user, err := users.Get(user.Name)
+	if err != nil {
+		apiUserError(w, err)
+		return
+	}
+	w.Header().Set("Location", "/proxy/api/v1/users/"+user.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newAPIUser(user))
+}
+
+func apiUpdateUser(w http.ResponseWriter, r *http.Request) {
+	admin := apiAdmin(r)
+	user, err := users.Get(mux.Vars(r)["name"])
+	if err != nil {
+		apiUserError(w, ErrUnknownUser)
+		return
+	}
+	var req apiUserChange
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, http.StatusBadRequest, "Malformed request.")
+		return
+	}
+	if req.Name != "" && req.Name != user.Name {
+		apiError(w, http.StatusBadRequest, "Users can not be renamed.")
+		return
+	}
+	if user.Name == admin.Name && ((req.Admin != nil && !*req.Admin) || (req.Disabled != nil && *req.Disabled)) {
+		apiError(w, http.StatusForbidden, "You can not lock yourself out. Ask another admin to do this.")
+		return
+	}
+	if err := req.apply(&user); err != nil {
+		apiUserError(w, err)
+		return
+	}
+	if req.Password != nil {
+		if err := passwordPolicy.Check(user.Name, *req.Password); err != nil {
+			apiUserError(w, err)
+			return
+		}
+		if err := user.SetPassword(*req.Password); err != nil {
+			apiUserError(w, err)
+			return
+		}
+	}
+	if err := users.Update(user); err != nil {
+		apiUserError(w, err)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "user": user.Name}).Info("User changed through API")
+	audit(r, EventAdmin, user.Name, admin.Name, "Changed through the API")
+	writeJSON(w, newAPIUser(user))
+}
+
+func apiDeleteUser(w http.ResponseWriter, r *http.Request) {
+	admin := apiAdmin(r)
+	name := mux.Vars(r)["name"]
+	if name == admin.Name {
+		apiError(w, http.StatusForbidden, "You can not lock yourself out. Ask another admin to do this.")
+		return
+	}
+	if _, err := users.Get(name); err != nil {
+		apiUserError(w, ErrUnknownUser)
+		return
+	}
+	if err := deleteUser(name); err != nil {
+		apiUserError(w, err)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "user": name}).Info("User deleted through API")
+	audit(r, EventAdmin, name, admin.Name, "Deleted through the API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//maxImportSize limits the body of an import, which is read into memory whole.
+const maxImportSize = 32 << 20
+
+func apiExportUsers(w http.ResponseWriter, r *http.Request) {
+	format, err := formatOf(r.URL.Query().Get("format"), "")
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error()+".")
+		return
+	}
+	var buf bytes.Buffer
+	n, err := exportUsers(&buf, format)
+	if err != nil {
+		apiUserError(w, err)
+		return
+	}
+	admin := apiAdmin(r)
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "users": n, "format": format}).Info("Users exported through API")
+	audit(r, EventAdmin, "", admin.Name, fmt.Sprintf("Exported %d users as %s through the API", n, format))
+	w.Header().Set("Content-Type", map[string]string{FormatJSON: "application/json", FormatCSV: "text/csv"}[format])
+	w.Header().Set("Content-Disposition", "attachment; filename=users."+format)
+	buf.WriteTo(w)
+}
+
+//apiImportUsers takes the format from the format parameter or else the Content-Type, and overwrites existing users
+//only when overwrite=true is given.
+func apiImportUsers(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		format = FormatCSV
+	}
+	format, err := formatOf(format, "")
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error()+".")
+		return
+	}
+	list, err := readUsers(http.MaxBytesReader(w, r.Body, maxImportSize), format)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "The import is not valid: "+err.Error())
+		return
+	}
+	res, err := importUsers(list, r.URL.Query().Get("overwrite") == "true")
+	admin := apiAdmin(r)
+	if res.Added+res.Updated > 0 {
+		logger.WithFields(logrus.Fields{"admin": admin.Name, "added": res.Added, "updated": res.Updated}).Info("Users imported through API")
+		audit(r, EventAdmin, "", admin.Name, fmt.Sprintf("Imported users through the API, %d added and %d updated", res.Added, res.Updated))
+	}
+	if err != nil {
+		apiUserError(w, err)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func apiListSessions(w http.ResponseWriter, r *http.Request) {
+	list, err := listSessions(r.URL.Query().Get("user"))
+	if err != nil {
+		apiUserError(w, err)
+		return
+	}
+	if list == nil {
+		list = []SessionInfo{}
+	}
+	writeJSON(w, list)
+}
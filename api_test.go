@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPITokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stateDB = db
+	selectAPITokens()
+
+	token, stored, err := newAPIToken("alice", "script", []string{ScopeAdmin}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := checkAPIToken(token); err != nil || got.User != "alice" || !got.HasScope(ScopeAdmin) || got.LastUsed.IsZero() {
+		t.Errorf("checkAPIToken = %+v, %v", got, err)
+	}
+	if _, err := checkAPIToken(token[:len(token)-1] + "x"); err != ErrInvalidToken {
+		t.Errorf("Wrong secret: %v. Expected ErrInvalidToken", err)
+	}
+
+	expired, _, _ := newAPIToken("alice", "old", []string{ScopeAdmin}, time.Now().Add(-time.Minute))
+	if _, err := checkAPIToken(expired); err != ErrInvalidToken {
+		t.Errorf("Expired token: %v. Expected ErrInvalidToken", err)
+	}
+
+	if err := revokeAPIToken("bob", stored.ID); err != ErrInvalidToken {
+		t.Errorf("Revoking the token of another user: %v. Expected ErrInvalidToken", err)
+	}
+	if err := revokeAPIToken("alice", stored.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkAPIToken(token); err != ErrInvalidToken {
+		t.Errorf("Revoked token: %v. Expected ErrInvalidToken", err)
+	}
+}
+
+func TestAPIUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	um, err := NewBoltUserManager(filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	users, stateDB = um, um.DB
+	selectAPITokens()
+	selectSessionRegistry()
+	if throttle, err = NewThrottle(stateDB); err != nil {
+		t.Fatal(err)
+	}
+
+	um.Register(User{Name: "admin"}, "correct horse battery staple")
+	token, _, _ := newAPIToken("admin", "test", []string{ScopeAdmin}, time.Time{})
+	router := mux.NewRouter()
+	setupAPIHandlers(router.PathPrefix("/proxy/api/v1").Subrouter())
+
+	do := func(method, path, body, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("GET", "/proxy/api/v1/users", "", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Without token: %d", w.Code)
+	}
+	if w := do("POST", "/proxy/api/v1/users", `{"name": "bob", "password": "short"}`, token); w.Code != http.StatusBadRequest {
+		t.Errorf("Weak password: %d", w.Code)
+	}
+	if w := do("POST", "/proxy/api/v1/users", `{"name": "bob", "password": "tr0ub4dor&3 is long", "email": "bob@example.com"}`, token); w.Code != http.StatusCreated {
+		t.Fatalf("Creating user: %d %s", w.Code, w.Body)
+	}
+	if w := do("POST", "/proxy/api/v1/users", `{"name": "bob", "password": "tr0ub4dor&3 is long"}`, token); w.Code != http.StatusConflict {
+		t.Errorf("Creating user twice: %d", w.Code)
+	}
+	if !um.Authenticate("bob", "tr0ub4dor&3 is long") {
+		t.Error("Created user can not log in")
+	}
+
+	if w := do("PATCH", "/proxy/api/v1/users/bob", `{"disabled": true}`, token); w.Code != http.StatusOK {
+		t.Errorf("Disabling user: %d %s", w.Code, w.Body)
+	}
+	if w := do("PATCH", "/proxy/api/v1/users/admin", `{"admin": false}`, token); w.Code != http.StatusForbidden {
+		t.Errorf("Demoting oneself: %d", w.Code)
+	}
+
+	var list []apiUser
+	w := do("GET", "/proxy/api/v1/users?q=example", "", token)
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list) != 1 || !list[0].Disabled {
+		t.Errorf("Searching users: %v, %+v", err, list)
+	}
+
+	if w := do("DELETE", "/proxy/api/v1/users/bob", "", token); w.Code != http.StatusNoContent {
+		t.Errorf("Deleting user: %d", w.Code)
+	}
+	if w := do("GET", "/proxy/api/v1/users/bob", "", token); w.Code != http.StatusNotFound {
+		t.Errorf("Deleted user: %d", w.Code)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//The audit log keeps security events, like logins and admin actions, so it can be answered later who did what and when.
+//Events are appended to a Bolt bucket under increasing sequence numbers and never changed, only pruned when they get too old.
+
+//An AuditEvent is one entry in the audit log.
+type AuditEvent struct {
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	User    string    `json:"user,omitempty"`    //Whom the event is about
+	Actor   string    `json:"actor,omitempty"`   //Who caused it, when not the user, like an admin
+	Client  string    `json:"client,omitempty"`  //Address of the client, or cli for user commands
+	Details string    `json:"details,omitempty"` //Like the reason a login failed or what an admin changed
+}
+
+const (
+	EventLogin          = "login"
+	EventLoginFailed    = "login_failed"
+	EventLogout         = "logout"
+	EventRegister       = "register"
+	EventLockout        = "lockout"
+	EventPasswordChange = "password_change"
+	EventPasswordReset  = "password_reset"
+	EventAdmin          = "admin"
+	EventToken          = "token" //A user made or revoked a personal access token
+)
+
+//The event types, in the order the query page lists them.
+var eventTypes = []string{EventLogin, EventLoginFailed, EventLogout, EventRegister, EventLockout, EventPasswordChange, EventPasswordReset, EventAdmin, EventToken}
+
+//An AuditFilter selects events. Empty fields match everything.
+type AuditFilter struct {
+	User   string
+	Client string
+	Type   string
+	Since  time.Time
+	Until  time.Time
+	Limit  int //Defaults to defaultAuditLimit
+}
+
+func (f AuditFilter) match(e AuditEvent) bool {
+	return (f.User == "" || e.User == f.User || e.Actor == f.User) &&
+		(f.Client == "" || e.Client == f.Client) &&
+		(f.Type == "" || e.Type == f.Type) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+var BoltBucketAudit = []byte("audit") //Sequence number to AuditEvent
+
+const (
+	defaultAuditRetention = 365 * 24 * time.Hour
+	defaultAuditLimit     = 100
+	maxAuditLimit         = 10000
+)
+
+//An AuditLog stores events in a Bolt database.
+type AuditLog struct {
+	db        *bolt.DB
+	Retention time.Duration //Events older than this are pruned
+}
+
+var auditLog *AuditLog
+
+func selectAuditLog() {
+	var err error
+	auditLog, err = NewAuditLog(stateDB)
+	if err != nil {
+		logger.WithField("err", err).Fatal("Unable to create audit bucket.")
+	}
+	if config.Audit.Retention > 0 {
+		auditLog.Retention = time.Duration(config.Audit.Retention)
+	}
+}
+
+func NewAuditLog(db *bolt.DB) (*AuditLog, error) {
+	if err := ensureBuckets(db, BoltBucketAudit); err != nil {
+		return nil, err
+	}
+	return &AuditLog{db: db, Retention: defaultAuditRetention}, nil
+}
+
+func auditKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+//Record appends an event. The time is set if it is zero.
+func (a *AuditLog) Record(e AuditEvent) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketAudit)
+		var err error
+		if e.ID, err = b.NextSequence(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put(auditKey(e.ID), data)
+	})
+}
+
+//Query returns the events that match the filter, newest first.
+func (a *AuditLog) Query(f AuditFilter) (list []AuditEvent, err error) {
+	if f.Limit <= 0 {
+		f.Limit = defaultAuditLimit
+	}
+	if f.Limit > maxAuditLimit {
+		f.Limit = maxAuditLimit
+	}
+	err = a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(BoltBucketAudit).Cursor()
+		for k, v := c.Last(); k != nil && len(list) < f.Limit; k, v = c.Prev() {
+			var e AuditEvent
+			if json.Unmarshal(v, &e) != nil {
+				continue
+			}
+			if !f.Since.IsZero() && e.Time.Before(f.Since) {
+				break //Everything further back is older still
+			}
+			if f.match(e) {
+				list = append(list, e)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+//Prune removes the events that have outlived the retention and returns how many there were.
+func (a *AuditLog) Prune() (n int, err error) {
+	cutoff := time.Now().Add(-a.Retention)
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketAudit)
+		var old [][]byte
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var e AuditEvent
+			if json.Unmarshal(v, &e) != nil {
+				continue //Kept for someone to look at
+			}
+			if !e.Time.Before(cutoff) {
+				break
+			}
+			old = append(old, append([]byte(nil), k...))
+		}
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	return
+}
+
+//pruneAuditLog prunes once a day for as long as the server runs.
+func pruneAuditLog() {
+	for ; ; time.Sleep(24 * time.Hour) {
+		n, err := auditLog.Prune()
+		if err != nil {
+			logger.WithField("err", err).Error("Pruning audit log")
+		} else if n > 0 {
+			logger.WithField("events", n).Info("Pruned audit log")
+		}
+	}
+}
+
+//audit records an event caused by a request. Failures are logged, since they should not stop the request.
+func audit(r *http.Request, typ, user, actor, details string) {
+	client := "cli"
+	if r != nil {
+		client = clientAddress(r)
+	}
+	recordEvent(AuditEvent{Type: typ, User: user, Actor: actor, Client: client, Details: details})
+}
+
+func recordEvent(e AuditEvent) {
+	if auditLog == nil {
+		return
+	}
+	if err := auditLog.Record(e); err != nil {
+		logger.WithFields(logrus.Fields{"type": e.Type, "user": e.User, "err": err}).Error("Recording audit event")
+	}
+}
+
+//parseAuditFilter reads a filter from query parameters. Times may be dates or RFC 3339; until includes the whole of a date.
+func parseAuditFilter(r *http.Request) (f AuditFilter, err error) {
+	q := r.URL.Query()
+	f.User, f.Client, f.Type = q.Get("user"), q.Get("client"), q.Get("type")
+	if s := q.Get("since"); s != "" {
+		if f.Since, err = parseAuditTime(s, false); err != nil {
+			return
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if f.Until, err = parseAuditTime(s, true); err != nil {
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func parseAuditTime(s string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err == nil && endOfDay {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, err
+}
+
+var auditContent = template.Must(template.New("audit").Parse(`
+	<form method="GET" action="/proxy/admin/audit">
+		<input type="text" name="user" value="{{.Filter.User}}" placeholder="User">
+		<input type="text" name="client" value="{{.Filter.Client}}" placeholder="Client address">
+		<select name="type">
+			<option value="">All events</option>
+			{{range .Types}}<option{{if eq . $.Filter.Type}} selected{{end}}>{{.}}</option>{{end}}
+		</select>
+		<input type="date" name="since" value="{{.Since}}">
+		<input type="date" name="until" value="{{.Until}}">
+		<input type="submit" value="Filter">
+	</form>
+	<table class="admin">
+	{{range .Events}}
+		<tr>
+			<td>{{.Time.Format "2006-01-02 15:04:05"}}</td>
+			<td>{{.Type}}</td>
+			<td>{{.User}}{{with .Actor}} by {{.}}{{end}}</td>
+			<td>{{.Client}}</td>
+			<td>{{.Details}}</td>
+		</tr>
+	{{else}}
+		<tr><td>No events found.</td></tr>
+	{{end}}
+	</table>`))
+
+func getAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(r); !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	page := Page{Title: "Audit Log"}
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		page.Message = "The filter is not valid: " + err.Error()
+	}
+	list, err := auditLog.Query(f)
+	if err != nil {
+		logger.WithField("err", err).Error("Querying audit log")
+	}
+	page.Content = renderContent(auditContent, map[string]interface{}{
+		"Filter": f,
+		"Types":  eventTypes,
+		"Since":  r.URL.Query().Get("since"),
+		"Until":  r.URL.Query().Get("until"),
+		"Events": list,
+	})
+	renderer.Render(w, page)
+}
+
+func apiListAudit(w http.ResponseWriter, r *http.Request) {
+	f, err := parseAuditFilter(r)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "The filter is not valid: "+err.Error())
+		return
+	}
+	list, err := auditLog.Query(f)
+	if err != nil {
+		apiUserError(w, err)
+		return
+	}
+	if list == nil {
+		list = []AuditEvent{}
+	}
+	writeJSON(w, list)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tempAuditLog(t *testing.T) (*AuditLog, func()) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, boltOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuditLog(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, func() { db.Close(); os.RemoveAll(dir) }
+}
+
+func TestAuditQuery(t *testing.T) {
+	a, done := tempAuditLog(t)
+	defer done()
+	now := time.Now()
+	for _, e := range []AuditEvent{
+		{Time: now.Add(-72 * time.Hour), Type: EventLogin, User: "alice", Client: "10.0.0.1"},
+		{Time: now.Add(-48 * time.Hour), Type: EventLoginFailed, User: "bob", Client: "10.0.0.2"},
+		{Time: now.Add(-24 * time.Hour), Type: EventAdmin, User: "bob", Actor: "alice", Client: "10.0.0.1"},
+		{Type: EventLogout, User: "alice", Client: "10.0.0.1"},
+	} {
+		if err := a.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := a.Query(AuditFilter{})
+	if err != nil || len(all) != 4 {
+		t.Fatalf("Query found %d events, %v. Expected 4", len(all), err)
+	}
+	if all[0].Type != EventLogout || all[0].ID != 4 {
+		t.Errorf("Newest event first expected, got %+v", all[0])
+	}
+	for _, c := range []struct {
+		filter AuditFilter
+		want   int
+	}{
+		{AuditFilter{User: "alice"}, 3}, //Including what alice did to bob
+		{AuditFilter{User: "bob", Type: EventLoginFailed}, 1},
+		{AuditFilter{Client: "10.0.0.1"}, 3},
+		{AuditFilter{Since: now.Add(-50 * time.Hour)}, 3},
+		{AuditFilter{Since: now.Add(-50 * time.Hour), Until: now.Add(-time.Hour)}, 2},
+		{AuditFilter{Limit: 1}, 1},
+	} {
+		if list, _ := a.Query(c.filter); len(list) != c.want {
+			t.Errorf("Query(%+v) found %d events, expected %d", c.filter, len(list), c.want)
+		}
+	}
+}
+
+func TestAuditPrune(t *testing.T) {
+	a, done := tempAuditLog(t)
+	defer done()
+	a.Retention = 30 * 24 * time.Hour
+	a.Record(AuditEvent{Time: time.Now().AddDate(0, 0, -40), Type: EventLogin, User: "alice"})
+	a.Record(AuditEvent{Time: time.Now().AddDate(0, 0, -10), Type: EventLogin, User: "alice"})
+	if n, err := a.Prune(); n != 1 || err != nil {
+		t.Errorf("Prune removed %d events, %v. Expected 1", n, err)
+	}
+	if list, _ := a.Query(AuditFilter{}); len(list) != 1 {
+		t.Errorf("%d events left, expected 1", len(list))
+	}
+}
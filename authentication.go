@@ -2,13 +2,18 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha512"
-	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"github.com/Sirupsen/logrus"
 	"github.com/boltdb/bolt"
-	"github.com/gorilla/securecookie"
-	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
 )
 
 type Authenticator interface {
@@ -20,19 +25,140 @@ type User struct {
 	Admin    bool
 	Passhash Key
 	Salt     Key
+	Email    string //Where password reset links are sent. May be empty
+
+	Unverified bool //Registered, but the email address has not been confirmed yet. Such users can not log in
+	Pending    bool //Registered, but waiting for an admin to approve. Such users can not log in
+	Disabled   bool //Turned off by an admin. Such users can not log in
+
+	MustChangePassword bool //Set by an admin. The user has to choose a new password at the next login
+
+	CreatedAt time.Time //When the user registered. Zero if the store does not keep it, or for users from before it was recorded
+	ExpiresAt time.Time //The user can not log in from this time on. Zero if the account does not expire
+
+	TOTPSecret    Key   //Empty unless two-factor authentication is enabled
+	TOTPLastStep  int64 //Time step of the last accepted TOTP code. Codes of this or an earlier step are refused
+	RecoveryCodes []Key //SHA-256 sums of the unused recovery codes
+}
+
+//A ContextAuthenticator tells who logged in, or why not. The error is
+//	ErrUnknownUser or ErrWrongPassword for bad credentials,
+//	ErrDisabled, ErrExpired, ErrUnverified or ErrPending for an account that may not log in, together with the user,
+//	a BackendError when the user store could not be asked, or the error of ctx once it is done.
+//The state of an account is only told after the password matched, so it can not be probed for.
+type ContextAuthenticator interface {
+	AuthenticateContext(ctx context.Context, user, password string) (User, error)
+}
+
+//A SecondFactorStore records that a second factor was used in one step with the check that it was not used before,
+//so parallel requests can not get in with the same code. The error is ErrCodeUsed if it was.
+type SecondFactorStore interface {
+	//UseTOTPStep stores the time step of an accepted TOTP code, if it is after the stored one.
+	UseTOTPStep(username string, step int64) error
+	//UseRecoveryCode removes a recovery code by its hash, if the user still has it.
+	UseRecoveryCode(username string, hash Key) error
+}
+
+//A BackendError is a failure of the user store itself, like a database or directory that can not be reached.
+type BackendError struct {
+	Err error
+}
+
+func (e BackendError) Error() string {
+	return "The user store is unavailable: " + e.Err.Error()
+}
+
+//inactiveReason tells why a user may not log in, or is nil for Active users.
+func (u User) inactiveReason() error {
+	switch {
+	case u.Disabled:
+		return ErrDisabled
+	case u.Expired():
+		return ErrExpired
+	case u.Unverified:
+		return ErrUnverified
+	case u.Pending:
+		return ErrPending
+	}
+	return nil
+}
+
+//checkCredentials decides a login against a stored user as ContextAuthenticator describes, and tells whether the hash
+//should be upgraded.
+func checkCredentials(user User, password string) (rehash bool, err error) {
+	ok, rehash := VerifyPassword(user, password)
+	if !ok {
+		return false, ErrWrongPassword
+	}
+	if err := user.inactiveReason(); err != nil {
+		return false, err
+	}
+	return rehash, nil
+}
+
+//authenticate checks credentials against the configured users.
+func authenticate(ctx context.Context, username, password string) (User, error) {
+	return authenticateWith(ctx, users, username, password)
+}
+
+//authenticateWith checks credentials against um. Backends that only report success or failure are asked again
+//for the user to tell the reasons apart as far as possible.
+func authenticateWith(ctx context.Context, um UserManager, username, password string) (User, error) {
+	if ca, ok := um.(ContextAuthenticator); ok {
+		return ca.AuthenticateContext(ctx, username, password)
+	}
+	ok := um.Authenticate(username, password)
+	user, err := um.Get(username)
+	switch {
+	case err == ErrUnknownUser:
+		return User{}, ErrUnknownUser
+	case err != nil:
+		return User{}, BackendError{err}
+	case ok:
+		return user, nil
+	case user.Active():
+		return User{}, ErrWrongPassword
+	}
+	//The backend may keep passwords elsewhere, as LDAP does, so this only tells the state if it can check the password.
+	if _, err := checkCredentials(user, password); err != ErrWrongPassword {
+		return user, err
+	}
+	return User{}, ErrWrongPassword
+}
+
+//Active reports whether the user may log in at all, given the right credentials.
+func (u User) Active() bool {
+	return !u.Unverified && !u.Pending && !u.Disabled && !u.Expired()
 }
 
+//Expired reports whether the account has run out, as for contractors and guests.
+func (u User) Expired() bool {
+	return !u.ExpiresAt.IsZero() && !time.Now().Before(u.ExpiresAt)
+}
+
+//A UserManager stores users.
+//Register creates a user with the given password from the other fields of user. The first user becomes an admin.
+//Authenticate rejects users that are not Active.
 type UserManager interface {
 	Authenticator
-	Register(username, password string) error
+	Register(user User, password string) error
 	Update(user User) error
 	Get(username string) (User, error)
+	List() ([]User, error) //Sorted by name
+	Delete(username string) error
 }
 
 var (
 	ErrUnknownUser   = errors.New("User does not exist")
 	ErrUserExists    = errors.New("User already exists")
 	ErrWrongPassword = errors.New("Wrong password")
+	ErrReadOnly      = errors.New("The user store is read-only")
+	ErrNotSupported  = errors.New("Not supported by the user store")
+	ErrUnverified    = errors.New("The email address of the user has not been verified")
+	ErrPending       = errors.New("The user has not been approved by an admin yet")
+	ErrDisabled      = errors.New("The user has been disabled")
+	ErrExpired       = errors.New("The account of the user has expired")
+	ErrCodeUsed      = errors.New("The code has already been used")
 )
 
 //A Dummy User Manager implements the User Manager interface in the simplest way possible.
@@ -42,10 +168,24 @@ var (
 type DummyUserManager User
 
 func (d DummyUserManager) Authenticate(user, password string) bool {
-	if user == d.Name && bytes.Compare(HashAndSalt(password, d.Salt), d.Passhash) == 0 {
-		return true
+	_, err := d.AuthenticateContext(context.Background(), user, password)
+	return err == nil
+}
+
+func (d DummyUserManager) AuthenticateContext(ctx context.Context, user, password string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	if user != d.Name {
+		return User{}, ErrUnknownUser
 	}
-	return false
+	if _, err := checkCredentials(User(d), password); err != nil {
+		if err == ErrWrongPassword {
+			return User{}, err
+		}
+		return User(d), err
+	}
+	return User(d), nil
 }
 
 func (d DummyUserManager) Get(user string) (User, error) {
@@ -55,39 +195,290 @@ func (d DummyUserManager) Get(user string) (User, error) {
 	return User{}, ErrUnknownUser
 }
 
-func (d *DummyUserManager) Register(user, password string) error {
-	d.Name, d.Passhash = user, HashAndSalt(password, d.Salt)
+func (d *DummyUserManager) Register(user User, password string) error {
+	user.Admin = true
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	*d = DummyUserManager(user)
 	return nil
 }
 
 func (d *DummyUserManager) Update(user User) error {
-	if d.Name == user.Name {
-		d.Passhash = user.Passhash
+	if d.Name != user.Name {
+		return ErrUnknownUser
 	}
-	return ErrUnknownUser
+	*d = DummyUserManager(user)
+	return nil
+}
+
+func (d DummyUserManager) List() ([]User, error) {
+	return []User{User(d)}, nil
+}
+
+func (d *DummyUserManager) Delete(user string) error {
+	return ErrNotSupported //There would be nobody left.
 }
 
 //A JsonUserManager is a User Manager backed by a JSON datastore on file.
 //The contents of the file is kept in memory during operation, but all changes are saved back to file immediately.
+//Changes are written to a temporary file that then replaces the datastore, so a crash never leaves a half-written file.
+//A lock file next to the datastore keeps other processes from using it at the same time.
 type JsonUserManager struct {
+	mu    sync.RWMutex
 	cache map[string]User
-	file  io.WriteSeeker
+	file  string
+	lock  *os.File
+}
+
+var (
+	ErrDatastoreLocked = errors.New("Datastore is locked by another process")
+)
+
+func NewJsonUserManager(file string) (um *JsonUserManager, err error) {
+	lock, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err, "file": file}).Error("Opening JSON datastore lock")
+		return
+	}
+	if err = lockFile(lock); err != nil {
+		lock.Close()
+		logger.WithFields(logrus.Fields{"err": err, "file": file}).Error("Locking JSON datastore")
+		return nil, ErrDatastoreLocked
+	}
+
+	um = &JsonUserManager{
+		cache: make(map[string]User),
+		file:  file,
+		lock:  lock,
+	}
+	if err = um.load(); err != nil {
+		logger.WithFields(logrus.Fields{"err": err, "file": file}).Error("Loading JSON datastore")
+		um.Close()
+		return nil, err
+	}
+	logger.WithFields(logrus.Fields{"file": file, "users": len(um.cache)}).Debug("JSON-user manager initialized")
+	return
+}
+
+//Close releases the lock on the datastore.
+func (um *JsonUserManager) Close() error {
+	unlockFile(um.lock)
+	return um.lock.Close()
+}
+
+func (um *JsonUserManager) Authenticate(username, password string) bool {
+	_, err := um.AuthenticateContext(context.Background(), username, password)
+	return err == nil
 }
 
-func (um JsonUserManager) Authenticate(username, password string) (authenticated bool) {
+func (um *JsonUserManager) AuthenticateContext(ctx context.Context, username, password string) (User, error) {
+	if err := ctx.Err(); err != nil {
+		return User{}, err
+	}
+	um.mu.RLock()
 	user, ok := um.cache[username]
+	um.mu.RUnlock()
 	if !ok {
-		return false
+		return User{}, ErrUnknownUser
 	}
-	hashsum := HashAndSalt(password, user.Salt)
-	if bytes.Compare(user.Passhash, hashsum) == 0 { //Compare to stored hash
-		authenticated = true
+	rehash, err := checkCredentials(user, password) //Compare to stored hash
+	switch {
+	case err == ErrWrongPassword:
+		return User{}, err
+	case err != nil:
+		return user, err
+	case rehash:
+		user = um.rehash(user, password)
 	}
-	return
+	return user, nil
+}
+
+//rehash stores a new hash of the checked password and returns the user as stored. The user is left alone
+//if it was deleted or its password changed since it was checked.
+func (um *JsonUserManager) rehash(checked User, password string) User {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	user, ok := um.cache[checked.Name]
+	if !ok || !bytes.Equal(user.Passhash, checked.Passhash) {
+		return checked
+	}
+	if err := user.SetPassword(password); err != nil {
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Upgrading password hash")
+		return checked
+	}
+	um.cache[user.Name] = user
+	if err := um.save(); err != nil {
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Upgrading password hash")
+	}
+	return user
+}
+
+func (um *JsonUserManager) Register(user User, password string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	if _, ok := um.cache[user.Name]; ok {
+		return ErrUserExists
+	}
+	user.Admin = user.Admin || len(um.cache) == 0 //First user becomes admin
+	if user.CreatedAt.IsZero() {
+		user.CreatedAt = time.Now()
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	um.cache[user.Name] = user
+	if err := um.save(); err != nil {
+		delete(um.cache, user.Name)
+		return err
+	}
+	return nil
+}
+
+func (um *JsonUserManager) Update(user User) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	old, ok := um.cache[user.Name]
+	if !ok {
+		return ErrUnknownUser
+	}
+	um.cache[user.Name] = user
+	if err := um.save(); err != nil {
+		um.cache[user.Name] = old
+		return err
+	}
+	return nil
+}
+
+//modify changes a user under the lock, so nothing else can change it in between.
+func (um *JsonUserManager) modify(username string, change func(user *User) error) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	old, ok := um.cache[username]
+	if !ok {
+		return ErrUnknownUser
+	}
+	user := old
+	if err := change(&user); err != nil {
+		return err
+	}
+	um.cache[username] = user
+	if err := um.save(); err != nil {
+		um.cache[username] = old
+		return err
+	}
+	return nil
 }
 
+func (um *JsonUserManager) UseTOTPStep(username string, step int64) error {
+	return um.modify(username, func(user *User) error { return user.useTOTPStep(step) })
+}
+
+func (um *JsonUserManager) UseRecoveryCode(username string, hash Key) error {
+	return um.modify(username, func(user *User) error { return user.removeRecoveryCode(hash) })
+}
+
+func (um *JsonUserManager) Get(username string) (User, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	if user, ok := um.cache[username]; ok {
+		return user, nil
+	}
+	return User{}, ErrUnknownUser
+}
+
+func (um *JsonUserManager) List() ([]User, error) {
+	um.mu.RLock()
+	defer um.mu.RUnlock()
+	list := make([]User, 0, len(um.cache))
+	for _, user := range um.cache {
+		list = append(list, user)
+	}
+	sort.Sort(usersByName(list))
+	return list, nil
+}
+
+func (um *JsonUserManager) Delete(username string) error {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	old, ok := um.cache[username]
+	if !ok {
+		return ErrUnknownUser
+	}
+	delete(um.cache, username)
+	if err := um.save(); err != nil {
+		um.cache[username] = old
+		return err
+	}
+	return nil
+}
+
+//load reads the datastore into the cache. A missing file is an empty datastore.
+func (um *JsonUserManager) load() error {
+	f, err := os.Open(um.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var list []User
+	if err := json.NewDecoder(f).Decode(&list); err != nil {
+		return err
+	}
+	for _, user := range list {
+		um.cache[user.Name] = user
+	}
+	return nil
+}
+
+//save writes the cache to a temporary file in the same directory and renames it over the datastore.
+//The caller must hold the write lock.
+func (um *JsonUserManager) save() error {
+	list := make([]User, 0, len(um.cache))
+	for _, user := range um.cache {
+		list = append(list, user)
+	}
+	sort.Sort(usersByName(list))
+
+	tmp, err := ioutil.TempFile(filepath.Dir(um.file), filepath.Base(um.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(tmp)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(list)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), um.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.WithFields(logrus.Fields{"err": err, "file": um.file}).Error("Saving JSON datastore")
+	}
+	return err
+}
+
+type usersByName []User
+
+func (u usersByName) Len() int           { return len(u) }
+func (u usersByName) Less(i, j int) bool { return u[i].Name < u[j].Name }
+func (u usersByName) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+
 //HashAndSalt takes a user-supplied password and a server generated salt and creates the corresponding hash.
-// The hash-algorithm used can be changed and is left as an implementation detail.
+//It is the legacy SHA-512 scheme, kept to verify old hashes until they are upgraded. New passwords use HashPassword.
 func HashAndSalt(password string, salt []byte) []byte {
 	hasher := sha512.New()
 	hasher.Write([]byte(password))
@@ -95,10 +486,6 @@ func HashAndSalt(password string, salt []byte) []byte {
 	return hasher.Sum(make([]byte, 0, sha512.Size)) //Calculate sum
 }
 
-func init() {
-	gob.Register(User{})
-}
-
 type BoltUserManager struct {
 	*bolt.DB
 }
@@ -108,7 +495,7 @@ var (
 )
 
 func NewBoltUserManager(file string) (bum *BoltUserManager, err error) {
-	db, err := bolt.Open(file, 0600, nil)
+	db, err := bolt.Open(file, 0600, boltOptions)
 	if err != nil {
 		logger.WithFields(logrus.Fields{"err": err, "file": file}).Error("Opening Bolt DB")
 		return
@@ -119,6 +506,12 @@ func NewBoltUserManager(file string) (bum *BoltUserManager, err error) {
 	})
 	if err != nil {
 		logger.WithFields(logrus.Fields{"err": err, "file": file}).Error("Creating top-level buckets")
+		db.Close()
+		return
+	}
+	if _, err = migrateBoltUsers(db, false); err != nil {
+		logger.WithFields(logrus.Fields{"err": err, "file": file}).Error("Migrating Bolt schema")
+		db.Close()
 		return
 	}
 	logger.WithFields(logrus.Fields{"file": file}).Debug("Bolt-user manager initialized")
@@ -128,39 +521,88 @@ func NewBoltUserManager(file string) (bum *BoltUserManager, err error) {
 }
 
 func (bum BoltUserManager) Authenticate(username, password string) bool {
-	err := bum.View(func(tx *bolt.Tx) error {
+	_, err := bum.AuthenticateContext(context.Background(), username, password)
+	return err == nil
+}
+
+func (bum BoltUserManager) AuthenticateContext(ctx context.Context, username, password string) (user User, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var rehash bool
+	err = bum.View(func(tx *bolt.Tx) (err error) {
+		if user, err = bum.fetchUser(tx, username); err != nil {
+			return
+		}
+		rehash, err = checkCredentials(user, password)
+		return
+	})
+	switch err {
+	case nil:
+	case ErrUnknownUser, ErrWrongPassword:
+		return User{}, err
+	case ErrDisabled, ErrExpired, ErrUnverified, ErrPending:
+		return user, err
+	default:
+		return User{}, BackendError{err}
+	}
+	if rehash {
+		bum.rehash(username, password, user.Passhash)
+		if upgraded, err := bum.Get(username); err == nil {
+			user = upgraded
+		}
+	}
+	return user, nil
+}
+
+//rehash replaces the stored hash of a user with one made by the configured algorithm.
+//It is called after a successful login, when the plaintext password is known.
+//Failures are only logged since the user has already been authenticated.
+//The user is left alone if the password changed since the checked hash was read.
+func (bum BoltUserManager) rehash(username, password string, checked Key) {
+	err := bum.DB.Update(func(tx *bolt.Tx) error {
 		user, err := bum.fetchUser(tx, username)
 		if err != nil {
 			return err
 		}
-		hash := HashAndSalt(password, user.Salt)
-		if bytes.Compare(hash, user.Passhash) != 0 {
-			return ErrWrongPassword
+		if !bytes.Equal(user.Passhash, checked) {
+			return nil
 		}
-		return nil
+		old := HashAlgorithm(user.Passhash)
+		if err = user.SetPassword(password); err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{
+			"user": username,
+			"from": old,
+			"to":   passwordHasher.Name(),
+		}).Info("Upgrading password hash")
+		return tx.Bucket(BoltBucketUsers).Put([]byte(username), encodeUserRecord(user))
 	})
-	return err == nil
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Upgrading password hash")
+	}
 }
 
-func (bum BoltUserManager) Register(user, password string) (err error) {
+func (bum BoltUserManager) Register(user User, password string) (err error) {
 	err = bum.DB.Update(func(tx *bolt.Tx) error {
-		if _, err := bum.fetchUser(tx, user); err == nil {
+		if _, err := bum.fetchUser(tx, user.Name); err == nil {
 			//User already exists
 			return ErrUserExists
 		}
 		b := tx.Bucket(BoltBucketUsers)
-		salt := securecookie.GenerateRandomKey(32)
 		isFirst := false
 		if b.Stats().KeyN == 0 {
 			isFirst = true
 		}
-		err := b.Put([]byte(user), bum.encodeUser(User{
-			Name:     user,
-			Passhash: HashAndSalt(password, salt),
-			Salt:     salt,
-			Admin:    isFirst,
-		}))
-		return err
+		user.Admin = user.Admin || isFirst
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt = time.Now()
+		}
+		if err := user.SetPassword(password); err != nil {
+			return err
+		}
+		return b.Put([]byte(user.Name), encodeUserRecord(user))
 	})
 	return
 }
@@ -168,12 +610,34 @@ func (bum BoltUserManager) Register(user, password string) (err error) {
 func (bum BoltUserManager) Update(user User) (err error) {
 	err = bum.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(BoltBucketUsers)
-		b.Put([]byte(user.Name), bum.encodeUser(user))
+		b.Put([]byte(user.Name), encodeUserRecord(user))
 		return nil
 	})
 	return
 }
 
+//modify changes a user in one transaction, so nothing else can change it in between.
+func (bum BoltUserManager) modify(username string, change func(user *User) error) error {
+	return bum.DB.Update(func(tx *bolt.Tx) error {
+		user, err := bum.fetchUser(tx, username)
+		if err != nil {
+			return err
+		}
+		if err := change(&user); err != nil {
+			return err
+		}
+		return tx.Bucket(BoltBucketUsers).Put([]byte(username), encodeUserRecord(user))
+	})
+}
+
+func (bum BoltUserManager) UseTOTPStep(username string, step int64) error {
+	return bum.modify(username, func(user *User) error { return user.useTOTPStep(step) })
+}
+
+func (bum BoltUserManager) UseRecoveryCode(username string, hash Key) error {
+	return bum.modify(username, func(user *User) error { return user.removeRecoveryCode(hash) })
+}
+
 func (bum BoltUserManager) Get(user string) (u User, err error) {
 	err = bum.View(func(tx *bolt.Tx) error {
 		u, err = bum.fetchUser(tx, user)
@@ -182,6 +646,30 @@ func (bum BoltUserManager) Get(user string) (u User, err error) {
 	return
 }
 
+func (bum BoltUserManager) List() (list []User, err error) {
+	err = bum.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketUsers).ForEach(func(k, v []byte) error {
+			u, err := decodeUserRecord(v)
+			if err != nil {
+				return err
+			}
+			list = append(list, u) //Bolt keeps keys sorted
+			return nil
+		})
+	})
+	return
+}
+
+func (bum BoltUserManager) Delete(username string) error {
+	return bum.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketUsers)
+		if b.Get([]byte(username)) == nil {
+			return ErrUnknownUser
+		}
+		return b.Delete([]byte(username))
+	})
+}
+
 func (bum BoltUserManager) fetchUser(tx *bolt.Tx, username string) (u User, err error) {
 	b := tx.Bucket(BoltBucketUsers)
 	data := b.Get([]byte(username))
@@ -189,14 +677,5 @@ func (bum BoltUserManager) fetchUser(tx *bolt.Tx, username string) (u User, err
 		err = ErrUnknownUser
 		return
 	}
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err = dec.Decode(&u)
-	return
-}
-
-func (BoltUserManager) encodeUser(user User) []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	enc.Encode(user)
-	return buf.Bytes()
+	return decodeUserRecord(data)
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJsonUserManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.json")
+
+	um, err := NewJsonUserManager(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewJsonUserManager(file); err != ErrDatastoreLocked {
+		t.Errorf("Second manager on the same file: %v. Expected ErrDatastoreLocked", err)
+	}
+
+	if err := um.Register(User{Name: "alice"}, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.Register(User{Name: "alice"}, "hunter3"); err != ErrUserExists {
+		t.Errorf("Registering twice: %v. Expected ErrUserExists", err)
+	}
+	if err := um.Register(User{Name: "bob"}, "hunter3"); err != nil {
+		t.Fatal(err)
+	}
+	bob, _ := um.Get("bob")
+	bob.Admin = true
+	if err := um.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.Update(User{Name: "mallory"}); err != ErrUnknownUser {
+		t.Errorf("Updating unknown user: %v. Expected ErrUnknownUser", err)
+	}
+	um.Close()
+
+	um, err = NewJsonUserManager(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	if !um.Authenticate("alice", "hunter2") || um.Authenticate("alice", "hunter3") {
+		t.Error("Authentication of reloaded user failed")
+	}
+	if alice, _ := um.Get("alice"); !alice.Admin {
+		t.Error("First user is not admin")
+	}
+	if bob, _ := um.Get("bob"); !bob.Admin {
+		t.Error("Update was not saved")
+	}
+
+	//A rehash that lost the race against a delete leaves the user deleted.
+	bob, _ = um.Get("bob")
+	if err := um.Delete("bob"); err != nil {
+		t.Fatal(err)
+	}
+	um.rehash(bob, "hunter3")
+	if _, err := um.Get("bob"); err != ErrUnknownUser {
+		t.Errorf("Rehashing a deleted user: %v. Expected ErrUnknownUser", err)
+	}
+}
+
+//onlyBool hides AuthenticateContext, like backends that only report success or failure.
+type onlyBool struct {
+	UserManager
+}
+
+func TestAuthenticateContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jum, err := NewJsonUserManager(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jum.Close()
+	bum, err := NewBoltUserManager(filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bum.Close()
+
+	jum.Register(User{Name: "alice"}, "hunter2")
+	bum.Register(User{Name: "alice"}, "hunter2")
+	dummy := &DummyUserManager{}
+	dummy.Register(User{Name: "alice"}, "hunter2")
+	for name, um := range map[string]UserManager{"dummy": dummy, "json": jum, "bolt": bum, "fallback": onlyBool{jum}} {
+		users = um
+		ctx := context.Background()
+		if user, err := authenticate(ctx, "alice", "hunter2"); err != nil || user.Name != "alice" {
+			t.Errorf("%s: right password = %+v, %v", name, user, err)
+		}
+		if _, err := authenticate(ctx, "alice", "hunter3"); err != ErrWrongPassword {
+			t.Errorf("%s: wrong password = %v. Expected ErrWrongPassword", name, err)
+		}
+		if _, err := authenticate(ctx, "mallory", "hunter2"); err != ErrUnknownUser {
+			t.Errorf("%s: unknown user = %v. Expected ErrUnknownUser", name, err)
+		}
+
+		alice, _ := um.Get("alice")
+		alice.Disabled = true
+		um.Update(alice)
+		if user, err := authenticate(ctx, "alice", "hunter2"); err != ErrDisabled || user.Name != "alice" {
+			t.Errorf("%s: disabled user = %+v, %v. Expected ErrDisabled", name, user, err)
+		}
+		if _, err := authenticate(ctx, "alice", "hunter3"); err != ErrWrongPassword {
+			t.Errorf("%s: disabled user with a wrong password = %v. The state must not be told", name, err)
+		}
+		alice.Disabled = false
+		um.Update(alice)
+
+		if _, ok := um.(onlyBool); !ok {
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			if _, err := authenticate(canceled, "alice", "hunter2"); err != context.Canceled {
+				t.Errorf("%s: canceled context = %v", name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"github.com/gorilla/securecookie"
+	"sync"
+	"time"
+)
+
+//Clients that use Basic authorization at the proxy send the password with every request. Checking it against an
+//argon2id hash each time would make every request slow, so credentials that were verified a moment ago are remembered.
+//Entries are keyed by an HMAC of username and password under a key that only lives in memory, and hold the stored hash
+//the password was checked against. A changed password, or an account that may no longer log in, misses the cache.
+
+const basicAuthCacheTTL = time.Minute
+
+type basicAuthEntry struct {
+	passhash Key
+	expires  time.Time
+}
+
+type basicAuthCache struct {
+	mu      sync.Mutex
+	key     []byte
+	entries map[string]basicAuthEntry
+}
+
+var basicAuthVerified = newBasicAuthCache()
+
+func newBasicAuthCache() *basicAuthCache {
+	return &basicAuthCache{key: securecookie.GenerateRandomKey(32), entries: map[string]basicAuthEntry{}}
+}
+
+func (c *basicAuthCache) sum(username, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(username))
+	mac.Write([]byte{0})
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+//add remembers credentials that were just verified for the user, and forgets the ones that have expired.
+func (c *basicAuthCache) add(user User, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[c.sum(user.Name, password)] = basicAuthEntry{passhash: user.Passhash, expires: now.Add(basicAuthCacheTTL)}
+}
+
+//user returns the user of credentials that were verified recently, if the user is unchanged and may still log in
+//with only a password.
+func (c *basicAuthCache) user(username, password string) (User, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[c.sum(username, password)]
+	c.mu.Unlock()
+	if !ok || time.Now().After(e.expires) {
+		return User{}, false
+	}
+	user, err := users.Get(username)
+	if err != nil || !bytes.Equal(user.Passhash, e.passhash) || user.inactiveReason() != nil || !passwordSuffices(user) {
+		return User{}, false
+	}
+	return user, true
+}
+
+//passwordSuffices reports whether the user may log in at the proxy with only a password.
+func passwordSuffices(user User) bool {
+	return len(user.TOTPSecret) == 0 && !hasPasskeys(user.Name) && !user.MustChangePassword
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"os"
+	"strconv"
+)
+
+//The Bolt user database records the version of its schema in the meta bucket. Each user is stored as a JSON record
+//that carries the version it was written with, so a record from a newer authprox is recognised instead of misread.
+//Databases without a version are from before it was recorded and hold gob-encoded users.
+
+//boltSchemaVersion is the schema this build reads and writes.
+const boltSchemaVersion = 1
+
+var (
+	BoltBucketMeta = []byte("meta")
+	boltSchemaKey  = []byte("schema_version")
+)
+
+var (
+	ErrSchemaTooNew = errors.New("The database was written by a newer version of authprox")
+	errDryRun       = errors.New("dry run") //Rolls back the transaction of a dry run
+)
+
+//A boltUserRecord is how a user is stored in the users bucket.
+type boltUserRecord struct {
+	Version int  `json:"version"`
+	User    User `json:"user"`
+}
+
+func encodeUserRecord(user User) []byte {
+	data, _ := json.Marshal(boltUserRecord{Version: boltSchemaVersion, User: user}) //A User always encodes
+	return data
+}
+
+func decodeUserRecord(data []byte) (User, error) {
+	var rec boltUserRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return User{}, err
+	}
+	if rec.Version > boltSchemaVersion {
+		return User{}, ErrSchemaTooNew
+	}
+	return rec.User, nil
+}
+
+//A boltMigration brings the schema from the previous version to Version.
+//Migrate makes the changes in tx and describes each of them, one line per user or bucket.
+type boltMigration struct {
+	Version     int
+	Description string
+	Migrate     func(tx *bolt.Tx) ([]string, error)
+}
+
+var boltMigrations = []boltMigration{
+	{1, "Store users as versioned JSON records instead of gob", migrateGobUsers},
+}
+
+func boltSchema(tx *bolt.Tx) (int, error) {
+	b := tx.Bucket(BoltBucketMeta)
+	if b == nil || b.Get(boltSchemaKey) == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(b.Get(boltSchemaKey)))
+}
+
+func setBoltSchema(tx *bolt.Tx, version int) error {
+	b, err := tx.CreateBucketIfNotExists(BoltBucketMeta)
+	if err != nil {
+		return err
+	}
+	return b.Put(boltSchemaKey, []byte(strconv.Itoa(version)))
+}
+
+//migrateBoltUsers applies all migrations newer than the schema version of db, each in its own transaction.
+//With dryRun they are made in a single transaction that is rolled back, so only the returned report tells what would change.
+func migrateBoltUsers(db *bolt.DB, dryRun bool) (report []string, err error) {
+	var current int
+	if err = db.View(func(tx *bolt.Tx) (err error) {
+		current, err = boltSchema(tx)
+		return
+	}); err != nil {
+		return
+	}
+	if current > boltSchemaVersion {
+		return nil, ErrSchemaTooNew
+	}
+	apply := func(tx *bolt.Tx, m boltMigration) error {
+		changes, err := m.Migrate(tx)
+		if err != nil {
+			return fmt.Errorf("migration %d: %v", m.Version, err)
+		}
+		report = append(report, fmt.Sprintf("Migration %d: %s", m.Version, m.Description))
+		for _, c := range changes {
+			report = append(report, "\t"+c)
+		}
+		return setBoltSchema(tx, m.Version)
+	}
+	if dryRun {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, m := range boltMigrations {
+				if m.Version <= current {
+					continue
+				}
+				if err := apply(tx, m); err != nil {
+					return err
+				}
+			}
+			return errDryRun
+		})
+		if err == errDryRun {
+			err = nil
+		}
+		return
+	}
+	for _, m := range boltMigrations {
+		if m.Version <= current {
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			"version":     m.Version,
+			"description": m.Description,
+		}).Info("Migrating Bolt schema")
+		if err = db.Update(func(tx *bolt.Tx) error { return apply(tx, m) }); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//migrateGobUsers re-encodes the users of a database from before the schema was versioned.
+func migrateGobUsers(tx *bolt.Tx) (changes []string, err error) {
+	b, err := tx.CreateBucketIfNotExists(BoltBucketUsers)
+	if err != nil {
+		return
+	}
+	records := make(map[string][]byte)
+	err = b.ForEach(func(k, v []byte) error {
+		var u User
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&u); err != nil {
+			return fmt.Errorf("user %s: %v", k, err)
+		}
+		records[string(k)] = encodeUserRecord(u)
+		changes = append(changes, fmt.Sprintf("User %s: re-encoded as JSON", k))
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for k, v := range records { //Bolt does not allow changes while iterating
+		if err = b.Put([]byte(k), v); err != nil {
+			return
+		}
+	}
+	return
+}
+
+//reportMigrations prints what migrating the Bolt user databases would change, and returns the exit status of the process.
+func reportMigrations() int {
+	var files []string
+	if config.Database.Type == "bolt" {
+		files = append(files, config.Database.Location)
+	}
+	for _, b := range config.Database.Chain {
+		if config.Database.Type == "chain" && b.Type == "bolt" {
+			files = append(files, b.Location)
+		}
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "authprox: Only bolt user databases are migrated this way. SQL databases keep their own schema_migrations table.")
+		return 1
+	}
+	status := 0
+	for _, file := range files {
+		if err := reportFileMigrations(file); err != nil {
+			fmt.Fprintln(os.Stderr, "authprox:", file+":", err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func reportFileMigrations(file string) error {
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		fmt.Printf("%s does not exist yet. It will be created with the current schema.\n", file)
+		return nil
+	}
+	db, err := bolt.Open(file, 0600, boltOptions)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	report, err := migrateBoltUsers(db, true)
+	if err != nil {
+		return err
+	}
+	if len(report) == 0 {
+		fmt.Printf("%s is up to date at schema version %d.\n", file, boltSchemaVersion)
+		return nil
+	}
+	fmt.Printf("%s:\n", file)
+	for _, line := range report {
+		fmt.Println(line)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//legacyBoltDB writes a database the way authprox did before the schema was versioned.
+func legacyBoltDB(t *testing.T, file string, list ...User) {
+	db, err := bolt.Open(file, 0600, boltOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(BoltBucketUsers)
+		if err != nil {
+			return err
+		}
+		for _, u := range list {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(u); err != nil {
+				return err
+			}
+			if err := b.Put([]byte(u.Name), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBoltMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "users.db")
+	legacyBoltDB(t, file, User{Name: "alice", Admin: true, Email: "alice@example.com"}, User{Name: "bob"})
+
+	db, err := bolt.Open(file, 0600, boltOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := migrateBoltUsers(db, true)
+	if err != nil || len(report) != 3 {
+		t.Errorf("Dry run reported %q, %v. Expected the migration and two users", report, err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if v, _ := boltSchema(tx); v != 0 {
+			t.Errorf("Dry run changed the schema version to %d", v)
+		}
+		if _, err := decodeUserRecord(tx.Bucket(BoltBucketUsers).Get([]byte("alice"))); err == nil {
+			t.Error("Dry run re-encoded alice")
+		}
+		return nil
+	})
+	db.Close()
+
+	bum, err := NewBoltUserManager(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := bum.Get("alice")
+	if err != nil || !alice.Admin || alice.Email != "alice@example.com" {
+		t.Errorf("alice = %+v, %v after migration", alice, err)
+	}
+	if list, err := bum.List(); err != nil || len(list) != 2 {
+		t.Errorf("List = %v, %v after migration", list, err)
+	}
+	if report, err := migrateBoltUsers(bum.DB, true); err != nil || len(report) != 0 {
+		t.Errorf("Migrated database still needs %q, %v", report, err)
+	}
+
+	//A database from a newer authprox must not be opened.
+	bum.DB.Update(func(tx *bolt.Tx) error { return setBoltSchema(tx, boltSchemaVersion+1) })
+	bum.Close()
+	if _, err := NewBoltUserManager(file); err != ErrSchemaTooNew {
+		t.Errorf("Opening a newer schema: %v. Expected ErrSchemaTooNew", err)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"sort"
+)
+
+//A ChainUserManager asks several user stores in order, like a local Bolt file for a break-glass admin,
+//then the company directory, then an htpasswd file for service accounts.
+//A user belongs to the first backend that knows the name. That backend answers Get, Update and Delete.
+
+//A ChainBackend is one user store in a chain.
+type ChainBackend struct {
+	Name string
+	UserManager
+	FallThrough bool //A wrong password here lets the next backend try, instead of rejecting the login.
+	//Only use it between stores that agree on who a name is, as the user is still the one this backend has
+}
+
+type ChainUserManager struct {
+	Backends   []ChainBackend
+	RegisterIn int //Index of the backend new users are registered in
+}
+
+var (
+	ErrEmptyChain         = errors.New("The backend chain is empty")
+	ErrUnknownBackend     = errors.New("The backend to register users in is not part of the chain")
+	ErrNestedChain        = errors.New("A backend chain can not contain another chain")
+	ErrUnknownBackendType = errors.New("Unknown backend type. Expected bolt, json, sql, ldap or htpasswd")
+)
+
+//NewChainUserManager makes a chain of the backends. Users register in the backend named register, or in the first
+//if it is empty.
+func NewChainUserManager(backends []ChainBackend, register string) (*ChainUserManager, error) {
+	if len(backends) == 0 {
+		return nil, ErrEmptyChain
+	}
+	chain := &ChainUserManager{Backends: backends, RegisterIn: -1}
+	for i, b := range backends {
+		if _, ok := b.UserManager.(*ChainUserManager); ok {
+			return nil, ErrNestedChain
+		}
+		if chain.RegisterIn < 0 && (b.Name == register || register == "") {
+			chain.RegisterIn = i
+		}
+	}
+	if chain.RegisterIn < 0 {
+		return nil, ErrUnknownBackend
+	}
+	return chain, nil
+}
+
+func (c *ChainUserManager) Authenticate(username, password string) bool {
+	_, err := c.AuthenticateContext(context.Background(), username, password)
+	return err == nil
+}
+
+//AuthenticateContext tries the backends in order until one accepts the user, or rejects them for good.
+//A backend that is unreachable is skipped, but its error is returned if no later backend knows the user,
+//so an outage is not mistaken for an unknown user.
+func (c *ChainUserManager) AuthenticateContext(ctx context.Context, username, password string) (User, error) {
+	var unavailable error
+	wrongPassword := false
+	for _, b := range c.Backends {
+		user, err := authenticateWith(ctx, b.UserManager, username, password)
+		switch err {
+		case nil:
+			return user, nil
+		case ErrUnknownUser:
+			continue
+		case ErrWrongPassword:
+			if !b.FallThrough {
+				return User{}, err
+			}
+			wrongPassword = true
+			continue
+		}
+		if err == ctx.Err() {
+			return User{}, err
+		}
+		if _, ok := err.(BackendError); ok {
+			logger.WithFields(logrus.Fields{"backend": b.Name, "user": username, "err": err}).Error("Skipping unavailable backend")
+			if unavailable == nil {
+				unavailable = err
+			}
+			continue
+		}
+		return user, err //The account is known here and may not log in
+	}
+	switch {
+	case wrongPassword:
+		return User{}, ErrWrongPassword
+	case unavailable != nil:
+		return User{}, unavailable
+	}
+	return User{}, ErrUnknownUser
+}
+
+//owner finds the backend a user belongs to.
+func (c *ChainUserManager) owner(username string) (ChainBackend, User, error) {
+	for _, b := range c.Backends {
+		user, err := b.Get(username)
+		if err == ErrUnknownUser {
+			continue
+		}
+		return b, user, err
+	}
+	return ChainBackend{}, User{}, ErrUnknownUser
+}
+
+func (c *ChainUserManager) Get(username string) (User, error) {
+	_, user, err := c.owner(username)
+	return user, err
+}
+
+//Register registers in the configured backend, unless the name is taken anywhere in the chain.
+func (c *ChainUserManager) Register(user User, password string) error {
+	if _, _, err := c.owner(user.Name); err != ErrUnknownUser {
+		if err == nil {
+			return ErrUserExists
+		}
+		return err
+	}
+	return c.Backends[c.RegisterIn].Register(user, password)
+}
+
+func (c *ChainUserManager) Update(user User) error {
+	b, _, err := c.owner(user.Name)
+	if err != nil {
+		return err
+	}
+	return b.Update(user)
+}
+
+func (c *ChainUserManager) UseTOTPStep(username string, step int64) error {
+	b, _, err := c.owner(username)
+	if err != nil {
+		return err
+	}
+	return useSecondFactor(b.UserManager, username, step, nil)
+}
+
+func (c *ChainUserManager) UseRecoveryCode(username string, hash Key) error {
+	b, _, err := c.owner(username)
+	if err != nil {
+		return err
+	}
+	return useSecondFactor(b.UserManager, username, 0, hash)
+}
+
+func (c *ChainUserManager) Delete(username string) error {
+	b, _, err := c.owner(username)
+	if err != nil {
+		return err
+	}
+	return b.Delete(username)
+}
+
+//List merges the users of all backends that can list them. A name in several backends is listed once, as Get sees it.
+func (c *ChainUserManager) List() ([]User, error) {
+	seen := make(map[string]bool)
+	var list []User
+	for _, b := range c.Backends {
+		part, err := b.List()
+		if err == ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range part {
+			if !seen[u.Name] {
+				seen[u.Name] = true
+				list = append(list, u)
+			}
+		}
+	}
+	sort.Sort(usersByName(list))
+	return list, nil
+}
+
+//Close closes the backends that hold something open.
+func (c *ChainUserManager) Close() error {
+	var first error
+	for _, b := range c.Backends {
+		if closer, ok := b.UserManager.(interface {
+			Close() error
+		}); ok {
+			if err := closer.Close(); err != nil && first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
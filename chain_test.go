@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//brokenUserManager is a backend that can not be reached.
+type brokenUserManager struct {
+	DummyUserManager
+}
+
+var errUnreachable = errors.New("connection refused")
+
+func (brokenUserManager) AuthenticateContext(ctx context.Context, user, password string) (User, error) {
+	return User{}, BackendError{errUnreachable}
+}
+
+func (brokenUserManager) Get(user string) (User, error) {
+	return User{}, errUnreachable
+}
+
+func TestChainUserManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	local, err := NewJsonUserManager(filepath.Join(dir, "local.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	directory, err := NewJsonUserManager(filepath.Join(dir, "directory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer directory.Close()
+	local.Register(User{Name: "root"}, "local secret")
+	local.Register(User{Name: "alice"}, "old password")
+	directory.Register(User{Name: "alice"}, "hunter2")
+	directory.Register(User{Name: "bob"}, "hunter3")
+
+	if _, err := NewChainUserManager([]ChainBackend{{Name: "local", UserManager: local}}, "directory"); err != ErrUnknownBackend {
+		t.Errorf("Registering in a missing backend: %v. Expected ErrUnknownBackend", err)
+	}
+	chain, err := NewChainUserManager([]ChainBackend{
+		{Name: "local", UserManager: local},
+		{Name: "broken", UserManager: &brokenUserManager{}},
+		{Name: "directory", UserManager: directory},
+	}, "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, c := range []struct {
+		user, password string
+		want           error
+	}{
+		{"root", "local secret", nil},
+		{"bob", "hunter3", nil},                //Past the broken backend
+		{"alice", "hunter2", ErrWrongPassword}, //The local alice decides
+		{"alice", "old password", nil},
+		{"mallory", "hunter2", BackendError{errUnreachable}}, //Maybe the broken backend knows mallory
+	} {
+		if _, err := chain.AuthenticateContext(ctx, c.user, c.password); err != c.want {
+			t.Errorf("%s with %q: %v. Expected %v", c.user, c.password, err, c.want)
+		}
+	}
+
+	chain.Backends[0].FallThrough = true
+	if user, err := chain.AuthenticateContext(ctx, "alice", "hunter2"); err != nil || user.Name != "alice" {
+		t.Errorf("Falling through to the directory: %+v, %v", user, err)
+	}
+
+	chain.Backends = append(chain.Backends[:1], chain.Backends[2:]...) //Without the broken backend
+	chain.RegisterIn = 1
+	if err := chain.Register(User{Name: "carol"}, "hunter4"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := directory.Get("carol"); err != nil {
+		t.Errorf("carol was not registered in the directory: %v", err)
+	}
+	if err := chain.Register(User{Name: "root"}, "hunter5"); err != ErrUserExists {
+		t.Errorf("Registering a name of another backend: %v. Expected ErrUserExists", err)
+	}
+	list, err := chain.List()
+	if err != nil || len(list) != 4 {
+		t.Errorf("List = %v, %v. Expected root, alice, bob and carol once each", list, err)
+	}
+	bob, _ := chain.Get("bob")
+	bob.Disabled = true
+	if err := chain.Update(bob); err != nil {
+		t.Fatal(err)
+	}
+	if bob, _ := directory.Get("bob"); !bob.Disabled {
+		t.Error("The update did not reach the backend of bob")
+	}
+	if _, err := chain.AuthenticateContext(ctx, "bob", "hunter3"); err != ErrDisabled {
+		t.Errorf("Disabled bob: %v. Expected ErrDisabled", err)
+	}
+}
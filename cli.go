@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/term"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+//Subcommands for administering users from a shell, like bootstrapping the first admin or recovering a lost one.
+//They open the configured UserManager directly, so they work without the web server and reCaptcha.
+
+const commandUsage = `Usage: authprox [-f config] [command]
+
+Without a command, the proxy is started.
+
+Commands:
+  user add [-admin] [-email address] [-expires date] <name>
+                                              Add a user. The password is read from the terminal or stdin.
+  user del <name>                             Delete a user together with their passkeys, tokens and sessions.
+  user list                                   List all users.
+  user passwd <name>                          Set a new password for a user.
+  user promote <name>                         Make a user an admin.
+  user demote <name>                          Take admin rights away from a user.
+  user disable <name>                         Keep a user from logging in.
+  user enable <name>                          Let a disabled user log in again.
+  user expire <name> <date|never>             Keep a user from logging in after the given day.
+  users export [-format json|csv] [file]      Write all users with their password hashes to file or stdout.
+  users import [-format json|csv] [-overwrite] [file]
+                                              Add users from file or stdin. Existing users are skipped
+                                              unless -overwrite is given.
+`
+
+var ErrUsage = errors.New("Invalid command. Run authprox -h for usage.")
+
+func usage() {
+	fmt.Fprint(os.Stderr, commandUsage)
+	fmt.Fprintln(os.Stderr, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+//runCommand runs a subcommand and returns the exit status of the process.
+func runCommand(args []string) int {
+	if err := command(args); err != nil {
+		fmt.Fprintln(os.Stderr, "authprox:", err)
+		return 1
+	}
+	return 0
+}
+
+func command(args []string) error {
+	if len(args) < 2 || (args[0] != "user" && args[0] != "users") {
+		return ErrUsage
+	}
+	logger.Level = logrus.WarnLevel //Keep the output of the command readable
+
+	selectPasswordHasher()
+	selectPasswordPolicy()
+	selectUserManager()
+	if users == nil {
+		return errors.New("No user database is configured.")
+	}
+	defer closeUsers()
+	openStateDB()
+	defer stateDB.Close()
+	selectSessionRegistry()
+	selectAPITokens()
+	selectAuditLog()
+	selectThrottle()
+	selectRelyingParty()
+
+	if args[0] == "users" {
+		switch args[1] {
+		case "export":
+			return usersExport(args[2:])
+		case "import":
+			return usersImport(args[2:])
+		}
+		return ErrUsage
+	}
+	switch args[1] {
+	case "add":
+		return userAdd(args[2:])
+	case "list":
+		return userList()
+	case "expire":
+		if len(args) != 4 {
+			return ErrUsage
+		}
+		expires, err := parseExpiry(args[3])
+		if err != nil {
+			return err
+		}
+		return userChange(args[2], "expires "+args[3], func(u *User) { u.ExpiresAt = expires })
+	}
+	if len(args) != 3 {
+		return ErrUsage
+	}
+	name := args[2]
+	switch args[1] {
+	case "del":
+		if _, err := users.Get(name); err != nil {
+			return err
+		}
+		if err := deleteUser(name); err != nil {
+			return err
+		}
+		audit(nil, EventAdmin, name, "", name+" deleted")
+		return nil
+	case "passwd":
+		return userPasswd(name)
+	case "promote":
+		return userChange(name, "promote", func(u *User) { u.Admin = true })
+	case "demote":
+		return userChange(name, "demote", func(u *User) { u.Admin = false })
+	case "disable":
+		return userChange(name, "disable", func(u *User) { u.Disabled = true })
+	case "enable":
+		return userChange(name, "enable", func(u *User) { u.Disabled = false })
+	}
+	return ErrUsage
+}
+
+//closeUsers closes the user database if the backend holds it open, releasing any lock for the server.
+func closeUsers() {
+	if c, ok := users.(interface {
+		Close() error
+	}); ok {
+		c.Close()
+	}
+}
+
+func userAdd(args []string) error {
+	flags := flag.NewFlagSet("user add", flag.ContinueOnError)
+	admin := flags.Bool("admin", false, "make the user an admin")
+	email := flags.String("email", "", "email address of the user")
+	expires := flags.String("expires", "", "last day the user may log in, like 2006-01-02")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+	if flags.NArg() != 1 {
+		return ErrUsage
+	}
+	user := User{Name: flags.Arg(0), Admin: *admin, Email: *email}
+	var err error
+	if user.ExpiresAt, err = parseExpiry(*expires); err != nil {
+		return err
+	}
+	if user.Email != "" {
+		if _, err := mail.ParseAddress(user.Email); err != nil {
+			return ErrInvalidAddress
+		}
+	}
+	password, err := readNewPassword(user.Name)
+	if err != nil {
+		return err
+	}
+	if err := users.Register(user, password); err != nil {
+		return err
+	}
+	audit(nil, EventAdmin, user.Name, "", user.Name+" added")
+	fmt.Printf("User %s added.\n", user.Name)
+	return nil
+}
+
+func userList() error {
+	list, err := users.List()
+	if err != nil {
+		return err
+	}
+	for _, u := range list {
+		var notes []string
+		if u.Admin {
+			notes = append(notes, "admin")
+		}
+		if u.Disabled {
+			notes = append(notes, "disabled")
+		}
+		if u.Pending {
+			notes = append(notes, "pending")
+		}
+		if u.Unverified {
+			notes = append(notes, "unverified")
+		}
+		if u.Expired() {
+			notes = append(notes, "expired")
+		} else if !u.ExpiresAt.IsZero() {
+			notes = append(notes, "expires "+u.ExpiresAt.Format("2006-01-02 15:04"))
+		}
+		fmt.Printf("%s\t%s\t%s\n", u.Name, u.Email, strings.Join(notes, ","))
+	}
+	return nil
+}
+
+func userPasswd(name string) error {
+	user, err := users.Get(name)
+	if err != nil {
+		return err
+	}
+	password, err := readNewPassword(name)
+	if err != nil {
+		return err
+	}
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+	user.MustChangePassword = false
+	if err := users.Update(user); err != nil {
+		return err
+	}
+	throttle.Succeed(name) //A new password is a good reason to lift a lockout.
+	audit(nil, EventPasswordChange, name, "", "Set from the command line")
+	fmt.Printf("Password of %s changed.\n", name)
+	return nil
+}
+
+//userChange applies a change to a user and records it in the audit log under the given description.
+func userChange(name, description string, change func(*User)) error {
+	user, err := users.Get(name)
+	if err != nil {
+		return err
+	}
+	change(&user)
+	if err := users.Update(user); err != nil {
+		return err
+	}
+	audit(nil, EventAdmin, name, "", name+" "+description)
+	fmt.Printf("User %s changed.\n", name)
+	return nil
+}
+
+//transferFlags parses the flags and file argument that export and import share.
+func transferFlags(name string, args []string, overwrite *bool) (format, file string, err error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&format, "format", "", "json or csv. Defaults to csv for .csv files and json otherwise")
+	if overwrite != nil {
+		flags.BoolVar(overwrite, "overwrite", false, "replace users that already exist")
+	}
+	if err = flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return "", "", ErrUsage
+	}
+	if file = flags.Arg(0); file == "-" {
+		file = ""
+	}
+	format, err = formatOf(format, file)
+	return
+}
+
+func usersExport(args []string) error {
+	format, file, err := transferFlags("users export", args, nil)
+	if err != nil {
+		return err
+	}
+	out := os.Stdout
+	if file != "" {
+		if out, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600); err != nil {
+			return err
+		}
+	}
+	n, err := exportUsers(out, format)
+	if file != "" {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	audit(nil, EventAdmin, "", "", fmt.Sprintf("Exported %d users as %s", n, format))
+	if file != "" {
+		fmt.Printf("%d users exported to %s.\n", n, file)
+	}
+	return nil
+}
+
+func usersImport(args []string) error {
+	var overwrite bool
+	format, file, err := transferFlags("users import", args, &overwrite)
+	if err != nil {
+		return err
+	}
+	in := os.Stdin
+	if file != "" {
+		if in, err = os.Open(file); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	list, err := readUsers(in, format)
+	if err != nil {
+		return err
+	}
+	res, err := importUsers(list, overwrite)
+	if res.Added+res.Updated > 0 {
+		audit(nil, EventAdmin, "", "", fmt.Sprintf("Imported users, %d added and %d updated", res.Added, res.Updated))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d users added, %d updated.\n", res.Added, res.Updated)
+	if len(res.Skipped) > 0 {
+		fmt.Printf("Skipped existing users: %s\n", strings.Join(res.Skipped, ", "))
+	}
+	return nil
+}
+
+//readNewPassword asks for a password twice on a terminal, or reads a single line when stdin is not one, as in scripts.
+//The password policy applies like on the registration page.
+func readNewPassword(name string) (string, error) {
+	var password string
+	if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+		fmt.Fprintf(os.Stderr, "New password for %s: ", name)
+		first, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprint(os.Stderr, "Repeat password: ")
+		second, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		if string(first) != string(second) {
+			return "", errors.New("The passwords do not match.")
+		}
+		password = string(first)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("No password given on stdin.")
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+	if err := passwordPolicy.Check(name, password); err != nil {
+		return "", err
+	}
+	return password, nil
+}
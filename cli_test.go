@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//withStdin runs f with the given text as standard input.
+func withStdin(t *testing.T, text string, f func()) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(text)
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin; r.Close() }()
+	f()
+}
+
+func TestUserCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.Database.Type = "json"
+	config.Database.Location = filepath.Join(dir, "users.json")
+	config.Database.State = filepath.Join(dir, "state.db")
+
+	withStdin(t, "correct horse battery staple\n", func() {
+		if err := command([]string{"user", "add", "-email", "alice@example.com", "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	withStdin(t, "short\n", func() {
+		if err := command([]string{"user", "add", "bob"}); err == nil {
+			t.Error("Weak password accepted")
+		}
+	})
+	withStdin(t, "tr0ub4dor&3 is long\n", func() {
+		if err := command([]string{"user", "add", "bob"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	for _, args := range [][]string{
+		{"user", "promote", "bob"},
+		{"user", "disable", "bob"},
+		{"user", "del", "alice"},
+	} {
+		if err := command(args); err != nil {
+			t.Errorf("%v: %v", args, err)
+		}
+	}
+	if err := command([]string{"user", "frobnicate", "bob"}); err != ErrUsage {
+		t.Errorf("Unknown command: %v. Expected ErrUsage", err)
+	}
+	if err := command([]string{"user", "del", "alice"}); err != ErrUnknownUser {
+		t.Errorf("Deleting twice: %v. Expected ErrUnknownUser", err)
+	}
+
+	um, err := NewJsonUserManager(config.Database.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	bob, err := um.Get("bob")
+	if err != nil || !bob.Admin || !bob.Disabled {
+		t.Errorf("bob = %+v, %v. Expected a disabled admin", bob, err)
+	}
+	if _, err := um.Get("alice"); err != ErrUnknownUser {
+		t.Errorf("alice was not deleted: %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/Sirupsen/logrus"
 	"os"
+	"time"
 )
 
 type Config struct {
@@ -14,16 +15,83 @@ type Config struct {
 	Logfile      string
 	WebDirectory *string
 	RootRedirect *string
+	PublicURL    string //URL users reach authprox at, like https://example.com. Used for links sent by mail
 
 	Keys struct {
 		AuthenticationKey Key
 		EncryptionKey     Key
+		SigningKey        Key //RSA key in PKCS #1 form that the OpenID Connect provider signs tokens with
 		ReCaptcha         string
 	}
 
 	Database struct {
-		Type     string
+		Type     string //bolt, json, sql, ldap, htpasswd, dummy or chain
 		Location string
+		State    string          //Bolt file for sessions, passkeys and other state. Shared with the user database when Type is bolt, a file of its own for a chain
+		Chain    []BackendConfig //The backends asked in order when Type is chain
+		Register string          //Name of the backend in the chain that new users are registered in. Defaults to the first
+	}
+
+	LDAP struct {
+		URL                string //ldap://host:389 or ldaps://host:636
+		StartTLS           bool
+		InsecureSkipVerify bool
+		BindDN             string //Service account used to search for users
+		BindPassword       string
+		BaseDN             string
+		Filter             string //%s is replaced by the username. Defaults to (uid=%s), use (sAMAccountName=%s) for Active Directory
+		AdminGroup         string //DN of the group whose members are admins
+	}
+
+	Htpasswd struct {
+		Writable bool     //Write registrations and password changes back to the file
+		Admins   []string //Usernames that are admins, since htpasswd files have no such notion
+	}
+
+	WebAuthn struct {
+		RPID         string   //Domain passkeys are bound to, like example.com. Passkeys are disabled when empty
+		Origins      []string //Origins the browser may report. Defaults to https://<RPID>
+		Passwordless bool     //Allow passkeys as the only factor, not just as a second factor after the password
+	}
+
+	Passwords struct {
+		Algorithm        string //argon2id (default), bcrypt or scrypt
+		MinLength        int    //Defaults to 8
+		CharacterClasses int    //How many of lowercase, uppercase, digits and symbols a password must contain
+		AllowUsername    bool   //Allow passwords that contain the username
+		MinStrength      int    //Estimated strength from 0 (guessable) to 4 (very strong) a password must reach
+		BreachedList     string //Sorted file of SHA-1 hashes of breached passwords, like the Have I Been Pwned download
+	}
+
+	Mail struct {
+		Method   string //smtp or directory. Mail, and with it password resets, is disabled when empty
+		Address  string //host:port of the SMTP server, or the directory messages are written to
+		From     string
+		Username string
+		Password string
+	}
+
+	Registration struct {
+		Mode          string   //open (default), invite, approval or closed
+		InviteTimeout Duration //How long invite codes are valid. Defaults to 168h
+	}
+
+	Throttle struct {
+		Threshold        int      //Failed logins before a username is locked out. Defaults to 5
+		AddressThreshold int      //Failed logins before a client address is locked out. Defaults to 20
+		Backoff          Duration //Delay after the first failure, doubled with every further one. Defaults to 1s
+		Lockout          Duration //How long a lockout lasts. Defaults to 15m
+	}
+
+	Audit struct {
+		Retention Duration //How long audit events are kept. Defaults to 8760h
+	}
+
+	OIDC []OIDCConfig //Identity providers users can sign in with, written as [[OIDC]]
+
+	Provider struct {
+		Clients       []ClientConfig //Apps that log users in with authprox as their OpenID Connect provider. Disabled when empty
+		TokenLifetime Duration       //How long ID and access tokens are valid. Defaults to 1h
 	}
 }
 
@@ -34,6 +102,11 @@ func loadConfig() {
 			"error": err,
 		}).Fatal("Unable to read config file.")
 	}
+	for _, k := range []Key{config.Keys.AuthenticationKey, config.Keys.EncryptionKey} {
+		if len(k) > 0 && !k.Valid() && !*setup {
+			logrus.WithField("error", ErrInvalidKey).Fatal("Unable to read config file.")
+		}
+	}
 
 	logger.WithFields(logrus.Fields{
 		"bind-address": config.Address,
@@ -57,6 +130,43 @@ func saveConfig() {
 	f.Close()
 }
 
+//A BackendConfig is one user store in a chain, written as [[Database.Chain]] in the config file.
+//LDAP and htpasswd backends take their options from the LDAP and Htpasswd sections.
+type BackendConfig struct {
+	Name        string //Defaults to the type
+	Type        string //bolt, json, sql, ldap or htpasswd
+	Location    string
+	FallThrough bool //Let the next backend try after a wrong password, instead of rejecting the login
+}
+
+//An OIDCConfig is an OpenID Connect provider. Its redirect URL is <PublicURL>/proxy/login/oidc/<Name>/callback.
+type OIDCConfig struct {
+	Name          string //Used in URLs and to link identities to users, so it must not change
+	Title         string //Shown as "Sign in with <Title>". Defaults to the name
+	Issuer        string //Like https://accounts.example.com. The discovery document is read from below it
+	ClientID      string
+	ClientSecret  string
+	Scopes        []string //Defaults to openid, profile and email
+	UsernameClaim string   //Claim the name of new users is taken from. Defaults to preferred_username
+	AdminClaim    string   //Claim that makes a user admin, like groups. Admin status is left alone when empty
+	AdminValue    string   //Value, or list entry, of the admin claim that makes a user admin. Empty means a true boolean claim
+}
+
+//A ClientConfig is an app that uses authprox as its OpenID Connect provider, written as [[Provider.Clients]].
+type ClientConfig struct {
+	ID           string
+	Secret       string //Empty for apps that can not keep a secret, like single-page apps. These must use PKCE
+	Name         string //Shown to users and in the audit log. Defaults to the ID
+	RedirectURIs []string
+}
+
+func (c ClientConfig) title() string {
+	if c.Name == "" {
+		return c.ID
+	}
+	return c.Name
+}
+
 type Key []byte
 
 var (
@@ -69,6 +179,10 @@ func (k Key) MarshalText() (res []byte, err error) {
 	return
 }
 
+func (k Key) String() string {
+	return base64.StdEncoding.EncodeToString(k)
+}
+
 func (k *Key) UnmarshalText(text []byte) error {
 	*k = make(Key, base64.StdEncoding.DecodedLen(len(text)))
 	n, err := base64.StdEncoding.Decode([]byte(*k), text)
@@ -76,13 +190,28 @@ func (k *Key) UnmarshalText(text []byte) error {
 		return err //Error decoding
 	}
 	*k = (*k)[:n]
-
-	if !(len(*k) == 32 || len(*k) == 64) {
-		return ErrInvalidKey
-	}
 	return nil
 }
 
+//Valid reports whether the key has a length usable for cookie authentication and encryption.
+//Keys are also used for hashes and salts of any length, so this is not checked when decoding.
+func (k Key) Valid() bool {
+	return len(k) == 32 || len(k) == 64
+}
+
+//A Duration is written as "15m" or "1h30m" in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	*d = Duration(v)
+	return err
+}
+
 var (
 	config = Config{ //Default values
 		Address:     "0.0.0.0:80",
@@ -91,9 +220,13 @@ var (
 		Database: struct {
 			Type     string
 			Location string
+			State    string
+			Chain    []BackendConfig
+			Register string
 		}{
 			Type:     "bolt",
 			Location: defaultDBfile,
+			State:    defaultstatefile,
 		},
 	}
 )
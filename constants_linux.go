@@ -1,7 +1,8 @@
 package main
 
 const (
-	defaultcfile   = "/etc/authprox.conf"
-	defaultlogfile = "/var/log/authprox.log"
-	defaultDBfile  = "/var/authprox.db"
+	defaultcfile     = "/etc/authprox.conf"
+	defaultlogfile   = "/var/log/authprox.log"
+	defaultstatefile = "/var/authprox-state.db"
+	defaultDBfile    = "/var/authprox.db"
 )
@@ -1,7 +1,8 @@
 package main
 
 const (
-	defaultcfile   = `C:\authprox\authprox.conf`
-	defaultlogfile = `C:\authprox\authprox.log`
-	defaultDBfile  = `C:\authprox\authprox.db`
+	defaultcfile     = `C:\authprox\authprox.conf`
+	defaultlogfile   = `C:\authprox\authprox.log`
+	defaultstatefile = `C:\authprox\authprox-state.db`
+	defaultDBfile    = `C:\authprox\authprox.db`
 )
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/md5"
+	"strings"
+)
+
+//Implementations of the legacy crypt(3) schemes found in htpasswd files.
+//They are only used to verify existing entries; new entries are written with bcrypt.
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+//MD5Crypt computes the MD5-based crypt of a password as used by Apache ($apr1$) and glibc ($1$).
+//The salt is the part between the magic and the hash, at most 8 characters.
+func MD5Crypt(password, salt, magic string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(pw)
+	ctx.Write([]byte(magic))
+	ctx.Write([]byte(salt))
+	for pl := len(pw); pl > 0; pl -= 16 {
+		if pl > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:pl])
+		}
+	}
+	for i := len(pw); i != 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	//A thousand rounds to slow things down, which was a lot in 1994.
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+
+	var buf strings.Builder
+	buf.WriteString(magic)
+	buf.WriteString(salt)
+	buf.WriteByte('$')
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			buf.WriteByte(cryptAlphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, i := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[i[0]])<<16|uint32(final[i[1]])<<8|uint32(final[i[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return buf.String()
+}
+
+//DESCrypt computes the traditional DES-based crypt(3) of a password.
+//Only the first 8 characters of the password matter and the salt is 2 characters.
+//This follows the original Unix implementation bit by bit, which is slow but simple.
+func DESCrypt(password, salt string) string {
+	if len(salt) < 2 {
+		return ""
+	}
+	var block [66]byte
+	for i, n := 0, 0; n < len(password) && i < 64; n++ {
+		c := password[n]
+		for j := 0; j < 7; j++ {
+			block[i] = (c >> uint(6-j)) & 1
+			i++
+		}
+		i++
+	}
+	var d desState
+	d.setKey(block[:64])
+
+	for i := range block {
+		block[i] = 0
+	}
+	for i := 0; i < 2; i++ {
+		c := cryptIndex(salt[i])
+		for j := 0; j < 6; j++ {
+			if (c>>uint(j))&1 != 0 {
+				d.E[6*i+j], d.E[6*i+j+24] = d.E[6*i+j+24], d.E[6*i+j]
+			}
+		}
+	}
+	for i := 0; i < 25; i++ {
+		d.encrypt(block[:64])
+	}
+
+	out := []byte(salt[:2])
+	for i := 0; i < 11; i++ {
+		var c byte
+		for j := 0; j < 6; j++ {
+			c = c<<1 | block[6*i+j]
+		}
+		out = append(out, cryptAlphabet[c])
+	}
+	return string(out)
+}
+
+func cryptIndex(c byte) byte {
+	if i := strings.IndexByte(cryptAlphabet, c); i >= 0 {
+		return byte(i)
+	}
+	return 0
+}
+
+type desState struct {
+	KS [16][48]byte
+	E  [48]byte
+}
+
+func (d *desState) setKey(key []byte) {
+	var C, D [28]byte
+	for i := 0; i < 28; i++ {
+		C[i] = key[desPC1C[i]-1]
+		D[i] = key[desPC1D[i]-1]
+	}
+	for i := 0; i < 16; i++ {
+		for k := 0; k < int(desShifts[i]); k++ {
+			c0, d0 := C[0], D[0]
+			copy(C[:], C[1:])
+			copy(D[:], D[1:])
+			C[27], D[27] = c0, d0
+		}
+		for j := 0; j < 24; j++ {
+			d.KS[i][j] = C[desPC2C[j]-1]
+			d.KS[i][j+24] = D[desPC2D[j]-28-1]
+		}
+	}
+	d.E = desE
+}
+
+func (d *desState) encrypt(block []byte) {
+	var LR [64]byte
+	for j := 0; j < 64; j++ {
+		LR[j] = block[desIP[j]-1]
+	}
+	L, R := LR[:32], LR[32:]
+	var tempL [32]byte
+	var preS [48]byte
+	var f [32]byte
+	for i := 0; i < 16; i++ {
+		copy(tempL[:], R)
+		for j := 0; j < 48; j++ {
+			preS[j] = R[d.E[j]-1] ^ d.KS[i][j]
+		}
+		for j := 0; j < 8; j++ {
+			t := 6 * j
+			k := desS[j][preS[t]<<5|preS[t+1]<<3|preS[t+2]<<2|preS[t+3]<<1|preS[t+4]|preS[t+5]<<4]
+			t = 4 * j
+			f[t], f[t+1], f[t+2], f[t+3] = (k>>3)&1, (k>>2)&1, (k>>1)&1, k&1
+		}
+		for j := 0; j < 32; j++ {
+			R[j] = L[j] ^ f[desP[j]-1]
+		}
+		copy(L, tempL[:])
+	}
+	for j := 0; j < 32; j++ {
+		L[j], R[j] = R[j], L[j]
+	}
+	for j := 0; j < 64; j++ {
+		block[j] = LR[desFP[j]-1]
+	}
+}
+
+var (
+	desIP = [64]byte{
+		58, 50, 42, 34, 26, 18, 10, 2, 60, 52, 44, 36, 28, 20, 12, 4,
+		62, 54, 46, 38, 30, 22, 14, 6, 64, 56, 48, 40, 32, 24, 16, 8,
+		57, 49, 41, 33, 25, 17, 9, 1, 59, 51, 43, 35, 27, 19, 11, 3,
+		61, 53, 45, 37, 29, 21, 13, 5, 63, 55, 47, 39, 31, 23, 15, 7,
+	}
+	desFP = [64]byte{
+		40, 8, 48, 16, 56, 24, 64, 32, 39, 7, 47, 15, 55, 23, 63, 31,
+		38, 6, 46, 14, 54, 22, 62, 30, 37, 5, 45, 13, 53, 21, 61, 29,
+		36, 4, 44, 12, 52, 20, 60, 28, 35, 3, 43, 11, 51, 19, 59, 27,
+		34, 2, 42, 10, 50, 18, 58, 26, 33, 1, 41, 9, 49, 17, 57, 25,
+	}
+	desPC1C = [28]byte{
+		57, 49, 41, 33, 25, 17, 9, 1, 58, 50, 42, 34, 26, 18,
+		10, 2, 59, 51, 43, 35, 27, 19, 11, 3, 60, 52, 44, 36,
+	}
+	desPC1D = [28]byte{
+		63, 55, 47, 39, 31, 23, 15, 7, 62, 54, 46, 38, 30, 22,
+		14, 6, 61, 53, 45, 37, 29, 21, 13, 5, 28, 20, 12, 4,
+	}
+	desShifts = [16]byte{1, 1, 2, 2, 2, 2, 2, 2, 1, 2, 2, 2, 2, 2, 2, 1}
+	desPC2C   = [24]byte{
+		14, 17, 11, 24, 1, 5, 3, 28, 15, 6, 21, 10,
+		23, 19, 12, 4, 26, 8, 16, 7, 27, 20, 13, 2,
+	}
+	desPC2D = [24]byte{
+		41, 52, 31, 37, 47, 55, 30, 40, 51, 45, 33, 48,
+		44, 49, 39, 56, 34, 53, 46, 42, 50, 36, 29, 32,
+	}
+	desE = [48]byte{
+		32, 1, 2, 3, 4, 5, 4, 5, 6, 7, 8, 9,
+		8, 9, 10, 11, 12, 13, 12, 13, 14, 15, 16, 17,
+		16, 17, 18, 19, 20, 21, 20, 21, 22, 23, 24, 25,
+		24, 25, 26, 27, 28, 29, 28, 29, 30, 31, 32, 1,
+	}
+	desS = [8][64]byte{
+		{14, 4, 13, 1, 2, 15, 11, 8, 3, 10, 6, 12, 5, 9, 0, 7,
+			0, 15, 7, 4, 14, 2, 13, 1, 10, 6, 12, 11, 9, 5, 3, 8,
+			4, 1, 14, 8, 13, 6, 2, 11, 15, 12, 9, 7, 3, 10, 5, 0,
+			15, 12, 8, 2, 4, 9, 1, 7, 5, 11, 3, 14, 10, 0, 6, 13},
+		{15, 1, 8, 14, 6, 11, 3, 4, 9, 7, 2, 13, 12, 0, 5, 10,
+			3, 13, 4, 7, 15, 2, 8, 14, 12, 0, 1, 10, 6, 9, 11, 5,
+			0, 14, 7, 11, 10, 4, 13, 1, 5, 8, 12, 6, 9, 3, 2, 15,
+			13, 8, 10, 1, 3, 15, 4, 2, 11, 6, 7, 12, 0, 5, 14, 9},
+		{10, 0, 9, 14, 6, 3, 15, 5, 1, 13, 12, 7, 11, 4, 2, 8,
+			13, 7, 0, 9, 3, 4, 6, 10, 2, 8, 5, 14, 12, 11, 15, 1,
+			13, 6, 4, 9, 8, 15, 3, 0, 11, 1, 2, 12, 5, 10, 14, 7,
+			1, 10, 13, 0, 6, 9, 8, 7, 4, 15, 14, 3, 11, 5, 2, 12},
+		{7, 13, 14, 3, 0, 6, 9, 10, 1, 2, 8, 5, 11, 12, 4, 15,
+			13, 8, 11, 5, 6, 15, 0, 3, 4, 7, 2, 12, 1, 10, 14, 9,
+			10, 6, 9, 0, 12, 11, 7, 13, 15, 1, 3, 14, 5, 2, 8, 4,
+			3, 15, 0, 6, 10, 1, 13, 8, 9, 4, 5, 11, 12, 7, 2, 14},
+		{2, 12, 4, 1, 7, 10, 11, 6, 8, 5, 3, 15, 13, 0, 14, 9,
+			14, 11, 2, 12, 4, 7, 13, 1, 5, 0, 15, 10, 3, 9, 8, 6,
+			4, 2, 1, 11, 10, 13, 7, 8, 15, 9, 12, 5, 6, 3, 0, 14,
+			11, 8, 12, 7, 1, 14, 2, 13, 6, 15, 0, 9, 10, 4, 5, 3},
+		{12, 1, 10, 15, 9, 2, 6, 8, 0, 13, 3, 4, 14, 7, 5, 11,
+			10, 15, 4, 2, 7, 12, 9, 5, 6, 1, 13, 14, 0, 11, 3, 8,
+			9, 14, 15, 5, 2, 8, 12, 3, 7, 0, 4, 10, 1, 13, 11, 6,
+			4, 3, 2, 12, 9, 5, 15, 10, 11, 14, 1, 7, 6, 0, 8, 13},
+		{4, 11, 2, 14, 15, 0, 8, 13, 3, 12, 9, 7, 5, 10, 6, 1,
+			13, 0, 11, 7, 4, 9, 1, 10, 14, 3, 5, 12, 2, 15, 8, 6,
+			1, 4, 11, 13, 12, 3, 7, 14, 10, 15, 6, 8, 0, 5, 9, 2,
+			6, 11, 13, 8, 1, 4, 10, 7, 9, 5, 0, 15, 14, 2, 3, 12},
+		{13, 2, 8, 4, 6, 15, 11, 1, 10, 9, 3, 14, 5, 0, 12, 7,
+			1, 15, 13, 8, 10, 3, 7, 4, 12, 5, 6, 11, 0, 14, 9, 2,
+			7, 11, 4, 1, 9, 12, 14, 2, 0, 6, 10, 13, 15, 3, 5, 8,
+			2, 1, 14, 7, 4, 10, 8, 13, 15, 12, 9, 0, 3, 5, 6, 11},
+	}
+	desP = [32]byte{
+		16, 7, 20, 21, 29, 12, 28, 17, 1, 15, 23, 26, 5, 18, 31, 10,
+		2, 8, 24, 14, 32, 27, 3, 9, 19, 13, 30, 6, 22, 11, 4, 25,
+	}
+)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/securecookie"
+	"net/http"
+)
+
+//Cross-site request forgery protection. Each session gets a random token, which forms send back in a hidden field.
+//Another site can make the browser post to us with the session cookie, but it can not read the token.
+
+const csrfField = "csrf"
+
+//csrfToken returns the token of the session, making one if it has none yet.
+//It may save the session, so call it before writing the response.
+func csrfToken(w http.ResponseWriter, r *http.Request) string {
+	session, _ := store.Get(r, "auth")
+	token, ok := session.Values[csrfField].(string)
+	if !ok || token == "" {
+		token = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+		session.Values[csrfField] = token
+		session.Save(r, w)
+	}
+	return token
+}
+
+//CSRFMW rejects posts whose form does not carry the token of the session.
+type CSRFMW struct {
+	Wrapped http.Handler
+}
+
+func (c CSRFMW) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, _ := store.Get(r, "auth")
+	token, _ := session.Values[csrfField].(string)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.PostFormValue(csrfField))) != 1 {
+		logger.WithFields(logrus.Fields{
+			"method": r.Method,
+			"url":    r.URL,
+			"client": r.RemoteAddr,
+		}).Warn("Form rejected, CSRF token mismatch.")
+		http.Error(w, "The form has expired. Please go back, reload the page and try again.", http.StatusForbidden)
+		return
+	}
+	c.Wrapped.ServeHTTP(w, r)
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+//lockFile takes an exclusive lock on f without blocking.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
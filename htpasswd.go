@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//A HtpasswdUserManager is a User Manager backed by an Apache htpasswd file.
+//It understands bcrypt, APR1-MD5, SHA1 and crypt entries, so existing files from basic-auth setups can be used unchanged.
+//The file is reloaded whenever it has been modified since it was last read.
+//Register and Update only write back to the file if it is writable in the config; new passwords are stored as bcrypt.
+type HtpasswdUserManager struct {
+	mu       sync.Mutex
+	file     string
+	writable bool
+	admins   map[string]bool
+
+	entries  map[string]string //Username to hash
+	order    []string          //Usernames in file order, to keep the file recognizable on write
+	loadTime time.Time
+}
+
+func NewHtpasswdUserManager(file string, writable bool, admins []string) (*HtpasswdUserManager, error) {
+	hum := &HtpasswdUserManager{
+		file:     file,
+		writable: writable,
+		admins:   make(map[string]bool),
+	}
+	for _, name := range admins {
+		hum.admins[name] = true
+	}
+	if err := hum.load(); err != nil {
+		logger.WithFields(logrus.Fields{"err": err, "file": file}).Error("Loading htpasswd file")
+		return nil, err
+	}
+	logger.WithFields(logrus.Fields{"file": file, "users": len(hum.entries)}).Debug("Htpasswd-user manager initialized")
+	return hum, nil
+}
+
+//reload reads the file again if it has been modified since the last load. The caller must hold the lock.
+func (hum *HtpasswdUserManager) reload() {
+	finfo, err := os.Stat(hum.file)
+	if err != nil || !finfo.ModTime().After(hum.loadTime) {
+		return
+	}
+	logger.WithField("file", hum.file).Info("Reloading htpasswd file")
+	if err := hum.load(); err != nil {
+		logger.WithFields(logrus.Fields{"err": err, "file": hum.file}).Error("Reloading htpasswd file")
+	}
+}
+
+func (hum *HtpasswdUserManager) load() error {
+	f, err := os.Open(hum.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	entries := make(map[string]string)
+	var order []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			logger.WithFields(logrus.Fields{"file": hum.file, "line": line}).Warn("Skipping malformed htpasswd line")
+			continue
+		}
+		name, hash := line[:i], line[i+1:]
+		if _, ok := entries[name]; !ok {
+			order = append(order, name)
+		}
+		entries[name] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	hum.entries, hum.order, hum.loadTime = entries, order, finfo.ModTime()
+	return nil
+}
+
+//save writes all entries to a temporary file and renames it over the htpasswd file. The caller must hold the lock.
+func (hum *HtpasswdUserManager) save() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(hum.file), filepath.Base(hum.file)+".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, name := range hum.order {
+		fmt.Fprintf(w, "%s:%s\n", name, hum.entries[name])
+	}
+	err = w.Flush()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0640)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), hum.file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.WithFields(logrus.Fields{"err": err, "file": hum.file}).Error("Saving htpasswd file")
+		return err
+	}
+	if finfo, err := os.Stat(hum.file); err == nil {
+		hum.loadTime = finfo.ModTime()
+	}
+	return nil
+}
+
+func (hum *HtpasswdUserManager) Authenticate(username, password string) bool {
+	hum.mu.Lock()
+	hum.reload()
+	hash, ok := hum.entries[username]
+	hum.mu.Unlock()
+	return ok && verifyHtpasswd(hash, password)
+}
+
+//verifyHtpasswd checks a password against an htpasswd entry, telling the schemes apart by their prefix.
+//Hashes in one of our own formats are accepted too, since Update stores whatever the user has.
+func verifyHtpasswd(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "$1$"):
+		magic := hash[:strings.Index(hash[1:], "$")+2]
+		salt := strings.SplitN(hash[len(magic):], "$", 2)[0]
+		return subtle.ConstantTimeCompare([]byte(MD5Crypt(password, salt, magic)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(hash[5:])) == 1
+	case strings.HasPrefix(hash, "$"):
+		ok, _ := VerifyPassword(User{Passhash: Key(hash)}, password)
+		return ok
+	case len(hash) == 13:
+		return subtle.ConstantTimeCompare([]byte(DESCrypt(password, hash[:2])), []byte(hash)) == 1
+	}
+	return false
+}
+
+func (hum *HtpasswdUserManager) Get(username string) (User, error) {
+	hum.mu.Lock()
+	defer hum.mu.Unlock()
+	hum.reload()
+	hash, ok := hum.entries[username]
+	if !ok {
+		return User{}, ErrUnknownUser
+	}
+	return User{
+		Name:     username,
+		Admin:    hum.admins[username],
+		Passhash: Key(hash),
+	}, nil
+}
+
+func (hum *HtpasswdUserManager) Register(user User, password string) error {
+	if !hum.writable {
+		return ErrReadOnly
+	}
+	if user.Email != "" || !user.Active() || !user.ExpiresAt.IsZero() {
+		return ErrNotSupported //Nowhere to keep the address or state
+	}
+	username := user.Name
+	if strings.Contains(username, ":") {
+		return fmt.Errorf("username may not contain ':'")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	hum.mu.Lock()
+	defer hum.mu.Unlock()
+	hum.reload()
+	if _, ok := hum.entries[username]; ok {
+		return ErrUserExists
+	}
+	hum.entries[username] = string(hash)
+	hum.order = append(hum.order, username)
+	if err := hum.save(); err != nil {
+		delete(hum.entries, username)
+		hum.order = hum.order[:len(hum.order)-1]
+		return err
+	}
+	return nil
+}
+
+//Update stores the password hash of the user. Admin status comes from the config and is not stored.
+//Htpasswd files have no room for anything else, so two-factor secrets and email addresses are refused rather than lost.
+func (hum *HtpasswdUserManager) Update(user User) error {
+	if !hum.writable {
+		return ErrReadOnly
+	}
+	if len(user.TOTPSecret) > 0 || user.Email != "" || !user.Active() || user.MustChangePassword || !user.ExpiresAt.IsZero() {
+		return ErrNotSupported
+	}
+	hum.mu.Lock()
+	defer hum.mu.Unlock()
+	hum.reload()
+	old, ok := hum.entries[user.Name]
+	if !ok {
+		return ErrUnknownUser
+	}
+	if !isLegacyHash(user.Passhash) {
+		hum.entries[user.Name] = string(user.Passhash)
+	}
+	if err := hum.save(); err != nil {
+		hum.entries[user.Name] = old
+		return err
+	}
+	return nil
+}
+
+func (hum *HtpasswdUserManager) List() ([]User, error) {
+	hum.mu.Lock()
+	defer hum.mu.Unlock()
+	hum.reload()
+	list := make([]User, 0, len(hum.order))
+	for _, name := range hum.order {
+		list = append(list, User{Name: name, Admin: hum.admins[name], Passhash: Key(hum.entries[name])})
+	}
+	sort.Sort(usersByName(list))
+	return list, nil
+}
+
+func (hum *HtpasswdUserManager) Delete(username string) error {
+	if !hum.writable {
+		return ErrReadOnly
+	}
+	hum.mu.Lock()
+	defer hum.mu.Unlock()
+	hum.reload()
+	old, ok := hum.entries[username]
+	if !ok {
+		return ErrUnknownUser
+	}
+	order := hum.order
+	delete(hum.entries, username)
+	hum.order = nil
+	for _, name := range order {
+		if name != username {
+			hum.order = append(hum.order, name)
+		}
+	}
+	if err := hum.save(); err != nil {
+		hum.entries[username], hum.order = old, order
+		return err
+	}
+	return nil
+}
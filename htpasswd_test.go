@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyHtpasswd(t *testing.T) {
+	for _, hash := range []string{
+		"$2y$05$RDVQufF9O1jeuQKRBRx8kOcYicyaS05BMlvOY4kf1G/5OPLf.JQwa", //htpasswd -B
+		"$apr1$NWo2ZzAq$wD07ITFcOS3yjVU0ztsRI/",                        //htpasswd -m
+		"$1$saltsalt$ZliGyAN3DciDHEkDboonh/",
+		"{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=", //htpasswd -s
+		"ab0ozUNIgzCZ.",                     //htpasswd -d
+	} {
+		if !verifyHtpasswd(hash, "hunter2") {
+			t.Errorf("%s rejected the correct password", hash)
+		}
+		if verifyHtpasswd(hash, "hunter3") {
+			t.Errorf("%s accepted a wrong password", hash)
+		}
+	}
+}
+
+func TestDESCrypt(t *testing.T) {
+	for password, expected := range map[string]string{
+		"password123":  "ZxnjglVvhlyeM",
+		"longpassword": "./x0kTlw5iEAs",
+	} {
+		if hash := DESCrypt(password, expected[:2]); hash != expected {
+			t.Errorf("DESCrypt(%q) = %s, expected %s", password, hash, expected)
+		}
+	}
+}
+
+func TestHtpasswdUserManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "htpasswd")
+	ioutil.WriteFile(file, []byte("# Existing users\nalice:{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=\n"), 0600)
+
+	hum, err := NewHtpasswdUserManager(file, true, []string{"alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hum.Authenticate("alice", "hunter2") {
+		t.Error("alice could not log in")
+	}
+	if alice, _ := hum.Get("alice"); !alice.Admin {
+		t.Error("alice is not admin")
+	}
+
+	if err := hum.Register(User{Name: "bob"}, "hunter3"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(file)
+	if !strings.Contains(string(data), "alice:{SHA}") || !strings.Contains(string(data), "bob:$2a$") {
+		t.Errorf("Unexpected file contents after Register:\n%s", data)
+	}
+
+	//Changes made by others are picked up.
+	later := time.Now().Add(time.Second)
+	ioutil.WriteFile(file, []byte("carol:$apr1$NWo2ZzAq$wD07ITFcOS3yjVU0ztsRI/\n"), 0600)
+	os.Chtimes(file, later, later)
+	if !hum.Authenticate("carol", "hunter2") || hum.Authenticate("alice", "hunter2") {
+		t.Error("File was not reloaded")
+	}
+
+	readonly, err := NewHtpasswdUserManager(file, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := readonly.Register(User{Name: "dave"}, "hunter4"); err != ErrReadOnly {
+		t.Errorf("Register on read-only file: %v. Expected ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+//Just enough of JSON Web Tokens for OpenID Connect: compact JWS signed with RS256 or ES256, and keys in JWK form.
+//authprox itself signs with RS256 only, which every OpenID Connect client supports.
+
+var (
+	ErrJWTMalformed = errors.New("The token is not a well-formed JWT")
+	ErrJWTAlgorithm = errors.New("The token is signed with an unsupported algorithm")
+	ErrJWTSignature = errors.New("The signature of the token is not valid")
+	ErrJWKUnusable  = errors.New("The key is of an unsupported type")
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+//A jwt is a parsed, but not yet verified, token.
+type jwt struct {
+	Header    jwtHeader
+	Claims    map[string]interface{}
+	signed    []byte //The header and payload the signature is over
+	signature []byte
+}
+
+func parseJWT(token string) (t jwt, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return t, ErrJWTMalformed
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(header, &t.Header) != nil {
+		return t, ErrJWTMalformed
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(payload, &t.Claims) != nil {
+		return t, ErrJWTMalformed
+	}
+	if t.signature, err = base64.RawURLEncoding.DecodeString(parts[2]); err != nil {
+		return t, ErrJWTMalformed
+	}
+	t.signed = []byte(parts[0] + "." + parts[1])
+	return t, nil
+}
+
+//signJWT makes a token of the claims, signed with RS256.
+func signJWT(key *rsa.PrivateKey, header jwtHeader, claims interface{}) (string, error) {
+	header.Alg = "RS256"
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+//verify checks the signature with the key. The algorithm must fit the key, so a token can not pick a weaker one.
+func (t jwt) verify(key crypto.PublicKey) error {
+	digest := sha256.Sum256(t.signed)
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if t.Header.Alg != "RS256" {
+			return ErrJWTAlgorithm
+		}
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], t.signature) != nil {
+			return ErrJWTSignature
+		}
+	case *ecdsa.PublicKey:
+		if t.Header.Alg != "ES256" || key.Curve != elliptic.P256() {
+			return ErrJWTAlgorithm
+		}
+		if len(t.signature) != 64 { //JWS has r and s side by side instead of ASN.1
+			return ErrJWTSignature
+		}
+		r, s := new(big.Int).SetBytes(t.signature[:32]), new(big.Int).SetBytes(t.signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return ErrJWTSignature
+		}
+	default:
+		return ErrJWKUnusable
+	}
+	return nil
+}
+
+//claimString returns a string claim, or "" if it is missing or not a string.
+func (t jwt) claimString(name string) string {
+	s, _ := t.Claims[name].(string)
+	return s
+}
+
+//claimHas reports whether a claim is the value or, for a list like groups, contains it.
+func (t jwt) claimHas(name, value string) bool {
+	switch v := t.Claims[name].(type) {
+	case string:
+		return v == value
+	case bool:
+		return value == "" && v
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//A jsonWebKey is a public key as published in a JWK set.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`   //RSA modulus
+	E   string `json:"e,omitempty"`   //RSA exponent
+	Crv string `json:"crv,omitempty"` //EC curve
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+//rsaJWK publishes an RSA key for RS256 signatures.
+func rsaJWK(key *rsa.PublicKey, kid string) jsonWebKey {
+	return jsonWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	b64 := func(s string) *big.Int {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, e := b64(k.N), b64(k.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil, ErrJWKUnusable
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		x, y := b64(k.X), b64(k.Y)
+		if k.Crv != "P-256" || x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil, ErrJWKUnusable
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, ErrJWKUnusable
+}
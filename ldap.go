@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/go-ldap/ldap/v3"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//An LDAPUserManager authenticates users against an LDAP directory or Active Directory.
+//It searches for the user entry with a service account and then binds as that entry with the given password.
+//Membership in the configured admin group makes a user an admin.
+//The directory is managed elsewhere, so Register and Update are not supported.
+type LDAPUserManager struct {
+	URL                string
+	StartTLS           bool
+	InsecureSkipVerify bool
+	BindDN             string
+	BindPassword       string
+	BaseDN             string
+	Filter             string
+	AdminGroup         string
+
+	dial func() (ldapConn, error)
+}
+
+//The part of *ldap.Conn used by the LDAPUserManager, so a stand-in directory can be used in tests.
+type ldapConn interface {
+	Bind(username, password string) error
+	Search(*ldap.SearchRequest) (*ldap.SearchResult, error)
+	Close() error
+}
+
+var (
+	ErrAmbiguousUser = errors.New("More than one user matched")
+)
+
+const (
+	defaultLDAPFilter  = "(uid=%s)"
+	ldapGroupAttribute = "memberOf"
+	ldapMailAttribute  = "mail"
+)
+
+func NewLDAPUserManager() (*LDAPUserManager, error) {
+	lum := &LDAPUserManager{
+		URL:                config.LDAP.URL,
+		StartTLS:           config.LDAP.StartTLS,
+		InsecureSkipVerify: config.LDAP.InsecureSkipVerify,
+		BindDN:             config.LDAP.BindDN,
+		BindPassword:       config.LDAP.BindPassword,
+		BaseDN:             config.LDAP.BaseDN,
+		Filter:             config.LDAP.Filter,
+		AdminGroup:         config.LDAP.AdminGroup,
+	}
+	if lum.Filter == "" {
+		lum.Filter = defaultLDAPFilter
+	}
+	if _, err := url.Parse(lum.URL); err != nil || lum.URL == "" {
+		logger.WithFields(logrus.Fields{"url": lum.URL, "err": err}).Error("Invalid LDAP URL")
+		return nil, fmt.Errorf("invalid LDAP URL %q", lum.URL)
+	}
+	lum.dial = lum.dialDirectory
+
+	//Fail early on a bad configuration rather than on the first login.
+	conn, err := lum.connect()
+	if err != nil {
+		logger.WithFields(logrus.Fields{"url": lum.URL, "err": err}).Error("Connecting to LDAP directory")
+		return nil, err
+	}
+	conn.Close()
+	logger.WithFields(logrus.Fields{"url": lum.URL}).Debug("LDAP-user manager initialized")
+	return lum, nil
+}
+
+func (lum *LDAPUserManager) dialDirectory() (ldapConn, error) {
+	u, _ := url.Parse(lum.URL)
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: lum.InsecureSkipVerify,
+	}
+	conn, err := ldap.DialURL(lum.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	if lum.StartTLS && u.Scheme == "ldap" {
+		if err = conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+//connect dials the directory and binds as the service account, if one is configured.
+func (lum *LDAPUserManager) connect() (ldapConn, error) {
+	conn, err := lum.dial()
+	if err != nil {
+		return nil, err
+	}
+	if lum.BindDN != "" {
+		if err = conn.Bind(lum.BindDN, lum.BindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+//search finds the single entry of a user.
+func (lum *LDAPUserManager) search(conn ldapConn, username string) (*ldap.Entry, error) {
+	res, err := conn.Search(ldap.NewSearchRequest(
+		lum.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		fmt.Sprintf(lum.Filter, ldap.EscapeFilter(username)),
+		[]string{"dn", ldapGroupAttribute, ldapMailAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	switch len(res.Entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+		return res.Entries[0], nil
+	}
+	return nil, ErrAmbiguousUser
+}
+
+//isAdmin checks the memberOf attribute of the entry, and falls back to looking
+//for the entry among the members of the admin group for directories without memberOf.
+func (lum *LDAPUserManager) isAdmin(conn ldapConn, entry *ldap.Entry) bool {
+	if lum.AdminGroup == "" {
+		return false
+	}
+	for _, group := range entry.GetAttributeValues(ldapGroupAttribute) {
+		if strings.EqualFold(group, lum.AdminGroup) {
+			return true
+		}
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		lum.AdminGroup, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false,
+		fmt.Sprintf("(|(member=%s)(uniqueMember=%s))", ldap.EscapeFilter(entry.DN), ldap.EscapeFilter(entry.DN)),
+		[]string{"dn"},
+		nil,
+	))
+	return err == nil && len(res.Entries) > 0
+}
+
+func (lum *LDAPUserManager) Authenticate(username, password string) bool {
+	if username == "" || password == "" {
+		return false //An empty password would be an unauthenticated bind, which always succeeds.
+	}
+	conn, err := lum.connect()
+	if err != nil {
+		logger.WithFields(logrus.Fields{"url": lum.URL, "err": err}).Error("Connecting to LDAP directory")
+		return false
+	}
+	defer conn.Close()
+
+	entry, err := lum.search(conn, username)
+	if err != nil {
+		if err != ErrUnknownUser {
+			logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Searching LDAP directory")
+		}
+		return false
+	}
+	if err = conn.Bind(entry.DN, password); err != nil {
+		if !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			logger.WithFields(logrus.Fields{"user": username, "dn": entry.DN, "err": err}).Error("Binding as LDAP user")
+		}
+		return false
+	}
+	return true
+}
+
+func (lum *LDAPUserManager) Get(username string) (User, error) {
+	conn, err := lum.connect()
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+
+	entry, err := lum.search(conn, username)
+	if err != nil {
+		return User{}, err
+	}
+	return User{
+		Name:  username,
+		Admin: lum.isAdmin(conn, entry),
+		Email: entry.GetAttributeValue(ldapMailAttribute),
+	}, nil
+}
+
+func (lum *LDAPUserManager) Register(user User, password string) error {
+	return ErrReadOnly
+}
+
+func (lum *LDAPUserManager) Update(user User) error {
+	return ErrReadOnly
+}
+
+var ldapFilterAttribute = regexp.MustCompile(`\((\w+)=%s\)`)
+
+//List finds all entries matching the filter with the username replaced by a wildcard.
+//The username is read from the attribute the filter compares it to.
+func (lum *LDAPUserManager) List() ([]User, error) {
+	m := ldapFilterAttribute.FindStringSubmatch(lum.Filter)
+	if m == nil {
+		return nil, ErrNotSupported
+	}
+	conn, err := lum.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	res, err := conn.Search(ldap.NewSearchRequest(
+		lum.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		strings.Replace(lum.Filter, "%s", "*", -1),
+		[]string{"dn", m[1], ldapGroupAttribute, ldapMailAttribute},
+		nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	var list []User
+	for _, entry := range res.Entries {
+		list = append(list, User{
+			Name:  entry.GetAttributeValue(m[1]),
+			Admin: lum.isAdmin(conn, entry),
+			Email: entry.GetAttributeValue(ldapMailAttribute),
+		})
+	}
+	sort.Sort(usersByName(list))
+	return list, nil
+}
+
+func (lum *LDAPUserManager) Delete(username string) error {
+	return ErrReadOnly
+}
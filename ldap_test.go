@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/go-ldap/ldap/v3"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+//fakeDirectory is an in-process stand-in for an LDAP server.
+//It understands the equality and member filters the LDAPUserManager sends.
+type fakeDirectory struct {
+	entries   map[string]map[string][]string //DN to attributes
+	passwords map[string]string              //DN to password
+}
+
+type fakeLDAPConn struct {
+	dir   *fakeDirectory
+	bound string
+}
+
+var fakeFilter = regexp.MustCompile(`\((\w+)=([^()]*)\)`)
+
+func (c *fakeLDAPConn) Bind(dn, password string) error {
+	if pw, ok := c.dir.passwords[dn]; !ok || pw != password {
+		return ldap.NewError(ldap.LDAPResultInvalidCredentials, nil)
+	}
+	c.bound = dn
+	return nil
+}
+
+func (c *fakeLDAPConn) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if c.bound == "" {
+		return nil, ldap.NewError(ldap.LDAPResultInsufficientAccessRights, nil)
+	}
+	res := &ldap.SearchResult{}
+	for dn, attrs := range c.dir.entries {
+		if req.Scope == ldap.ScopeBaseObject && dn != req.BaseDN {
+			continue
+		}
+		if req.Scope != ldap.ScopeBaseObject && !strings.HasSuffix(dn, req.BaseDN) {
+			continue
+		}
+		for _, m := range fakeFilter.FindAllStringSubmatch(req.Filter, -1) {
+			for _, v := range attrs[m[1]] {
+				if v == m[2] {
+					res.Entries = append(res.Entries, ldap.NewEntry(dn, attrs))
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+func (c *fakeLDAPConn) Close() error { return nil }
+
+func newFakeLDAPUserManager() *LDAPUserManager {
+	dir := &fakeDirectory{
+		entries: map[string]map[string][]string{
+			"uid=alice,ou=people,dc=example,dc=com": {"uid": {"alice"}, "memberOf": {"cn=admins,ou=groups,dc=example,dc=com"}},
+			"uid=bob,ou=people,dc=example,dc=com":   {"uid": {"bob"}},
+			"uid=carol,ou=people,dc=example,dc=com": {"uid": {"carol"}},
+			"cn=admins,ou=groups,dc=example,dc=com": {"member": {"uid=carol,ou=people,dc=example,dc=com"}},
+		},
+		passwords: map[string]string{
+			"cn=authprox,dc=example,dc=com":         "service",
+			"uid=alice,ou=people,dc=example,dc=com": "hunter2",
+			"uid=bob,ou=people,dc=example,dc=com":   "hunter3",
+		},
+	}
+	return &LDAPUserManager{
+		BindDN:       "cn=authprox,dc=example,dc=com",
+		BindPassword: "service",
+		BaseDN:       "ou=people,dc=example,dc=com",
+		Filter:       defaultLDAPFilter,
+		AdminGroup:   "cn=admins,ou=groups,dc=example,dc=com",
+		dial:         func() (ldapConn, error) { return &fakeLDAPConn{dir: dir}, nil },
+	}
+}
+
+func TestLDAPUserManager_Authenticate(t *testing.T) {
+	lum := newFakeLDAPUserManager()
+	for _, c := range []struct {
+		user, password string
+		expected       bool
+	}{
+		{"alice", "hunter2", true},
+		{"alice", "hunter3", false},
+		{"alice", "", false},
+		{"bob", "hunter3", true},
+		{"mallory", "hunter2", false},
+		{"*", "hunter2", false},
+	} {
+		if lum.Authenticate(c.user, c.password) != c.expected {
+			t.Errorf("Authenticate(%q, %q) != %v", c.user, c.password, c.expected)
+		}
+	}
+}
+
+func TestLDAPUserManager_Admin(t *testing.T) {
+	lum := newFakeLDAPUserManager()
+	for name, admin := range map[string]bool{"alice": true, "bob": false, "carol": true} {
+		user, err := lum.Get(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Admin != admin {
+			t.Errorf("%s: Admin = %v, expected %v", name, user.Admin, admin)
+		}
+	}
+	if _, err := lum.Get("mallory"); err != ErrUnknownUser {
+		t.Errorf("Unknown user: %v. Expected ErrUnknownUser", err)
+	}
+	if err := lum.Register(User{Name: "mallory"}, "hunter2"); err != ErrReadOnly {
+		t.Errorf("Register: %v. Expected ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/securecookie"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+//A Mailer delivers plain text mail to users, like password reset links.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+//The mailer of this server. Nil when mail is disabled.
+var mailer Mailer
+
+var (
+	ErrInvalidAddress = errors.New("Invalid email address")
+	ErrUnknownMailer  = errors.New("Unknown mail method. Expected smtp or directory.")
+)
+
+func selectMailer() {
+	c := config.Mail
+	switch c.Method {
+	case "":
+		return
+	case "smtp":
+		mailer = &SMTPMailer{
+			Address:  c.Address,
+			From:     c.From,
+			Username: c.Username,
+			Password: c.Password,
+		}
+	case "directory":
+		mailer = &DirMailer{Dir: c.Address, From: c.From}
+	default:
+		logger.WithFields(logrus.Fields{"err": ErrUnknownMailer, "method": c.Method}).Fatal("Unable to set up mail.")
+	}
+	if config.PublicURL == "" {
+		logger.Fatal("PublicURL must be set for the links in mail to work.")
+	}
+	if err := ensureBuckets(stateDB, BoltBucketPasswordResets); err != nil {
+		logger.WithField("err", err).Fatal("Unable to create password reset bucket.")
+	}
+	logger.WithFields(logrus.Fields{"method": c.Method, "address": c.Address}).Info("Mail enabled")
+}
+
+//composeMail builds an RFC 5322 message. The recipient is checked so user data can not inject headers.
+func composeMail(from, to, subject, body string) ([]byte, error) {
+	if _, err := mail.ParseAddress(to); err != nil {
+		return nil, ErrInvalidAddress
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%x@authprox>\r\n", securecookie.GenerateRandomKey(16))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(body)
+	return buf.Bytes(), nil
+}
+
+//A SMTPMailer sends mail through an SMTP server, using STARTTLS when the server offers it.
+type SMTPMailer struct {
+	Address  string //host:port
+	From     string
+	Username string //Leave empty for servers that relay without authentication
+	Password string
+}
+
+func (sm *SMTPMailer) Send(to, subject, body string) error {
+	msg, err := composeMail(sm.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if sm.Username != "" {
+		host, _, _ := net.SplitHostPort(sm.Address)
+		auth = smtp.PlainAuth("", sm.Username, sm.Password, host)
+	}
+	//The envelope wants bare addresses, without display names.
+	from, rcpt := sm.From, to
+	if addr, err := mail.ParseAddress(sm.From); err == nil {
+		from = addr.Address
+	}
+	if addr, err := mail.ParseAddress(to); err == nil {
+		rcpt = addr.Address
+	}
+	return smtp.SendMail(sm.Address, auth, from, []string{rcpt}, msg)
+}
+
+//A DirMailer writes every message to a file in a directory instead of sending it.
+//It is meant for testing, or for handing mail to another program that picks up the files.
+type DirMailer struct {
+	Dir  string
+	From string
+}
+
+func (dm *DirMailer) Send(to, subject, body string) error {
+	msg, err := composeMail(dm.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+	//Written under a temporary name first so nothing picks up a half-written message.
+	name := fmt.Sprintf("%s-%x.eml", time.Now().UTC().Format("20060102T150405.000000000"), securecookie.GenerateRandomKey(4))
+	tmp := filepath.Join(dm.Dir, "."+name)
+	if err := ioutil.WriteFile(tmp, msg, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(dm.Dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"flag"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/securecookie"
@@ -14,6 +17,7 @@ import (
 var (
 	cfile      = flag.String("f", defaultcfile, "Config file to use")
 	setup      = flag.Bool("setup", false, "creates a config-file with key")
+	dryRun     = flag.Bool("migrate-dry-run", false, "report the migrations the user database needs without applying them")
 	logger     *logrus.Logger
 	users      UserManager
 	recaptcher recaptcha.R
@@ -27,6 +31,7 @@ func init() {
 }
 
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 	loadConfig()
 	setupLogger()
@@ -34,17 +39,43 @@ func main() {
 	if *setup {
 		config.Keys.AuthenticationKey = securecookie.GenerateRandomKey(64)
 		config.Keys.EncryptionKey = securecookie.GenerateRandomKey(32)
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			logger.WithField("err", err).Fatal("Unable to generate signing key.")
+		}
+		config.Keys.SigningKey = x509.MarshalPKCS1PrivateKey(key)
 		saveConfig()
 		return
 	}
 
+	if *dryRun {
+		os.Exit(reportMigrations())
+	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	selectPasswordHasher()
+	selectPasswordPolicy()
 	selectUserManager()
+	openStateDB()
+	selectSessionRegistry()
+	selectAPITokens()
+	selectAuditLog()
+	selectThrottle()
+	selectMailer()
+	selectRegistrationMode()
+	selectRelyingParty()
+	selectOIDCProviders()
+	selectIdentityProvider()
 	selectPageSource()
 
 	recaptcher = recaptcha.R{
 		Secret: config.Keys.ReCaptcha,
 	}
 
+	go pruneAuditLog()
+	go pruneThrottle()
 	handler := setupHandlers()
 	http.ListenAndServe(config.Address, handler)
 }
@@ -56,30 +87,75 @@ func setupLogger() {
 }
 
 func selectUserManager() {
-	switch config.Database.Type {
+	if config.Database.Type == "chain" {
+		selectChain()
+		return
+	}
+	var err error
+	users, err = openUserManager(config.Database.Type, config.Database.Location)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"type":     config.Database.Type,
+			"location": config.Database.Location,
+			"err":      err,
+		}).Fatal("Unable to open user database.")
+	}
+}
+
+//openUserManager opens a single backend. users stays nil for an unknown type, as it always has.
+func openUserManager(typ, location string) (UserManager, error) {
+	switch typ {
 	case "dummy":
-		usr_data := strings.Split(config.Database.Location, " ")
+		usr_data := strings.Split(location, " ")
 		if len(usr_data) < 2 {
 			logger.WithFields(logrus.Fields{
 				"expected": "<username> <password>",
-				"found":    config.Database.Location,
+				"found":    location,
 			}).Panic("Invalid dummy database configuration.")
 		}
 
-		users = &DummyUserManager{
-			Name:     usr_data[0],
-			Passhash: HashAndSalt(usr_data[1], Key{1}),
-			Admin:    true,
-			Salt:     Key{1},
+		dummy := &DummyUserManager{}
+		if err := dummy.Register(User{Name: usr_data[0]}, usr_data[1]); err != nil {
+			return nil, err
 		}
+		return dummy, nil
 	case "bolt":
-		var err error
-		users, err = NewBoltUserManager(config.Database.Location)
+		return NewBoltUserManager(location)
+	case "sql":
+		return NewSQLUserManager(location)
+	case "ldap":
+		return NewLDAPUserManager()
+	case "htpasswd":
+		return NewHtpasswdUserManager(location, config.Htpasswd.Writable, config.Htpasswd.Admins)
+	case "json":
+		return NewJsonUserManager(location)
+	}
+	return nil, nil
+}
+
+func selectChain() {
+	var backends []ChainBackend
+	for _, bc := range config.Database.Chain {
+		if bc.Name == "" {
+			bc.Name = bc.Type
+		}
+		um, err := openUserManager(bc.Type, bc.Location)
+		if err == nil && um == nil {
+			err = ErrUnknownBackendType
+		}
 		if err != nil {
 			logger.WithFields(logrus.Fields{
-				"type":     config.Database.Type,
-				"location": config.Database.Location,
-			}).Fatal("Unable to create database connection.")
+				"backend":  bc.Name,
+				"type":     bc.Type,
+				"location": bc.Location,
+				"err":      err,
+			}).Fatal("Unable to open user database.")
 		}
+		backends = append(backends, ChainBackend{Name: bc.Name, UserManager: um, FallThrough: bc.FallThrough})
+	}
+	chain, err := NewChainUserManager(backends, config.Database.Register)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"register": config.Database.Register, "err": err}).Fatal("Unable to set up the backend chain.")
 	}
+	users = chain
 }
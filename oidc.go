@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Sign in with an OpenID Connect provider, using the authorization code flow with PKCE.
+//The identity a provider vouches for is linked to a local user by the sub claim, so a local account can not be taken
+//over by someone who picks the same name at the provider. Users are created at their first sign-in.
+
+//An OIDCProvider is an identity provider from the config, with what has been learnt from it.
+type OIDCProvider struct {
+	OIDCConfig
+	RedirectURL string
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+//oidcDiscovery is the part of the discovery document authprox needs.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+const (
+	oidcTimeout    = 10 * time.Minute //How long a user may take at the provider
+	oidcClockSkew  = time.Minute
+	oidcKeyRefetch = time.Minute //Least time between fetching the keys again for an unknown key ID
+)
+
+var (
+	oidcProviders []*OIDCProvider
+	oidcClient    = &http.Client{Timeout: 10 * time.Second}
+
+	BoltBucketOIDCIdentities = []byte("oidc_identities") //<provider> <sub> to username
+)
+
+var (
+	ErrOIDCConfig     = errors.New("An OIDC provider needs a name, an issuer and a client ID, and PublicURL must be set")
+	ErrOIDCDiscovery  = errors.New("The discovery document of the provider is not valid")
+	ErrOIDCState      = errors.New("The sign-in is unknown or has timed out")
+	ErrOIDCToken      = errors.New("The provider did not hand out an ID token")
+	ErrOIDCClaims     = errors.New("The ID token is not meant for authprox, has expired or was replayed")
+	ErrOIDCNoKey      = errors.New("The ID token is signed with an unknown key")
+	ErrOIDCNoUsername = errors.New("The provider did not tell a username")
+	ErrOIDCNameTaken  = errors.New("An account with that name already exists")
+	ErrOIDCClosed     = errors.New("New accounts can not be created")
+)
+
+func selectOIDCProviders() {
+	for _, c := range config.OIDC {
+		if c.Name == "" || c.Issuer == "" || c.ClientID == "" || config.PublicURL == "" {
+			logger.WithFields(logrus.Fields{"name": c.Name, "err": ErrOIDCConfig}).Fatal("Invalid OIDC provider.")
+		}
+		if c.Title == "" {
+			c.Title = c.Name
+		}
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{"openid", "profile", "email"}
+		}
+		if c.UsernameClaim == "" {
+			c.UsernameClaim = "preferred_username"
+		}
+		p := &OIDCProvider{
+			OIDCConfig:  c,
+			RedirectURL: strings.TrimSuffix(config.PublicURL, "/") + "/proxy/login/oidc/" + url.PathEscape(c.Name) + "/callback",
+		}
+		oidcProviders = append(oidcProviders, p)
+		logger.WithFields(logrus.Fields{"name": c.Name, "issuer": c.Issuer}).Info("OIDC provider enabled")
+	}
+	if len(oidcProviders) > 0 {
+		if err := ensureBuckets(stateDB, BoltBucketOIDCIdentities); err != nil {
+			logger.WithField("err", err).Fatal("Unable to create OIDC bucket.")
+		}
+	}
+}
+
+func oidcProvider(name string) *OIDCProvider {
+	for _, p := range oidcProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := oidcClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+//discover reads the discovery document once and keeps it.
+func (p *OIDCProvider) discover(ctx context.Context) (oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := getJSON(ctx, strings.TrimSuffix(p.Issuer, "/")+"/.well-known/openid-configuration", &d); err != nil {
+		return d, err
+	}
+	if d.Issuer != p.Issuer || d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return d, ErrOIDCDiscovery
+	}
+	p.discovery = &d
+	return d, nil
+}
+
+//key returns the signing key with the ID. The keys are fetched again when the ID is unknown, as after a key rotation.
+func (p *OIDCProvider) key(ctx context.Context, jwksURI, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeyRefetch {
+		return nil, ErrOIDCNoKey
+	}
+	var set jsonWebKeySet
+	if err := getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, err
+	}
+	p.keys, p.keysFetched = make(map[string]crypto.PublicKey), time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if k, err := jwk.publicKey(); err == nil {
+			p.keys[jwk.Kid] = k
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, ErrOIDCNoKey
+}
+
+func randomToken() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+//pkceChallenge is the S256 code challenge for a verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *OIDCProvider) authURL(d oidcDiscovery, state, nonce, verifier string) string {
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.RedirectURL},
+		"scope":                 {strings.Join(p.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + q.Encode()
+}
+
+//exchange trades the authorization code for an ID token at the token endpoint.
+func (p *OIDCProvider) exchange(ctx context.Context, d oidcDiscovery, code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	res, err := oidcClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var body struct {
+		IDToken     string `json:"id_token"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s", body.Error, body.Description)
+	}
+	if body.IDToken == "" {
+		return "", ErrOIDCToken
+	}
+	return body.IDToken, nil
+}
+
+//verifyIDToken checks that the token was signed by the provider, for authprox, for this sign-in and is still valid.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, d oidcDiscovery, raw, nonce string) (jwt, error) {
+	t, err := parseJWT(raw)
+	if err != nil {
+		return t, err
+	}
+	key, err := p.key(ctx, d.JWKSURI, t.Header.Kid)
+	if err != nil {
+		return t, err
+	}
+	if err := t.verify(key); err != nil {
+		return t, err
+	}
+	exp, _ := t.Claims["exp"].(float64)
+	audiences := 0
+	switch aud := t.Claims["aud"].(type) {
+	case string:
+		if aud == p.ClientID {
+			audiences = 1
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if a == p.ClientID {
+				audiences = len(aud)
+			}
+		}
+	}
+	switch {
+	case t.claimString("iss") != d.Issuer,
+		audiences == 0,
+		audiences > 1 && t.claimString("azp") != p.ClientID,
+		time.Unix(int64(exp), 0).Add(oidcClockSkew).Before(time.Now()),
+		subtle.ConstantTimeCompare([]byte(t.claimString("nonce")), []byte(nonce)) != 1,
+		t.claimString("sub") == "":
+		return t, ErrOIDCClaims
+	}
+	return t, nil
+}
+
+func oidcIdentityKey(provider, sub string) []byte {
+	return []byte(provider + " " + sub)
+}
+
+func linkedUser(provider, sub string) (username string, err error) {
+	err = stateDB.View(func(tx *bolt.Tx) error {
+		username = string(tx.Bucket(BoltBucketOIDCIdentities).Get(oidcIdentityKey(provider, sub)))
+		return nil
+	})
+	return
+}
+
+func linkIdentity(provider, sub, username string) error {
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketOIDCIdentities).Put(oidcIdentityKey(provider, sub), []byte(username))
+	})
+}
+
+//userFor finds or creates the local user of a verified ID token and brings the admin status in line with the claims.
+//In approval mode new users wait for an admin like any other registration. In invite mode the invite the visitor
+//followed before signing in is used up. With registration closed nobody new gets in.
+func (p *OIDCProvider) userFor(r *http.Request, t jwt) (User, error) {
+	sub := t.claimString("sub")
+	username, err := linkedUser(p.Name, sub)
+	if err != nil {
+		return User{}, err
+	}
+	var user User
+	if username != "" {
+		if user, err = users.Get(username); err != ErrUnknownUser {
+			if err != nil {
+				return user, err
+			}
+			return p.syncAdmin(r, t, user)
+		}
+		//The local user was deleted since, so the identity gets a new one.
+	}
+
+	if username = t.claimString(p.UsernameClaim); username == "" {
+		return User{}, ErrOIDCNoUsername
+	}
+	if registrationMode == RegistrationClosed {
+		return User{}, ErrOIDCClosed
+	}
+	if _, err := users.Get(username); err != ErrUnknownUser {
+		if err == nil {
+			return User{}, ErrOIDCNameTaken
+		}
+		return User{}, err
+	}
+	var invite Invite
+	if registrationMode == RegistrationInvite {
+		session, _ := store.Get(r, "auth")
+		code, _ := session.Values["invite"].(string)
+		if invite, err = takeInvite(code); err != nil {
+			return User{}, ErrOIDCClosed
+		}
+		delete(session.Values, "invite") //Saved with the outcome of the sign-in
+	}
+	user = User{
+		Name:    username,
+		Pending: registrationMode == RegistrationApproval,
+		Admin:   p.AdminClaim != "" && t.claimHas(p.AdminClaim, p.AdminValue),
+	}
+	if verified, ok := t.Claims["email_verified"].(bool); !ok || verified {
+		user.Email = t.claimString("email")
+	}
+	if err := users.Register(user, randomToken()); err != nil { //The password is never told, so only the provider lets the user in
+		if invite.Code != "" {
+			putInvite(invite)
+		}
+		return User{}, err
+	}
+	if err := linkIdentity(p.Name, sub, username); err != nil {
+		return User{}, err
+	}
+	logger.WithFields(logrus.Fields{"user": username, "provider": p.Name, "client": r.RemoteAddr}).Info("User created at first OIDC sign-in")
+	details := "Created at the first sign-in with " + p.Title
+	if invite.Code != "" {
+		details += ". Invited by " + invite.CreatedBy
+	}
+	audit(r, EventRegister, username, "", details)
+	if user, err = users.Get(username); err != nil {
+		return user, err
+	}
+	return p.syncAdmin(r, t, user)
+}
+
+//syncAdmin gives or takes admin rights by the admin claim, if one is configured.
+func (p *OIDCProvider) syncAdmin(r *http.Request, t jwt, user User) (User, error) {
+	if p.AdminClaim == "" {
+		return user, nil
+	}
+	admin := t.claimHas(p.AdminClaim, p.AdminValue)
+	if user.Admin == admin {
+		return user, nil
+	}
+	user.Admin = admin
+	if err := users.Update(user); err != nil {
+		return user, err
+	}
+	audit(r, EventAdmin, user.Name, "", fmt.Sprintf("Admin set to %v by the %s claim of %s", admin, p.AdminClaim, p.Title))
+	return user, nil
+}
+
+var oidcLoginContent = template.Must(template.New("oidc_login").Parse(`
+	<p>{{range .}}<a class="button" href="/proxy/login/oidc/{{.Name}}">Sign in with {{.Title}}</a> {{end}}</p>`))
+
+//getOIDCLogin sends the user to the provider, remembering what the callback has to check.
+func getOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p := oidcProvider(mux.Vars(r)["name"])
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := p.discover(r.Context())
+	if err != nil {
+		logger.WithFields(logrus.Fields{"provider": p.Name, "err": err}).Error("Reading OIDC discovery document")
+		page := loginPage()
+		page.Message = p.Title + " can not be reached right now. Please try again later."
+		renderer.Render(w, page)
+		return
+	}
+	state, nonce, verifier := randomToken(), randomToken(), randomToken()
+	session, _ := store.Get(r, "auth")
+	session.Values["oidc_provider"] = p.Name
+	session.Values["oidc_state"] = state
+	session.Values["oidc_nonce"] = nonce
+	session.Values["oidc_verifier"] = verifier
+	session.Values["oidc_since"] = time.Now().Unix()
+	session.Save(r, w)
+	http.Redirect(w, r, p.authURL(d, state, nonce, verifier), http.StatusFound)
+}
+
+//getOIDCCallback is where the provider sends the user back with an authorization code.
+func getOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p := oidcProvider(mux.Vars(r)["name"])
+	if p == nil {
+		http.NotFound(w, r)
+		return
+	}
+	session, _ := store.Get(r, "auth")
+	provider, _ := session.Values["oidc_provider"].(string)
+	state, _ := session.Values["oidc_state"].(string)
+	nonce, _ := session.Values["oidc_nonce"].(string)
+	verifier, _ := session.Values["oidc_verifier"].(string)
+	since, _ := session.Values["oidc_since"].(int64)
+	for _, k := range []string{"oidc_provider", "oidc_state", "oidc_nonce", "oidc_verifier", "oidc_since"} {
+		delete(session.Values, k) //A sign-in can only be completed once. Saved with the outcome
+	}
+
+	q := r.URL.Query()
+	fail := func(err error, message string) {
+		session.Save(r, w)
+		logger.WithFields(logrus.Fields{"provider": p.Name, "client": r.RemoteAddr, "err": err}).Info("OIDC sign-in failed.")
+		audit(r, EventLoginFailed, "", "", "Sign-in with "+p.Title+": "+err.Error())
+		page := loginPage()
+		page.Message = message
+		renderer.Render(w, page)
+	}
+	if provider != p.Name || state == "" || time.Since(time.Unix(since, 0)) > oidcTimeout ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		fail(ErrOIDCState, "The sign-in has timed out. Please try again.")
+		return
+	}
+	if e := q.Get("error"); e != "" {
+		fail(errors.New(e+" "+q.Get("error_description")), "The sign-in with "+p.Title+" was cancelled or refused.")
+		return
+	}
+	d, err := p.discover(r.Context())
+	if err != nil {
+		fail(err, p.Title+" can not be reached right now. Please try again later.")
+		return
+	}
+	raw, err := p.exchange(r.Context(), d, q.Get("code"), verifier)
+	if err != nil {
+		fail(err, "The sign-in with "+p.Title+" did not succeed.")
+		return
+	}
+	t, err := p.verifyIDToken(r.Context(), d, raw, nonce)
+	if err != nil {
+		fail(err, "The sign-in with "+p.Title+" did not succeed.")
+		return
+	}
+	user, err := p.userFor(r, t)
+	switch err {
+	case nil:
+	case ErrOIDCNameTaken:
+		fail(err, "An account named "+t.claimString(p.UsernameClaim)+" already exists here. Please log in with its password.")
+		return
+	case ErrOIDCNoUsername, ErrOIDCClosed:
+		fail(err, "No account can be made for you here.")
+		return
+	default:
+		fail(err, "The sign-in with "+p.Title+" did not succeed.")
+		return
+	}
+	if reason := user.inactiveReason(); reason != nil {
+		page := loginPage()
+		page.Message = inactiveMessage(reason)
+		audit(r, EventLoginFailed, user.Name, "", "Sign-in with "+p.Title+": "+reason.Error())
+		session.Save(r, w)
+		renderer.Render(w, page)
+		return
+	}
+	//The provider is trusted with all factors, so no second factor is asked for here.
+	to := returnTo(session)
+	startSession(w, r, session, user.Name)
+	renderLoginSuccess(w, r, to)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//mockIdP is an identity provider that signs whatever claims the test sets for the next login.
+type mockIdP struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims map[string]interface{}
+
+	nonce, challenge string //Of the last authorization request
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key}
+	m := http.NewServeMux()
+	m.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.URL,
+			AuthorizationEndpoint: idp.URL + "/authorize",
+			TokenEndpoint:         idp.URL + "/token",
+			JWKSURI:               idp.URL + "/jwks",
+		})
+	})
+	m.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != "authprox" || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		idp.nonce, idp.challenge = q.Get("nonce"), q.Get("code_challenge")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=c0de&state="+url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	m.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if id != "authprox" || secret != "s3cret" || r.PostFormValue("code") != "c0de" ||
+			pkceChallenge(r.PostFormValue("code_verifier")) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		claims := map[string]interface{}{
+			"iss":   idp.URL,
+			"aud":   "authprox",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": idp.nonce,
+		}
+		for k, v := range idp.claims {
+			claims[k] = v
+		}
+		token, err := signJWT(idp.key, jwtHeader{Kid: "k1", Typ: "JWT"}, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": token})
+	})
+	m.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(jsonWebKeySet{Keys: []jsonWebKey{rsaJWK(&key.PublicKey, "k1")}})
+	})
+	idp.Server = httptest.NewServer(m)
+	return idp
+}
+
+func TestOIDCLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	um, err := NewJsonUserManager(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, stateDB = um, db
+	selectSessionRegistry()
+	if throttle, err = NewThrottle(stateDB); err != nil {
+		t.Fatal(err)
+	}
+	store = sessions.NewCookieStore(securecookie.GenerateRandomKey(64))
+	pages, renderer = constPages, &TemplateRenderer{}
+
+	idp := newMockIdP(t)
+	defer idp.Close()
+	config.PublicURL = "https://auth.example.com"
+	config.OIDC = []OIDCConfig{{Name: "idp", Issuer: idp.URL, ClientID: "authprox", ClientSecret: "s3cret", AdminClaim: "groups", AdminValue: "admins"}}
+	selectOIDCProviders()
+	defer func() { config.PublicURL, config.OIDC, oidcProviders = "", nil, nil }()
+
+	router := mux.NewRouter()
+	router.Path("/proxy/login/oidc/{name}").HandlerFunc(getOIDCLogin)
+	router.Path("/proxy/login/oidc/{name}/callback").HandlerFunc(getOIDCCallback)
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	//signIn goes through the flow and returns the page of the callback and who is logged in afterwards.
+	//It starts with the session in cookies, if any.
+	var cookies []*http.Cookie
+	signIn := func(claims map[string]interface{}, tamper func(callback *url.URL)) (string, string) {
+		idp.claims = claims
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/proxy/login/oidc/idp", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		router.ServeHTTP(w, r)
+		res, err := noRedirect.Get(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		callback, err := url.Parse(res.Header.Get("Location"))
+		if err != nil || callback.Path != "/proxy/login/oidc/idp/callback" {
+			t.Fatalf("The IdP redirected to %v, %v", callback, err)
+		}
+		if tamper != nil {
+			tamper(callback)
+		}
+		r = httptest.NewRequest("GET", callback.RequestURI(), nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		r = httptest.NewRequest("GET", "/", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		session, _ := store.Get(r, "auth")
+		user, _ := session.Values["user"].(string)
+		return w.Body.String(), user
+	}
+
+	admin := map[string]interface{}{"sub": "1", "preferred_username": "alice", "email": "alice@example.com", "groups": []string{"staff", "admins"}}
+	if _, user := signIn(admin, nil); user != "alice" {
+		t.Fatalf("First sign-in logged in %q. Expected alice", user)
+	}
+	if alice, err := um.Get("alice"); err != nil || !alice.Admin || alice.Email != "alice@example.com" {
+		t.Errorf("Created user %+v, %v. Expected admin alice with the email", alice, err)
+	}
+
+	renamed := map[string]interface{}{"sub": "1", "preferred_username": "alice2", "groups": []string{"staff"}}
+	if _, user := signIn(renamed, nil); user != "alice" {
+		t.Errorf("Sign-in by the same sub logged in %q. Expected alice", user)
+	}
+	if alice, _ := um.Get("alice"); alice.Admin {
+		t.Error("alice is still admin after leaving the admins group")
+	}
+
+	impostor := map[string]interface{}{"sub": "2", "preferred_username": "alice"}
+	if body, user := signIn(impostor, nil); user != "" || !strings.Contains(body, "already exists") {
+		t.Errorf("Another sub claiming the name alice logged in %q", user)
+	}
+
+	bob := map[string]interface{}{"sub": "3", "preferred_username": "bob"}
+	if _, user := signIn(bob, func(u *url.URL) { u.RawQuery = "code=c0de&state=forged" }); user != "" {
+		t.Errorf("Callback with a forged state logged in %q", user)
+	}
+	replayed := map[string]interface{}{"sub": "3", "preferred_username": "bob", "nonce": "an old one"}
+	if _, user := signIn(replayed, nil); user != "" {
+		t.Errorf("ID token with the wrong nonce logged in %q", user)
+	}
+	if _, err := um.Get("bob"); err != ErrUnknownUser {
+		t.Errorf("bob was created by a failed sign-in: %v", err)
+	}
+
+	defer func() { registrationMode = RegistrationOpen }()
+	carol := map[string]interface{}{"sub": "4", "preferred_username": "carol"}
+	registrationMode = RegistrationClosed
+	if body, user := signIn(carol, nil); user != "" || !strings.Contains(body, "No account can be made") {
+		t.Errorf("Sign-in with registration closed logged in %q", user)
+	}
+	registrationMode = RegistrationInvite
+	if err := ensureBuckets(db, BoltBucketInvites); err != nil {
+		t.Fatal(err)
+	}
+	if _, user := signIn(carol, nil); user != "" {
+		t.Errorf("Sign-in without an invite logged in %q", user)
+	}
+	invite, err := newInvite("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if !inviteRequired(w, httptest.NewRequest("GET", "/proxy/register?invite="+invite.Code, nil)) {
+		t.Fatal("Invite not accepted")
+	}
+	cookies = w.Result().Cookies()
+	if _, user := signIn(carol, nil); user != "carol" {
+		t.Errorf("Sign-in with an invite logged in %q. Expected carol", user)
+	}
+	if _, err := checkInvite(invite.Code); err != ErrInvalidInvite {
+		t.Errorf("The invite was not used up: %v", err)
+	}
+}
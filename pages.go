@@ -54,6 +54,7 @@ const (
 	LogoutPage              = "logout"
 	AdminPage               = "admin"
 	Error404Page            = "404"
+	TOTPPage                = "login_totp"
 )
 
 type Page struct {
@@ -61,6 +62,7 @@ type Page struct {
 	Title    template.HTML
 	Head     template.HTML
 	Content  template.HTML
+	Message  string //Feedback to the user, like why a form was rejected. Set by the handler, not the page source.
 }
 
 type FSPages struct {
@@ -157,6 +159,7 @@ const pageTemplate = `<html>
 	<div id="card">
 		<h3>AuthProx</h3>
 		<h1>{{.Title}}</h1>
+		{{with .Message}}<p class="message">{{.}}</p>{{end}}
 		{{.Content}}
 	</div>
 </body>
@@ -189,6 +192,7 @@ func init() {
 		Content: `
 	<form method="POST" action="/proxy/register">
 		<input type="text" name="username" placeholder="Username" required>
+		<input type="email" name="email" placeholder="Email">
 		<input type="password" name="password" placeholder="Password" required>
 		<div class="g-recaptcha" data-sitekey="6LcMDgoTAAAAALJTFmdzPieTUheKAdghSG9q1_D-"></div>
 		<input type="submit" value="Register">
@@ -204,6 +208,26 @@ func init() {
 	</p>`,
 	}
 
+	constPages[TOTPPage] = Page{
+		Title: "Two-Factor Authentication",
+		Content: `
+	<p>
+		Enter the 6-digit code from your authenticator app, or one of your recovery codes.
+	</p>
+	<form method="POST" action="/proxy/login/totp">
+		<input type="text" name="code" placeholder="123456" autocomplete="one-time-code" autofocus required>
+		<input type="submit" value="Verify">
+	</form>`,
+	}
+
+	constPages[AdminPage] = Page{
+		Title: "Administration",
+		Content: `
+	<p>
+		Find users and manage their accounts.
+	</p>`,
+	}
+
 	constPages[LogoutPage] = Page{
 		Title: "Logout Successfull",
 		Content: `
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/securecookie"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+	"strings"
+)
+
+//A PasswordHasher turns passwords into self-describing encoded hashes and verifies passwords against them.
+//The encoded form carries the algorithm, its parameters and the salt, so it can be stored as-is in User.Passhash.
+type PasswordHasher interface {
+	//Name is the algorithm name used in the config file.
+	Name() string
+	Hash(password string) ([]byte, error)
+	Verify(password string, encoded []byte) (bool, error)
+	//Recognizes reports whether the encoded hash was produced by this algorithm.
+	Recognizes(encoded []byte) bool
+	//NeedsRehash reports whether the encoded hash uses weaker parameters than the hasher is configured with.
+	NeedsRehash(encoded []byte) bool
+	//Check decodes the hash without verifying a password, and fails if it is malformed or its parameters are out of bounds.
+	Check(encoded []byte) error
+}
+
+var (
+	ErrUnknownHashAlgorithm = errors.New("Unknown password hash algorithm")
+	ErrMalformedHash        = errors.New("Malformed password hash")
+)
+
+//Bounds on the parameters of stored hashes, so a crafted hash can not make verifying it take all memory or CPU.
+//The totals allow four times the work of the defaults in each dimension, and some more for the argon2id passes.
+const (
+	maxArgon2Memory  = 256 * 1024 //KiB
+	maxArgon2Time    = 10
+	maxArgon2Threads = 16
+	maxArgon2Cost    = 1024 * 1024 //KiB times passes
+	maxScryptP       = 16
+	maxScryptMemory  = 256 << 20 //Bytes, 128*N*r
+	maxScryptCost    = 1 << 30   //128*N*r*p, the work done in bytes mixed
+)
+
+var (
+	passwordHashers = []PasswordHasher{
+		Argon2idHasher{Time: 1, Memory: 64 * 1024, Threads: 4, KeyLen: 32},
+		BcryptHasher{Cost: bcrypt.DefaultCost},
+		ScryptHasher{LogN: 15, R: 8, P: 1, KeyLen: 32},
+	}
+	//The hasher used for all new passwords. Set from the config by selectPasswordHasher.
+	passwordHasher = passwordHashers[0]
+)
+
+func selectPasswordHasher() {
+	if config.Passwords.Algorithm == "" {
+		return //Keep the default
+	}
+	h, err := findPasswordHasher(config.Passwords.Algorithm)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"algorithm": config.Passwords.Algorithm,
+		}).Fatal("Unknown password hashing algorithm.")
+	}
+	passwordHasher = h
+}
+
+func findPasswordHasher(name string) (PasswordHasher, error) {
+	for _, h := range passwordHashers {
+		if h.Name() == name {
+			return h, nil
+		}
+	}
+	return nil, ErrUnknownHashAlgorithm
+}
+
+//HashPassword hashes a password with the configured algorithm.
+func HashPassword(password string) (Key, error) {
+	return passwordHasher.Hash(password)
+}
+
+//VerifyPassword checks a password against the stored hash of a user.
+//If the password is correct but the hash is a legacy SHA-512 hash, or was made with another algorithm
+//or weaker parameters than currently configured, rehash is true and the caller should store a new hash.
+func VerifyPassword(user User, password string) (ok, rehash bool) {
+	if isLegacyHash(user.Passhash) {
+		ok = subtle.ConstantTimeCompare(HashAndSalt(password, user.Salt), user.Passhash) == 1
+		return ok, ok
+	}
+	for _, h := range passwordHashers {
+		if !h.Recognizes(user.Passhash) {
+			continue
+		}
+		var err error
+		ok, err = h.Verify(password, user.Passhash)
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"user":      user.Name,
+				"algorithm": h.Name(),
+				"error":     err,
+			}).Error("Unable to verify password hash.")
+			return false, false
+		}
+		rehash = ok && (h.Name() != passwordHasher.Name() || h.NeedsRehash(user.Passhash))
+		return
+	}
+	logger.WithField("user", user.Name).Error("Password hash of unknown format.")
+	return false, false
+}
+
+//SetPassword replaces the stored password hash of the user with one made by the configured algorithm.
+//The separate salt is only used by legacy hashes and is cleared.
+func (u *User) SetPassword(password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.Passhash, u.Salt = hash, nil
+	return nil
+}
+
+//Legacy hashes are raw SHA-512 sums made by HashAndSalt. All encoded hashes start with '$'.
+func isLegacyHash(hash []byte) bool {
+	return len(hash) == 0 || hash[0] != '$'
+}
+
+//CheckHash reports whether a stored hash can be verified by one of the hashers. Legacy hashes are not checked.
+func CheckHash(hash []byte) error {
+	if isLegacyHash(hash) {
+		return nil
+	}
+	for _, h := range passwordHashers {
+		if h.Recognizes(hash) {
+			return h.Check(hash)
+		}
+	}
+	return ErrUnknownHashAlgorithm
+}
+
+//HashAlgorithm names the algorithm an encoded hash was made with.
+func HashAlgorithm(hash []byte) string {
+	if isLegacyHash(hash) {
+		return "sha512"
+	}
+	for _, h := range passwordHashers {
+		if h.Recognizes(hash) {
+			return h.Name()
+		}
+	}
+	return "unknown"
+}
+
+var b64 = base64.RawStdEncoding
+
+//Argon2idHasher hashes passwords with argon2id.
+//Hashes are encoded in the PHC string format: $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32 //KiB
+	Threads uint8
+	KeyLen  uint32
+}
+
+func (Argon2idHasher) Name() string { return "argon2id" }
+
+func (a Argon2idHasher) Hash(password string) ([]byte, error) {
+	salt := securecookie.GenerateRandomKey(16)
+	if salt == nil {
+		return nil, errors.New("Unable to generate salt")
+	}
+	hash := argon2.IDKey([]byte(password), salt, a.Time, a.Memory, a.Threads, a.KeyLen)
+	return []byte(fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Time, a.Threads, b64.EncodeToString(salt), b64.EncodeToString(hash))), nil
+}
+
+func (a Argon2idHasher) Verify(password string, encoded []byte) (bool, error) {
+	params, salt, hash, err := a.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(hash)))
+	return subtle.ConstantTimeCompare(hash, other) == 1, nil
+}
+
+func (Argon2idHasher) Recognizes(encoded []byte) bool {
+	return bytes.HasPrefix(encoded, []byte("$argon2id$"))
+}
+
+func (a Argon2idHasher) NeedsRehash(encoded []byte) bool {
+	params, _, _, err := a.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return params.Time < a.Time || params.Memory < a.Memory || params.Threads < a.Threads
+}
+
+func (a Argon2idHasher) Check(encoded []byte) error {
+	_, _, _, err := a.decode(encoded)
+	return err
+}
+
+func (Argon2idHasher) decode(encoded []byte) (params Argon2idHasher, salt, hash []byte, err error) {
+	parts := strings.Split(string(encoded), "$")
+	if len(parts) != 6 {
+		return params, nil, nil, ErrMalformedHash
+	}
+	var version int
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if params.Time < 1 || params.Time > maxArgon2Time || params.Threads < 1 || params.Threads > maxArgon2Threads ||
+		params.Memory < 8*uint32(params.Threads) || params.Memory > maxArgon2Memory || params.Memory*params.Time > maxArgon2Cost {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if salt, err = b64.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if hash, err = b64.DecodeString(parts[5]); err != nil || len(hash) == 0 {
+		return params, nil, nil, ErrMalformedHash
+	}
+	return
+}
+
+//BcryptHasher hashes passwords with bcrypt, which already has a self-describing format.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (BcryptHasher) Name() string { return "bcrypt" }
+
+func (b BcryptHasher) Hash(password string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+}
+
+func (BcryptHasher) Verify(password string, encoded []byte) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(encoded, []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (BcryptHasher) Recognizes(encoded []byte) bool {
+	return bytes.HasPrefix(encoded, []byte("$2a$")) ||
+		bytes.HasPrefix(encoded, []byte("$2b$")) ||
+		bytes.HasPrefix(encoded, []byte("$2y$"))
+}
+
+func (b BcryptHasher) NeedsRehash(encoded []byte) bool {
+	cost, err := bcrypt.Cost(encoded)
+	return err != nil || cost < b.Cost
+}
+
+//Check only gets as far as the cost, which bcrypt keeps within its own bounds. The rest has a fixed length.
+func (BcryptHasher) Check(encoded []byte) error {
+	if _, err := bcrypt.Cost(encoded); err != nil || len(encoded) != 60 {
+		return ErrMalformedHash
+	}
+	return nil
+}
+
+//ScryptHasher hashes passwords with scrypt.
+//Hashes are encoded as $scrypt$ln=15,r=8,p=1$<salt>$<hash>
+type ScryptHasher struct {
+	LogN   uint8
+	R, P   int
+	KeyLen int
+}
+
+func (ScryptHasher) Name() string { return "scrypt" }
+
+func (s ScryptHasher) Hash(password string) ([]byte, error) {
+	salt := securecookie.GenerateRandomKey(16)
+	if salt == nil {
+		return nil, errors.New("Unable to generate salt")
+	}
+	hash, err := scrypt.Key([]byte(password), salt, 1<<s.LogN, s.R, s.P, s.KeyLen)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		s.LogN, s.R, s.P, b64.EncodeToString(salt), b64.EncodeToString(hash))), nil
+}
+
+func (s ScryptHasher) Verify(password string, encoded []byte) (bool, error) {
+	params, salt, hash, err := s.decode(encoded)
+	if err != nil {
+		return false, err
+	}
+	other, err := scrypt.Key([]byte(password), salt, 1<<params.LogN, params.R, params.P, len(hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(hash, other) == 1, nil
+}
+
+func (ScryptHasher) Recognizes(encoded []byte) bool {
+	return bytes.HasPrefix(encoded, []byte("$scrypt$"))
+}
+
+func (s ScryptHasher) NeedsRehash(encoded []byte) bool {
+	params, _, _, err := s.decode(encoded)
+	if err != nil {
+		return true
+	}
+	return params.LogN < s.LogN || params.R < s.R || params.P < s.P
+}
+
+func (s ScryptHasher) Check(encoded []byte) error {
+	_, _, _, err := s.decode(encoded)
+	return err
+}
+
+func (ScryptHasher) decode(encoded []byte) (params ScryptHasher, salt, hash []byte, err error) {
+	parts := strings.Split(string(encoded), "$")
+	if len(parts) != 5 {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if _, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if params.LogN == 0 || params.LogN > 30 || params.R < 1 || params.P < 1 ||
+		params.P > maxScryptP || 128*params.R > maxScryptMemory>>params.LogN || 128*params.R > maxScryptCost>>params.LogN/params.P {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if salt, err = b64.DecodeString(parts[3]); err != nil {
+		return params, nil, nil, ErrMalformedHash
+	}
+	if hash, err = b64.DecodeString(parts[4]); err != nil || len(hash) == 0 {
+		return params, nil, nil, ErrMalformedHash
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordHashers(t *testing.T) {
+	for _, h := range passwordHashers {
+		hash, err := h.Hash("hunter2")
+		if err != nil {
+			t.Fatal(h.Name(), err)
+		}
+		if !h.Recognizes(hash) {
+			t.Errorf("%s does not recognize its own hash %q", h.Name(), hash)
+		}
+		if ok, err := h.Verify("hunter2", hash); !ok || err != nil {
+			t.Errorf("%s rejected the correct password: %v", h.Name(), err)
+		}
+		if ok, _ := h.Verify("hunter3", hash); ok {
+			t.Errorf("%s accepted a wrong password", h.Name())
+		}
+		if h.NeedsRehash(hash) {
+			t.Errorf("%s wants to rehash a hash with current parameters", h.Name())
+		}
+		if HashAlgorithm(hash) != h.Name() {
+			t.Errorf("HashAlgorithm(%q) = %s, expected %s", hash, HashAlgorithm(hash), h.Name())
+		}
+		if err := CheckHash(hash); err != nil {
+			t.Errorf("%s rejected its own hash: %v", h.Name(), err)
+		}
+	}
+}
+
+func TestCheckHash(t *testing.T) {
+	for _, hash := range []string{
+		"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$argon2id$v=19$m=65536,t=1,p=0$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$argon2id$v=19$m=4294967295,t=1,p=4$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$argon2id$v=19$m=65536,t=1,p=4$c2FsdHNhbHQ$",
+		"$scrypt$ln=15,r=0,p=1$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$scrypt$ln=30,r=8,p=1$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$scrypt$ln=1,r=1,p=1000000000$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$scrypt$ln=17,r=8,p=16$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$argon2id$v=19$m=262144,t=10,p=4$c2FsdHNhbHQ$aGFzaGhhc2g",
+		"$2a$10$tooshort",
+		"$md5$whatever",
+	} {
+		if err := CheckHash([]byte(hash)); err == nil {
+			t.Errorf("%s was accepted", hash)
+		}
+		if ok, _ := VerifyPassword(User{Name: "crafted", Passhash: Key(hash)}, "hunter2"); ok {
+			t.Errorf("%s verified a password", hash)
+		}
+	}
+}
+
+func TestVerifyPassword_Legacy(t *testing.T) {
+	user := User{Name: "legacy", Salt: Key("saltsaltsaltsaltsaltsaltsaltsalt")}
+	user.Passhash = HashAndSalt("hunter2", user.Salt)
+
+	if ok, rehash := VerifyPassword(user, "hunter2"); !ok || !rehash {
+		t.Errorf("VerifyPassword = %v, %v. Expected true, true", ok, rehash)
+	}
+	if ok, rehash := VerifyPassword(user, "hunter3"); ok || rehash {
+		t.Errorf("VerifyPassword = %v, %v. Expected false, false", ok, rehash)
+	}
+}
+
+func TestBoltUserManager_RehashOnLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bum, err := NewBoltUserManager(filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bum.Close()
+
+	legacy := User{Name: "legacy", Salt: Key("saltsaltsaltsaltsaltsaltsaltsalt")}
+	legacy.Passhash = HashAndSalt("hunter2", legacy.Salt)
+	bum.DB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketUsers).Put([]byte(legacy.Name), encodeUserRecord(legacy))
+	})
+
+	if !bum.Authenticate("legacy", "hunter2") {
+		t.Fatal("Legacy user could not log in")
+	}
+	user, err := bum.Get("legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if HashAlgorithm(user.Passhash) != passwordHasher.Name() {
+		t.Errorf("Hash was not upgraded, still %s", HashAlgorithm(user.Passhash))
+	}
+	if len(user.Salt) != 0 {
+		t.Error("Legacy salt was not cleared")
+	}
+	if !bum.Authenticate("legacy", "hunter2") {
+		t.Error("User could not log in after upgrade")
+	}
+	if bum.Authenticate("legacy", "hunter3") {
+		t.Error("Wrong password accepted after upgrade")
+	}
+
+	//A rehash that lost the race against a password change does not bring the old password back.
+	bum.rehash("legacy", "hunter3", legacy.Passhash)
+	if bum.Authenticate("legacy", "hunter3") {
+		t.Error("Rehash overwrote a hash it had not checked")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+)
+
+//A PasswordPolicy decides which passwords users may choose when registering or changing their password.
+type PasswordPolicy struct {
+	MinLength        int
+	CharacterClasses int  //How many of lowercase, uppercase, digits and symbols must be present
+	AllowUsername    bool //Allow passwords containing the username
+	MinStrength      int  //Lowest PasswordStrength accepted
+	Breached         *BreachedList
+}
+
+//A PolicyViolation lists why a password was rejected, worded for the user.
+type PolicyViolation []string
+
+func (pv PolicyViolation) Error() string {
+	return strings.Join(pv, " ")
+}
+
+const defaultPasswordMinLength = 8
+
+var passwordPolicy = &PasswordPolicy{MinLength: defaultPasswordMinLength}
+
+func selectPasswordPolicy() {
+	c := config.Passwords
+	passwordPolicy = &PasswordPolicy{
+		MinLength:        c.MinLength,
+		CharacterClasses: c.CharacterClasses,
+		AllowUsername:    c.AllowUsername,
+		MinStrength:      c.MinStrength,
+	}
+	if passwordPolicy.MinLength <= 0 {
+		passwordPolicy.MinLength = defaultPasswordMinLength
+	}
+	if c.BreachedList != "" {
+		if _, err := os.Stat(c.BreachedList); err != nil {
+			logger.WithFields(logrus.Fields{"err": err, "file": c.BreachedList}).Fatal("Unable to open breached password list.")
+		}
+		passwordPolicy.Breached = &BreachedList{File: c.BreachedList}
+	}
+}
+
+//Check returns a PolicyViolation if the password may not be used for the user, nil otherwise.
+func (p *PasswordPolicy) Check(username, password string) error {
+	var pv PolicyViolation
+	if n := len([]rune(password)); n < p.MinLength {
+		pv = append(pv, fmt.Sprintf("The password must be at least %d characters long.", p.MinLength))
+	}
+	if p.CharacterClasses > 0 && characterClasses(password) < p.CharacterClasses {
+		pv = append(pv, fmt.Sprintf("The password must contain at least %d of lowercase letters, uppercase letters, digits and symbols.", p.CharacterClasses))
+	}
+	if !p.AllowUsername && username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		pv = append(pv, "The password may not contain the username.")
+	}
+	if p.MinStrength > 0 && PasswordStrength(password) < p.MinStrength {
+		pv = append(pv, "The password is too easy to guess. Try a longer one, or a few unrelated words.")
+	}
+	if p.Breached != nil {
+		breached, err := p.Breached.Contains(password)
+		if err != nil {
+			logger.WithFields(logrus.Fields{"err": err, "file": p.Breached.File}).Error("Searching breached password list")
+		}
+		if breached {
+			pv = append(pv, "The password has appeared in a data breach. Please choose another one.")
+		}
+	}
+	if len(pv) > 0 {
+		return pv
+	}
+	return nil
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
+
+//A BreachedList is a file of SHA-1 hashes of passwords known from data breaches, one hex hash per line,
+//sorted by hash. Anything after the hash on a line, like the ":count" in the Have I Been Pwned downloads, is ignored.
+//The file is binary searched on disk, so even the full list of several gigabytes can be used.
+type BreachedList struct {
+	File string
+}
+
+func (bl *BreachedList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	f, err := os.Open(bl.File)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	finfo, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	//The line we look for, if it is there, starts somewhere in [lo, hi).
+	lo, hi := int64(0), finfo.Size()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start, line, err := lineAt(f, mid, finfo.Size())
+		if err != nil {
+			return false, err
+		}
+		if start >= hi {
+			hi = mid
+			continue
+		}
+		hash := strings.ToUpper(strings.TrimSpace(strings.SplitN(line, ":", 2)[0]))
+		switch {
+		case hash == target:
+			return true, nil
+		case hash < target:
+			lo = start + int64(len(line))
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+//lineAt returns the first line that starts at or after offset, including its newline.
+//Start is the size of the file if there is no such line.
+func lineAt(f io.ReaderAt, offset, size int64) (start int64, line string, err error) {
+	start = offset
+	if offset > 0 {
+		start = offset - 1 //Offset starts a line if the byte before it is a newline
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, start, size-start))
+	if offset > 0 {
+		skipped, err := r.ReadString('\n')
+		if err == io.EOF {
+			return size, "", nil
+		} else if err != nil {
+			return 0, "", err
+		}
+		start += int64(len(skipped))
+	}
+	line, err = r.ReadString('\n')
+	if err == io.EOF {
+		err = nil
+	}
+	if line == "" {
+		return size, "", err
+	}
+	return start, line, err
+}
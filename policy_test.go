@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestPasswordStrength(t *testing.T) {
+	for _, c := range []struct {
+		password string
+		max      int //Highest acceptable score
+		min      int //Lowest acceptable score
+	}{
+		{"", 0, 0},
+		{"password", 0, 0},
+		{"P4ssw0rd", 1, 0},
+		{"qwertyuiop", 1, 0},
+		{"abcdefgh", 0, 0},
+		{"aaaaaaaaaaaa", 0, 0},
+		{"dragon1987", 2, 0},
+		{"kx7#Tq9!mZ", 4, 3},
+		{"correct horse battery staple", 4, 4},
+	} {
+		if s := PasswordStrength(c.password); s < c.min || s > c.max {
+			t.Errorf("Strength of %q is %d, expected %d to %d", c.password, s, c.min, c.max)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	p := &PasswordPolicy{MinLength: 8, CharacterClasses: 3, MinStrength: 3}
+	for _, c := range []struct {
+		username, password string
+		violations         int
+	}{
+		{"alice", "", 3},
+		{"alice", "Alice#2016!x", 1},
+		{"alice", "Password1", 1},
+		{"alice", "kx7#Tq9!mZ", 0},
+	} {
+		err := p.Check(c.username, c.password)
+		if pv, _ := err.(PolicyViolation); len(pv) != c.violations {
+			t.Errorf("Check(%q, %q) = %v, expected %d violations", c.username, c.password, err, c.violations)
+		}
+	}
+}
+
+func TestBreachedList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var lines []string
+	for i := 0; i < 500; i++ {
+		sum := sha1.Sum([]byte(fmt.Sprint("breached", i)))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1))
+	}
+	sort.Strings(lines)
+	file := filepath.Join(dir, "pwned.txt")
+	if err := ioutil.WriteFile(file, []byte(strings.Join(lines, "\r\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bl := &BreachedList{File: file}
+	for i := 0; i < 500; i++ {
+		if ok, err := bl.Contains(fmt.Sprint("breached", i)); !ok || err != nil {
+			t.Fatalf("breached%d not found: %v", i, err)
+		}
+	}
+	for _, pw := range []string{"", "breached500", "not breached"} {
+		if ok, err := bl.Contains(pw); ok || err != nil {
+			t.Errorf("%q found in list: %v", pw, err)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//authprox as an OpenID Connect provider, so apps behind or beside it can log users in with their authprox accounts.
+//Only the authorization code flow is offered. The clients are configured by the admin, so users are not asked for consent.
+//The issuer is <PublicURL>/proxy, which keeps the discovery document and the endpoints out of the way of the proxied app.
+
+//An IdentityProvider signs ID and access tokens for the configured clients.
+type IdentityProvider struct {
+	Issuer        string
+	Key           *rsa.PrivateKey
+	KeyID         string
+	Clients       []ClientConfig
+	TokenLifetime time.Duration
+}
+
+//An authCode is an authorization code waiting to be exchanged for tokens.
+type authCode struct {
+	Client      string
+	User        string
+	RedirectURI string
+	Scope       string
+	Nonce       string
+	Challenge   string //S256 PKCE challenge. Empty if the client did not send one
+	Expires     time.Time
+}
+
+const authCodeLifetime = time.Minute
+
+var (
+	identityProvider *IdentityProvider
+
+	BoltBucketAuthCodes = []byte("oidc_codes") //SHA-256 of the code to authCode
+)
+
+var (
+	ErrSigningKey   = errors.New("Keys.SigningKey must hold an RSA key for the OpenID Connect provider. authprox -setup makes one")
+	ErrInvalidGrant = errors.New("The authorization code is invalid, expired or already used")
+)
+
+func selectIdentityProvider() {
+	c := config.Provider
+	if len(c.Clients) == 0 {
+		return
+	}
+	if config.PublicURL == "" {
+		logger.Fatal("PublicURL must be set for the OpenID Connect provider.")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(config.Keys.SigningKey)
+	if err != nil {
+		logger.WithField("err", err).Fatal(ErrSigningKey.Error())
+	}
+	idp := &IdentityProvider{
+		Issuer:        strings.TrimSuffix(config.PublicURL, "/") + "/proxy",
+		Key:           key,
+		KeyID:         signingKeyID(&key.PublicKey),
+		Clients:       c.Clients,
+		TokenLifetime: time.Hour,
+	}
+	if c.TokenLifetime > 0 {
+		idp.TokenLifetime = time.Duration(c.TokenLifetime)
+	}
+	if err := ensureBuckets(stateDB, BoltBucketAuthCodes); err != nil {
+		logger.WithField("err", err).Fatal("Unable to create authorization code bucket.")
+	}
+	identityProvider = idp
+	logger.WithFields(logrus.Fields{"issuer": idp.Issuer, "clients": len(idp.Clients)}).Info("OpenID Connect provider enabled")
+}
+
+//signingKeyID names a key by its modulus, so a new key gets a new ID and clients fetch the key set again.
+func signingKeyID(key *rsa.PublicKey) string {
+	sum := sha256.Sum256(key.N.Bytes())
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+func (idp *IdentityProvider) client(id string) (ClientConfig, bool) {
+	for _, c := range idp.Clients {
+		if c.ID == id {
+			return c, true
+		}
+	}
+	return ClientConfig{}, false
+}
+
+//allowsRedirect reports whether uri is one of the redirect URIs of the client. They must match exactly.
+func (c ClientConfig) allowsRedirect(uri string) bool {
+	for _, u := range c.RedirectURIs {
+		if u == uri {
+			return true
+		}
+	}
+	return false
+}
+
+func hasScope(scope, want string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == want {
+			return true
+		}
+	}
+	return false
+}
+
+func authCodeKey(code string) []byte {
+	sum := sha256.Sum256([]byte(code))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+func newAuthCode(c authCode) (string, error) {
+	code := randomToken()
+	c.Expires = time.Now().Add(authCodeLifetime)
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return code, stateDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketAuthCodes).Put(authCodeKey(code), data)
+	})
+}
+
+//takeAuthCode returns the authorization code and forgets it, so it can only be exchanged once.
+//Codes that were never exchanged are dropped on the way.
+func takeAuthCode(code string) (c authCode, err error) {
+	err = stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketAuthCodes)
+		data := b.Get(authCodeKey(code))
+		if data == nil || json.Unmarshal(data, &c) != nil || time.Now().After(c.Expires) {
+			c = authCode{}
+		}
+		var stale [][]byte
+		b.ForEach(func(k, v []byte) error {
+			var other authCode
+			if json.Unmarshal(v, &other) != nil || time.Now().After(other.Expires) {
+				stale = append(stale, k)
+			}
+			return nil
+		})
+		for _, k := range append(stale, authCodeKey(code)) {
+			b.Delete(k)
+		}
+		return nil
+	})
+	if err == nil && c.Client == "" {
+		err = ErrInvalidGrant
+	}
+	return
+}
+
+//userClaims tells about the user as far as the scope allows.
+func userClaims(user User, scope string) map[string]interface{} {
+	claims := map[string]interface{}{"sub": user.Name}
+	if hasScope(scope, "profile") {
+		claims["preferred_username"] = user.Name
+	}
+	if hasScope(scope, "email") && user.Email != "" {
+		claims["email"] = user.Email
+		claims["email_verified"] = !user.Unverified
+	}
+	return claims
+}
+
+//tokens issues the ID token and the access token for the userinfo endpoint.
+func (idp *IdentityProvider) tokens(user User, c authCode) (idToken, accessToken string, err error) {
+	now := time.Now()
+	claims := userClaims(user, c.Scope)
+	claims["iss"] = idp.Issuer
+	claims["aud"] = c.Client
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(idp.TokenLifetime).Unix()
+	if c.Nonce != "" {
+		claims["nonce"] = c.Nonce
+	}
+	if idToken, err = signJWT(idp.Key, jwtHeader{Kid: idp.KeyID, Typ: "JWT"}, claims); err != nil {
+		return
+	}
+	accessToken, err = signJWT(idp.Key, jwtHeader{Kid: idp.KeyID, Typ: "at+jwt"}, map[string]interface{}{
+		"iss":       idp.Issuer,
+		"sub":       user.Name,
+		"aud":       idp.Issuer,
+		"client_id": c.Client,
+		"scope":     c.Scope,
+		"iat":       now.Unix(),
+		"exp":       now.Add(idp.TokenLifetime).Unix(),
+	})
+	return
+}
+
+//accessTokenUser checks an access token handed out by the token endpoint and returns its active user and scope.
+func (idp *IdentityProvider) accessTokenUser(token string) (User, string, error) {
+	t, err := parseJWT(token)
+	if err != nil {
+		return User{}, "", err
+	}
+	if err := t.verify(&idp.Key.PublicKey); err != nil {
+		return User{}, "", err
+	}
+	exp, _ := t.Claims["exp"].(float64)
+	if t.Header.Typ != "at+jwt" || t.claimString("iss") != idp.Issuer || t.claimString("aud") != idp.Issuer ||
+		time.Now().After(time.Unix(int64(exp), 0)) {
+		return User{}, "", ErrInvalidToken
+	}
+	user, err := users.Get(t.claimString("sub"))
+	if err != nil || !user.Active() {
+		return User{}, "", ErrInvalidToken
+	}
+	return user, t.claimString("scope"), nil
+}
+
+func getOIDCConfiguration(w http.ResponseWriter, r *http.Request) {
+	idp := identityProvider
+	writeJSON(w, map[string]interface{}{
+		"issuer":                                idp.Issuer,
+		"authorization_endpoint":                idp.Issuer + "/oidc/authorize",
+		"token_endpoint":                        idp.Issuer + "/oidc/token",
+		"userinfo_endpoint":                     idp.Issuer + "/oidc/userinfo",
+		"jwks_uri":                              idp.Issuer + "/oidc/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+		"claims_supported":                      []string{"sub", "preferred_username", "email", "email_verified"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+	})
+}
+
+func getJWKS(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, jsonWebKeySet{Keys: []jsonWebKey{rsaJWK(&identityProvider.Key.PublicKey, identityProvider.KeyID)}})
+}
+
+//getAuthorize hands a logged in user back to the client with an authorization code. Others log in first and return here.
+func getAuthorize(w http.ResponseWriter, r *http.Request) {
+	idp := identityProvider
+	q := r.URL.Query()
+	client, ok := idp.client(q.Get("client_id"))
+	redirectURI := q.Get("redirect_uri")
+	if !ok || !client.allowsRedirect(redirectURI) {
+		//Without a known redirect URI the error can only be shown here.
+		w.WriteHeader(http.StatusBadRequest)
+		renderer.Render(w, Page{Title: "Unknown Application", Content: "The application that sent you here is not known to authprox."})
+		return
+	}
+	back := func(params url.Values) {
+		if state := q.Get("state"); state != "" {
+			params.Set("state", state)
+		}
+		sep := "?"
+		if strings.Contains(redirectURI, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, redirectURI+sep+params.Encode(), http.StatusFound)
+	}
+	fail := func(code, description string) {
+		back(url.Values{"error": {code}, "error_description": {description}})
+	}
+	scope, challenge := q.Get("scope"), q.Get("code_challenge")
+	switch {
+	case q.Get("response_type") != "code":
+		fail("unsupported_response_type", "Only the authorization code flow is supported")
+		return
+	case !hasScope(scope, "openid"):
+		fail("invalid_scope", "The openid scope is required")
+		return
+	case challenge != "" && q.Get("code_challenge_method") != "S256":
+		fail("invalid_request", "Only the S256 code challenge method is supported")
+		return
+	case challenge == "" && client.Secret == "":
+		fail("invalid_request", "Clients without a secret must use PKCE")
+		return
+	}
+
+	user, ok := loggedInUser(r)
+	if !ok {
+		if q.Get("prompt") == "none" {
+			fail("login_required", "The user is not logged in")
+			return
+		}
+		session, _ := store.Get(r, "auth")
+		session.Values["return_to"] = r.URL.RequestURI()
+		session.Save(r, w)
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	code, err := newAuthCode(authCode{
+		Client:      client.ID,
+		User:        user.Name,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		Nonce:       q.Get("nonce"),
+		Challenge:   challenge,
+	})
+	if err != nil {
+		logger.WithFields(logrus.Fields{"client": client.ID, "user": user.Name, "err": err}).Error("Storing authorization code")
+		fail("server_error", "The authorization could not be stored")
+		return
+	}
+	logger.WithFields(logrus.Fields{"client": client.ID, "user": user.Name}).Info("Authorized OpenID Connect client")
+	back(url.Values{"code": {code}})
+}
+
+//tokenError answers the token endpoint with an error as RFC 6749 describes.
+func tokenError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+//postToken exchanges an authorization code for tokens.
+func postToken(w http.ResponseWriter, r *http.Request) {
+	idp := identityProvider
+	w.Header().Set("Cache-Control", "no-store")
+	r.ParseForm()
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	client, ok := idp.client(id)
+	if !ok || client.Secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(client.Secret)) != 1 {
+		logger.WithFields(logrus.Fields{"client": id, "address": r.RemoteAddr}).Info("OpenID Connect client failed to authenticate.")
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="authprox"`)
+		}
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "Unknown client or wrong secret")
+		return
+	}
+	if r.PostFormValue("grant_type") != "authorization_code" {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "Only authorization codes are exchanged")
+		return
+	}
+	c, err := takeAuthCode(r.PostFormValue("code"))
+	if err != nil || c.Client != client.ID || c.RedirectURI != r.PostFormValue("redirect_uri") ||
+		c.Challenge != "" && subtle.ConstantTimeCompare([]byte(pkceChallenge(r.PostFormValue("code_verifier"))), []byte(c.Challenge)) != 1 {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", ErrInvalidGrant.Error())
+		return
+	}
+	user, err := users.Get(c.User)
+	if err != nil || !user.Active() { //The account may have been disabled since the code was handed out
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "The user may no longer log in")
+		return
+	}
+	idToken, accessToken, err := idp.tokens(user, c)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"client": client.ID, "user": user.Name, "err": err}).Error("Signing tokens")
+		tokenError(w, http.StatusInternalServerError, "server_error", "The tokens could not be signed")
+		return
+	}
+	audit(r, EventLogin, user.Name, "", "Logged in to "+client.title()+" with OpenID Connect")
+	writeJSON(w, map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int(idp.TokenLifetime.Seconds()),
+		"id_token":     idToken,
+		"scope":        c.Scope,
+	})
+}
+
+//getUserinfo tells about the user of an access token.
+func getUserinfo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	user, scope, err := identityProvider.accessTokenUser(token)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, ErrInvalidToken.Error(), http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, userClaims(user, scope))
+}
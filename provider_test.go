@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIdentityProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	um, err := NewJsonUserManager(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, stateDB = um, db
+	selectSessionRegistry()
+	if throttle, err = NewThrottle(stateDB); err != nil {
+		t.Fatal(err)
+	}
+	pages, renderer = constPages, &TemplateRenderer{}
+	um.Register(User{Name: "alice", Email: "alice@example.com"}, "hunter2")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := config.Keys
+	config.Keys.AuthenticationKey, config.Keys.EncryptionKey = securecookie.GenerateRandomKey(64), securecookie.GenerateRandomKey(32)
+	config.Keys.SigningKey = x509.MarshalPKCS1PrivateKey(key)
+	config.PublicURL = "https://auth.example.com"
+	config.Provider.Clients = []ClientConfig{
+		{ID: "wiki", Secret: "s3cret", RedirectURIs: []string{"https://wiki.example.com/callback"}},
+		{ID: "spa", RedirectURIs: []string{"https://spa.example.com/"}},
+	}
+	selectIdentityProvider()
+	defer func() {
+		config.Keys, config.PublicURL, config.Provider.Clients, identityProvider = keys, "", nil, nil
+	}()
+	handler := setupHandlers()
+
+	do := func(r *http.Request, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	token := func(form url.Values, secret string) (int, map[string]interface{}) {
+		r := httptest.NewRequest("POST", "/proxy/oidc/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if secret != "" {
+			r.SetBasicAuth(form.Get("client_id"), secret)
+		}
+		w := do(r, nil)
+		var body map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body
+	}
+
+	var discovery oidcDiscovery
+	w := do(httptest.NewRequest("GET", "/proxy/.well-known/openid-configuration", nil), nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &discovery); err != nil || discovery.Issuer != "https://auth.example.com/proxy" {
+		t.Fatalf("Discovery document %s, %v", w.Body, err)
+	}
+
+	//Not logged in yet, so the user logs in first and is sent back.
+	authorize := "/proxy/oidc/authorize?response_type=code&client_id=wiki&scope=openid+email&state=xyz&nonce=n0nce&redirect_uri=" +
+		url.QueryEscape("https://wiki.example.com/callback")
+	w = do(httptest.NewRequest("GET", authorize, nil), nil)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/proxy/login" {
+		t.Fatalf("Authorize without login: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	r := httptest.NewRequest("POST", "/proxy/login", strings.NewReader("username=alice&password=hunter2"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = do(r, w.Result().Cookies())
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != authorize {
+		t.Fatalf("Login did not return to authorize: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	session := w.Result().Cookies()
+
+	w = do(httptest.NewRequest("GET", authorize, nil), session)
+	callback, _ := url.Parse(w.Header().Get("Location"))
+	code := callback.Query().Get("code")
+	if callback.Host != "wiki.example.com" || code == "" || callback.Query().Get("state") != "xyz" {
+		t.Fatalf("Authorize redirected to %s", callback)
+	}
+
+	form := url.Values{"grant_type": {"authorization_code"}, "client_id": {"wiki"}, "code": {code}, "redirect_uri": {"https://wiki.example.com/callback"}}
+	if status, _ := token(form, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("Token with the wrong client secret: %d", status)
+	}
+	status, body := token(form, "s3cret")
+	if status != http.StatusOK {
+		t.Fatalf("Token: %d %v", status, body)
+	}
+	idToken, _ := parseJWT(body["id_token"].(string))
+	if err := idToken.verify(&key.PublicKey); err != nil || idToken.claimString("aud") != "wiki" ||
+		idToken.claimString("sub") != "alice" || idToken.claimString("nonce") != "n0nce" || idToken.claimString("email") != "alice@example.com" {
+		t.Errorf("ID token %+v, %v", idToken.Claims, err)
+	}
+	if status, _ := token(form, "s3cret"); status != http.StatusBadRequest {
+		t.Errorf("Code used twice: %d", status)
+	}
+
+	for _, c := range []struct {
+		token string
+		want  int
+	}{
+		{body["access_token"].(string), http.StatusOK},
+		{body["id_token"].(string), http.StatusUnauthorized},
+	} {
+		r := httptest.NewRequest("GET", "/proxy/oidc/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+c.token)
+		if w := do(r, nil); w.Code != c.want || c.want == http.StatusOK && !strings.Contains(w.Body.String(), "alice@example.com") {
+			t.Errorf("Userinfo: %d %s. Expected %d", w.Code, w.Body, c.want)
+		}
+	}
+
+	//A client without a secret has to use PKCE.
+	spa := "/proxy/oidc/authorize?response_type=code&client_id=spa&scope=openid&redirect_uri=" + url.QueryEscape("https://spa.example.com/")
+	if w := do(httptest.NewRequest("GET", "/proxy/oidc/authorize?response_type=code&client_id=spa&scope=openid&redirect_uri=https://evil.example.com/", nil), session); w.Code != http.StatusBadRequest {
+		t.Errorf("Unregistered redirect URI: %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if w := do(httptest.NewRequest("GET", spa, nil), session); !strings.Contains(w.Header().Get("Location"), "error=invalid_request") {
+		t.Errorf("Public client without PKCE: %s", w.Header().Get("Location"))
+	}
+	verifier := randomToken()
+	for _, c := range []struct {
+		verifier string
+		want     int
+	}{
+		{randomToken(), http.StatusBadRequest},
+		{verifier, http.StatusOK},
+	} {
+		w = do(httptest.NewRequest("GET", spa+"&code_challenge_method=S256&code_challenge="+pkceChallenge(verifier), nil), session)
+		callback, _ = url.Parse(w.Header().Get("Location"))
+		form = url.Values{"grant_type": {"authorization_code"}, "client_id": {"spa"}, "code": {callback.Query().Get("code")},
+			"redirect_uri": {"https://spa.example.com/"}, "code_verifier": {c.verifier}}
+		if status, body := token(form, ""); status != c.want {
+			t.Errorf("Code verifier %s: %d %v. Expected %d", c.verifier, status, body, c.want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Who may register. In every mode but closed, the very first user may always register, and becomes an admin,
+//so a new installation can be set up through the web.
+const (
+	RegistrationOpen     = "open"     //Anyone who passes the reCaptcha
+	RegistrationInvite   = "invite"   //Only with an invite code made by an admin
+	RegistrationApproval = "approval" //Anyone, but an admin has to approve the account before it can be used
+	RegistrationClosed   = "closed"   //Nobody. /proxy/register is not served
+
+	defaultInviteTimeout = 7 * 24 * time.Hour
+)
+
+var registrationMode = RegistrationOpen
+
+var BoltBucketInvites = []byte("invites") //Code to Invite
+
+var (
+	ErrUnknownRegistrationMode = errors.New("Unknown registration mode. Expected open, invite, approval or closed.")
+	ErrInvalidInvite           = errors.New("The invite code is invalid or has expired")
+)
+
+//An Invite lets one person register while registration is by invitation only.
+type Invite struct {
+	Code      string
+	CreatedBy string
+	Created   time.Time
+	Expires   time.Time
+}
+
+func selectRegistrationMode() {
+	switch config.Registration.Mode {
+	case "", RegistrationOpen:
+		registrationMode = RegistrationOpen
+	case RegistrationInvite, RegistrationApproval, RegistrationClosed:
+		registrationMode = config.Registration.Mode
+	default:
+		logger.WithFields(logrus.Fields{"err": ErrUnknownRegistrationMode, "mode": config.Registration.Mode}).Fatal("Unable to set up registration.")
+	}
+	if registrationMode == RegistrationInvite {
+		if err := ensureBuckets(stateDB, BoltBucketInvites); err != nil {
+			logger.WithField("err", err).Fatal("Unable to create invite bucket.")
+		}
+	}
+	logger.WithField("mode", registrationMode).Info("Registration mode")
+}
+
+//noUsers reports whether nobody has registered yet.
+func noUsers() bool {
+	list, err := users.List()
+	return err == nil && len(list) == 0
+}
+
+func newInvite(admin string) (inv Invite, err error) {
+	timeout := time.Duration(config.Registration.InviteTimeout)
+	if timeout <= 0 {
+		timeout = defaultInviteTimeout
+	}
+	inv = Invite{
+		Code:      base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(15)),
+		CreatedBy: admin,
+		Created:   time.Now(),
+	}
+	inv.Expires = inv.Created.Add(timeout)
+	return inv, putInvite(inv)
+}
+
+func putInvite(inv Invite) error {
+	data, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketInvites).Put([]byte(inv.Code), data)
+	})
+}
+
+//listInvites returns the invites that have not expired yet.
+func listInvites() (list []Invite, err error) {
+	err = stateDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketInvites).ForEach(func(k, v []byte) error {
+			var inv Invite
+			if err := json.Unmarshal(v, &inv); err != nil {
+				return err
+			}
+			if time.Now().Before(inv.Expires) {
+				list = append(list, inv)
+			}
+			return nil
+		})
+	})
+	return
+}
+
+func checkInvite(code string) (inv Invite, err error) {
+	err = stateDB.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(BoltBucketInvites).Get([]byte(code))
+		if data == nil || json.Unmarshal(data, &inv) != nil || time.Now().After(inv.Expires) {
+			return ErrInvalidInvite
+		}
+		return nil
+	})
+	return
+}
+
+//takeInvite uses up an invite. Expired invites are removed too, but not returned.
+func takeInvite(code string) (inv Invite, err error) {
+	err = stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketInvites)
+		data := b.Get([]byte(code))
+		if data == nil {
+			return ErrInvalidInvite
+		}
+		if err := b.Delete([]byte(code)); err != nil {
+			return err
+		}
+		if json.Unmarshal(data, &inv) != nil || time.Now().After(inv.Expires) {
+			return ErrInvalidInvite
+		}
+		return nil
+	})
+	return
+}
+
+func revokeInvite(code string) error {
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketInvites).Delete([]byte(code))
+	})
+}
+
+//inviteLink is the registration link for an invite. It is only absolute when PublicURL is set.
+func inviteLink(code string) string {
+	return strings.TrimSuffix(config.PublicURL, "/") + "/proxy/register?invite=" + code
+}
+
+//inviteRequired checks the invite of a registration, if one is needed, and remembers it in the session for postRegister.
+//It returns false after rendering a page saying why the visitor may not register.
+func inviteRequired(w http.ResponseWriter, r *http.Request) bool {
+	if registrationMode != RegistrationInvite || noUsers() {
+		return true
+	}
+	session, _ := store.Get(r, "auth")
+	code := r.URL.Query().Get("invite")
+	if code == "" {
+		code, _ = session.Values["invite"].(string)
+	}
+	if _, err := checkInvite(code); err != nil {
+		page := Page{
+			Title:   "Registrations",
+			Content: "Registration is by invitation only. Please ask an admin for an invite link.",
+		}
+		if code != "" {
+			page.Message = ErrInvalidInvite.Error() + "."
+		}
+		renderer.Render(w, page)
+		return false
+	}
+	session.Values["invite"] = code
+	session.Save(r, w)
+	return true
+}
+
+var (
+	invitesContent = template.Must(template.New("invites").Parse(`
+	{{with .New}}<p>Send this link to the person you want to invite: <code>{{.}}</code></p>{{end}}
+	<table>
+	{{range .Invites}}
+		<tr>
+			<td><code>{{.Code}}</code></td>
+			<td>By {{.CreatedBy}}, expires {{.Expires.Format "2006-01-02 15:04"}}</td>
+			<td>
+				<form method="POST" action="/proxy/admin/invites/revoke">
+					<input type="hidden" name="code" value="{{.Code}}">
+					<input type="hidden" name="csrf" value="{{$.CSRF}}">
+					<input type="submit" value="Revoke">
+				</form>
+			</td>
+		</tr>
+	{{else}}
+		<tr><td>There are no open invites.</td></tr>
+	{{end}}
+	</table>
+	<form method="POST" action="/proxy/admin/invites">
+		<input type="hidden" name="csrf" value="{{.CSRF}}">
+		<input type="submit" value="New invite">
+	</form>`))
+
+	pendingContent = template.Must(template.New("pending").Parse(`
+	<table>
+	{{range .Users}}
+		<tr>
+			<td>{{.Name}}</td>
+			<td>{{.Email}}{{if .Unverified}} (not confirmed){{end}}</td>
+			<td>
+				<form method="POST" action="/proxy/admin/registrations/approve">
+					<input type="hidden" name="user" value="{{.Name}}">
+					<input type="hidden" name="csrf" value="{{$.CSRF}}">
+					<input type="submit" value="Approve">
+				</form>
+				<form method="POST" action="/proxy/admin/registrations/reject">
+					<input type="hidden" name="user" value="{{.Name}}">
+					<input type="hidden" name="csrf" value="{{$.CSRF}}">
+					<input type="submit" value="Reject">
+				</form>
+			</td>
+		</tr>
+	{{else}}
+		<tr><td>No registrations are waiting for approval.</td></tr>
+	{{end}}
+	</table>`))
+)
+
+func renderInvites(w http.ResponseWriter, r *http.Request, newLink string) {
+	list, err := listInvites()
+	if err != nil {
+		logger.WithField("err", err).Error("Listing invites")
+	}
+	renderer.Render(w, Page{
+		Title:   "Invites",
+		Content: renderContent(invitesContent, map[string]interface{}{"New": newLink, "Invites": list, "CSRF": csrfToken(w, r)}),
+	})
+}
+
+func getAdminInvites(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(r); !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	renderInvites(w, r, "")
+}
+
+func postAdminInvites(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	inv, err := newInvite(admin.Name)
+	if err != nil {
+		http.Error(w, "Unable to create invite: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "expires": inv.Expires}).Info("Invite created")
+	audit(r, EventAdmin, "", admin.Name, "Created an invite expiring "+inv.Expires.Format("2006-01-02 15:04"))
+	renderInvites(w, r, inviteLink(inv.Code))
+}
+
+func postAdminInviteRevoke(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	if err := revokeInvite(r.PostFormValue("code")); err != nil {
+		http.Error(w, "Unable to revoke invite: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.WithField("admin", admin.Name).Info("Invite revoked")
+	audit(r, EventAdmin, "", admin.Name, "Revoked an invite")
+	http.Redirect(w, r, "/proxy/admin/invites", http.StatusSeeOther)
+}
+
+func getAdminRegistrations(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(r); !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	list, err := users.List()
+	if err != nil {
+		logger.WithField("err", err).Error("Listing users")
+	}
+	var pending []User
+	for _, u := range list {
+		if u.Pending {
+			pending = append(pending, u)
+		}
+	}
+	renderer.Render(w, Page{
+		Title:   "Registrations",
+		Content: renderContent(pendingContent, map[string]interface{}{"CSRF": csrfToken(w, r), "Users": pending}),
+	})
+}
+
+const approvedMailBody = `Hello %s,
+
+Your account has been approved. You can now log in at %s
+`
+
+//approveUser lets a pending user log in, and tells them so if mail is set up.
+func approveUser(user User) error {
+	user.Pending = false
+	if err := users.Update(user); err != nil {
+		return err
+	}
+	if mailer != nil && user.Email != "" {
+		link := strings.TrimSuffix(config.PublicURL, "/") + "/proxy/login"
+		if err := mailer.Send(user.Email, "Your account has been approved", fmt.Sprintf(approvedMailBody, user.Name, link)); err != nil {
+			logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Sending approval mail")
+		}
+	}
+	return nil
+}
+
+func postAdminRegistrationApprove(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	user, err := users.Get(r.PostFormValue("user"))
+	if err != nil || !user.Pending {
+		http.Error(w, "No such registration.", http.StatusNotFound)
+		return
+	}
+	if err := approveUser(user); err != nil {
+		http.Error(w, "Unable to approve: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "user": user.Name}).Info("Registration approved")
+	audit(r, EventAdmin, user.Name, admin.Name, "Registration approved")
+	http.Redirect(w, r, "/proxy/admin/registrations", http.StatusSeeOther)
+}
+
+func postAdminRegistrationReject(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	user, err := users.Get(r.PostFormValue("user"))
+	if err != nil || !user.Pending {
+		http.Error(w, "No such registration.", http.StatusNotFound)
+		return
+	}
+	if err := deleteUser(user.Name); err != nil {
+		http.Error(w, "Unable to reject: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "user": user.Name}).Info("Registration rejected")
+	audit(r, EventAdmin, user.Name, admin.Name, "Registration rejected")
+	http.Redirect(w, r, "/proxy/admin/registrations", http.StatusSeeOther)
+}
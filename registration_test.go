@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInvites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	stateDB = db
+	ensureBuckets(stateDB, BoltBucketInvites)
+
+	inv, err := newInvite("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := Invite{Code: "expired", CreatedBy: "alice", Expires: time.Now().Add(-time.Minute)}
+	putInvite(expired)
+
+	if list, err := listInvites(); err != nil || len(list) != 1 || list[0].Code != inv.Code {
+		t.Errorf("listInvites = %+v, %v. Expected only the new invite", list, err)
+	}
+	if _, err := checkInvite(expired.Code); err != ErrInvalidInvite {
+		t.Errorf("Expired invite: %v. Expected ErrInvalidInvite", err)
+	}
+	if _, err := checkInvite(inv.Code); err != nil {
+		t.Fatal(err)
+	}
+	if taken, err := takeInvite(inv.Code); err != nil || taken.CreatedBy != "alice" {
+		t.Errorf("takeInvite = %+v, %v", taken, err)
+	}
+	if _, err := takeInvite(inv.Code); err != ErrInvalidInvite {
+		t.Errorf("Invite used twice: %v. Expected ErrInvalidInvite", err)
+	}
+}
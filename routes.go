@@ -1,15 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
+	"html/template"
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"net/mail"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 )
 
 const (
@@ -59,11 +63,48 @@ func setupHandlers() http.Handler {
 		renderer.Render(w, pages.Get(MainMenuPage))
 	})))
 
+	setupAPIHandlers(proxymux.PathPrefix("/api/v1").Subrouter())
+	if identityProvider != nil {
+		proxymux.Methods("GET").Path("/.well-known/openid-configuration").Handler(LoggingMW(http.HandlerFunc(getOIDCConfiguration)))
+		proxymux.Methods("GET").Path("/oidc/jwks").Handler(LoggingMW(http.HandlerFunc(getJWKS)))
+		proxymux.Methods("GET").Path("/oidc/authorize").Handler(LoggingMW(http.HandlerFunc(getAuthorize)))
+		proxymux.Methods("POST").Path("/oidc/token").Handler(LoggingMW(http.HandlerFunc(postToken)))
+		proxymux.Methods("GET", "POST").Path("/oidc/userinfo").Handler(LoggingMW(http.HandlerFunc(getUserinfo)))
+	}
+
 	{ // GET handlers
 		m := proxymux.Methods("GET").Subrouter()
+		m.Path("/login/password").Handler(LoggingMW(http.HandlerFunc(getLoginPassword)))
+		if len(oidcProviders) > 0 {
+			m.Path("/login/oidc/{name}").Handler(LoggingMW(http.HandlerFunc(getOIDCLogin)))
+			m.Path("/login/oidc/{name}/callback").Handler(LoggingMW(http.HandlerFunc(getOIDCCallback)))
+		}
 		m.PathPrefix("/login").Handler(LoggingMW(http.HandlerFunc(getLogin)))
-		m.PathPrefix("/register").Handler(LoggingMW(http.HandlerFunc(getRegister)))
+		if registrationMode != RegistrationClosed {
+			m.PathPrefix("/register").Handler(LoggingMW(http.HandlerFunc(getRegister)))
+		}
 		m.PathPrefix("/logout").Handler(LoggingMW(http.HandlerFunc(getLogout)))
+		m.Path("/account/password").Handler(LoggingMW(http.HandlerFunc(getAccountPassword)))
+		m.Path("/account/totp").Handler(LoggingMW(http.HandlerFunc(getAccountTOTP)))
+		m.Path("/account/tokens").Handler(LoggingMW(http.HandlerFunc(getAccountTokens)))
+		m.Path("/admin").Handler(LoggingMW(http.HandlerFunc(getAdmin)))
+		m.Path("/admin/lockouts").Handler(LoggingMW(http.HandlerFunc(getAdminLockouts)))
+		m.Path("/admin/tokens").Handler(LoggingMW(http.HandlerFunc(getAdminTokens)))
+		m.Path("/admin/audit").Handler(LoggingMW(http.HandlerFunc(getAdminAudit)))
+		switch registrationMode {
+		case RegistrationInvite:
+			m.Path("/admin/invites").Handler(LoggingMW(http.HandlerFunc(getAdminInvites)))
+		case RegistrationApproval:
+			m.Path("/admin/registrations").Handler(LoggingMW(http.HandlerFunc(getAdminRegistrations)))
+		}
+		if mailer != nil {
+			m.Path("/forgot").Handler(LoggingMW(http.HandlerFunc(getForgot)))
+			m.Path("/reset").Handler(LoggingMW(http.HandlerFunc(getReset)))
+			m.Path("/verify").Handler(LoggingMW(http.HandlerFunc(getVerify)))
+		}
+		if relyingParty != nil {
+			m.Path("/account/passkeys").Handler(LoggingMW(http.HandlerFunc(getAccountPasskeys)))
+		}
 		if config.WebDirectory != nil { //Only put up this route if we have static content. Could all be served from CDN or similar.
 			staticdir := filepath.Join(*config.WebDirectory, "static")
 			m.PathPrefix("/static").Handler(LoggingMW(CacheMW{RewriteMW{
@@ -77,8 +118,40 @@ func setupHandlers() http.Handler {
 
 	{ // POST handlers
 		m := proxymux.Methods("POST").Subrouter()
+		m.Path("/login/totp").Handler(LoggingMW(http.HandlerFunc(postLoginTOTP)))
+		m.Path("/login/password").Handler(LoggingMW(http.HandlerFunc(postLoginPassword)))
 		m.PathPrefix("/login").Handler(LoggingMW(http.HandlerFunc(postLogin)))
-		m.PathPrefix("/register").Handler(LoggingMW(http.HandlerFunc(postRegister)))
+		if registrationMode != RegistrationClosed {
+			m.PathPrefix("/register").Handler(LoggingMW(http.HandlerFunc(postRegister)))
+		}
+		m.Path("/account/password").Handler(LoggingMW(http.HandlerFunc(postAccountPassword)))
+		m.Path("/account/totp").Handler(LoggingMW(http.HandlerFunc(postAccountTOTP)))
+		m.Path("/account/totp/disable").Handler(LoggingMW(http.HandlerFunc(postAccountTOTPDisable)))
+		m.Path("/account/tokens").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAccountTokens)}))
+		m.Path("/account/tokens/revoke").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAccountTokenRevoke)}))
+		m.Path("/admin/users").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAdminUser)}))
+		m.Path("/admin/unlock").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAdminUnlock)}))
+		m.Path("/admin/tokens").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAdminTokens)}))
+		m.Path("/admin/tokens/revoke").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAdminTokenRevoke)}))
+		switch registrationMode {
+		case RegistrationInvite:
+			m.Path("/admin/invites").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAdminInvites)}))
+			m.Path("/admin/invites/revoke").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAdminInviteRevoke)}))
+		case RegistrationApproval:
+			m.Path("/admin/registrations/approve").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAdminRegistrationApprove)}))
+			m.Path("/admin/registrations/reject").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAdminRegistrationReject)}))
+		}
+		if mailer != nil {
+			m.Path("/forgot").Handler(LoggingMW(http.HandlerFunc(postForgot)))
+			m.Path("/reset").Handler(LoggingMW(http.HandlerFunc(postReset)))
+		}
+		if relyingParty != nil {
+			m.Path("/account/passkeys/delete").Handler(LoggingMW(CSRFMW{http.HandlerFunc(postAccountPasskeyDelete)}))
+			m.Path("/webauthn/register/begin").Handler(LoggingMW(http.HandlerFunc(postPasskeyRegisterBegin)))
+			m.Path("/webauthn/register/finish").Handler(LoggingMW(http.HandlerFunc(postPasskeyRegisterFinish)))
+			m.Path("/webauthn/login/begin").Handler(LoggingMW(http.HandlerFunc(postPasskeyLoginBegin)))
+			m.Path("/webauthn/login/finish").Handler(LoggingMW(http.HandlerFunc(postPasskeyLoginFinish)))
+		}
 	}
 
 	return muxer
@@ -138,19 +211,33 @@ func (rw RewriteMW) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func mainHandler(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "auth")
 	if loggedin, ok := session.Values["loggedin"].(bool); !(ok && loggedin) {
-		if isWebsocket(r) {
-			http.Error(w, "You need to login first.", http.StatusUnauthorized)
+		if _, ok := authorizationUser(w, r); ok {
+			proxyRequest(w, r)
 		}
-		logger.WithFields(logrus.Fields{
-			"method":   r.Method,
-			"url":      r.URL,
-			"client":   r.RemoteAddr,
-			"redirect": "/proxy/login",
-			"status":   http.StatusTemporaryRedirect,
-		}).Info("Client not logged in.")
-		http.Redirect(w, r, "/proxy/login", http.StatusTemporaryRedirect)
+		return
+	}
+
+	//The account may have been disabled, expired or deleted since the login.
+	name, _ := session.Values["user"].(string)
+	switch user, err := users.Get(name); {
+	case err == ErrUnknownUser || err == nil && !user.Active():
+		session.Values["loggedin"] = false
+		delete(session.Values, "user")
+		endSession(session)
+		session.Save(r, w)
+		audit(r, EventLogout, name, "", "Session ended, the account is no longer active")
+		denyProxy(w, r, "Session of inactive user rejected.")
+		return
+	case err != nil:
+		logger.WithFields(logrus.Fields{"user": name, "err": err}).Error("Checking user of session")
+		http.Error(w, "Unable to check your account. Please try again later.", http.StatusServiceUnavailable)
+		return
 	}
+	proxyRequest(w, r)
+}
 
+//proxyRequest passes a request of a logged in client on to the destination.
+func proxyRequest(w http.ResponseWriter, r *http.Request) {
 	if isWebsocket(r) {
 		p := websocketProxy{}
 		p.ServeHTTP(w, r)
@@ -171,6 +258,127 @@ func mainHandler(w http.ResponseWriter, r *http.Request) {
 	revProxy.ServeHTTP(w, r)
 }
 
+//denyProxy sends a browser that may not use the proxy to the login page. Other clients are asked for credentials.
+func denyProxy(w http.ResponseWriter, r *http.Request, message string) {
+	fields := logrus.Fields{
+		"method": r.Method,
+		"url":    r.URL,
+		"client": r.RemoteAddr,
+	}
+	if isWebsocket(r) || !acceptsHTML(r) {
+		fields["status"] = http.StatusUnauthorized
+		logger.WithFields(fields).Info(message)
+		challengeProxy(w, http.StatusUnauthorized, "You need to login first.")
+		return
+	}
+	fields["redirect"], fields["status"] = "/proxy/login", http.StatusTemporaryRedirect
+	logger.WithFields(fields).Info(message)
+	http.Redirect(w, r, "/proxy/login", http.StatusTemporaryRedirect)
+}
+
+//acceptsHTML tells browsers, which ask for HTML when following a link, from clients like curl, git or scripts.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+//challengeProxy answers with the ways to authenticate a client can use instead of the session cookie.
+func challengeProxy(w http.ResponseWriter, status int, message string) {
+	w.Header().Add("WWW-Authenticate", `Basic realm="authprox", charset="UTF-8"`)
+	w.Header().Add("WWW-Authenticate", `Bearer realm="authprox"`)
+	http.Error(w, message, status)
+}
+
+//authorizationUser lets in clients that send an Authorization header instead of a session cookie: a password with Basic,
+//or a personal access token with Bearer. Failed passwords count against the throttle like on the login page, and
+//passwords verified within the last minute are taken from basicAuthVerified instead of being hashed again.
+//The header is for authprox, not for the destination, so it is removed before the request is proxied.
+func authorizationUser(w http.ResponseWriter, r *http.Request) (User, bool) {
+	auth := r.Header.Get("Authorization")
+	username, password, basic := r.BasicAuth()
+	r.Header.Del("Authorization")
+	if auth == "" {
+		denyProxy(w, r, "Client not logged in.")
+		return User{}, false
+	}
+	fields := logrus.Fields{
+		"method": r.Method,
+		"url":    r.URL,
+		"client": r.RemoteAddr,
+	}
+
+	var user User
+	var err error
+	switch {
+	case strings.HasPrefix(auth, "Bearer "):
+		user, err = proxyTokenUser(strings.TrimPrefix(auth, "Bearer "))
+		fields["user"], fields["err"] = user.Name, err
+		switch err {
+		case nil:
+			return user, true
+		case ErrInvalidToken:
+			logger.WithFields(fields).Info("Proxy token rejected.")
+			challengeProxy(w, http.StatusUnauthorized, ErrInvalidToken.Error()+".")
+			return User{}, false
+		}
+	case basic:
+		fields["user"] = username
+		addr := clientAddress(r)
+		throttled := func(wait time.Duration, locked bool) (User, bool) {
+			logger.WithFields(fields).Info("Client login throttled.")
+			setRetryAfter(w, wait)
+			http.Error(w, throttleMessage(wait, locked), http.StatusTooManyRequests)
+			return User{}, false
+		}
+		if user, ok := basicAuthVerified.user(username, password); ok {
+			if wait, locked := throttle.Check(username, addr); wait > 0 {
+				return throttled(wait, locked)
+			}
+			return user, true
+		}
+		if wait, locked := throttle.Attempt(username, addr); wait > 0 {
+			return throttled(wait, locked)
+		}
+		user, err = authenticate(r.Context(), username, password)
+		fields["err"] = err
+		if err != ErrUnknownUser && err != ErrWrongPassword {
+			throttle.Release(username, addr)
+		}
+		switch err {
+		case nil:
+			if !passwordSuffices(user) {
+				//The password alone is not enough for this account.
+				logger.WithFields(fields).Info("Password rejected for account that needs more than a password.")
+				audit(r, EventLoginFailed, username, "", "Password sent without the second factor the account requires")
+				challengeProxy(w, http.StatusUnauthorized, "This account can not log in with only a password. Please use a personal access token.")
+				return User{}, false
+			}
+			throttle.Succeed(username)
+			basicAuthVerified.add(user, password)
+			return user, true
+		case ErrUnknownUser, ErrWrongPassword:
+			logger.WithFields(fields).Info("Client failed to log in.")
+			failLogin(r, username, err.Error())
+			challengeProxy(w, http.StatusUnauthorized, "Wrong username or password.")
+			return User{}, false
+		}
+	default:
+		logger.WithFields(fields).Info("Unsupported authorization.")
+		challengeProxy(w, http.StatusUnauthorized, "Only Basic and Bearer authorization are supported.")
+		return User{}, false
+	}
+
+	switch err {
+	case ErrDisabled, ErrExpired, ErrUnverified, ErrPending:
+		logger.WithFields(fields).Info("Inactive user tried to log in.")
+		audit(r, EventLoginFailed, user.Name, "", err.Error())
+		http.Error(w, err.Error()+".", http.StatusForbidden)
+	default:
+		logger.WithFields(fields).Error("Authenticating user")
+		http.Error(w, "Logging in is not possible right now. Please try again later.", http.StatusServiceUnavailable)
+	}
+	return User{}, false
+}
+
 func getLogin(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "auth")
 	if loggedin, ok := session.Values["loggedin"].(bool); ok && loggedin {
@@ -181,38 +389,224 @@ func getLogin(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
-	renderer.Render(w, pages.Get(LoginPage)) //Not logged in. Serve login page
+	renderer.Render(w, loginPage()) //Not logged in. Serve login page
+}
+
+//loginPage is the login page with whatever other ways to log in or recover are enabled.
+func loginPage() Page {
+	page := pages.Get(LoginPage)
+	if relyingParty != nil && config.WebAuthn.Passwordless {
+		page.Head += passkeyScript
+		page.Content += passkeyLoginContent
+	}
+	if len(oidcProviders) > 0 {
+		var buf bytes.Buffer
+		oidcLoginContent.Execute(&buf, oidcProviders)
+		page.Content += template.HTML(buf.String())
+	}
+	if mailer != nil {
+		page.Content += forgotLink
+	}
+	return page
 }
 
 func postLogin(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "auth")
-	//Temp code. Autologin.
 	r.ParseForm()
-
-	if users.Authenticate(r.PostFormValue("username"), r.PostFormValue("password")) {
-		session.Values["loggedin"] = true
-		session.Save(r, w)
-		logger.WithFields(logrus.Fields{
-			"method": r.Method,
-			"url":    r.URL,
-			"client": r.RemoteAddr,
-			"user":   r.PostFormValue("username"),
-		}).Info("Client logged in.")
-		renderer.Render(w, pages.Get(LoginSuccessPage))
-	} else {
+	username, password := r.PostFormValue("username"), r.PostFormValue("password")
+	addr := clientAddress(r)
+	if wait, locked := throttle.Attempt(username, addr); wait > 0 {
 		logger.WithFields(logrus.Fields{
 			"method": r.Method,
 			"url":    r.URL,
 			"client": r.RemoteAddr,
-			"user":   r.PostFormValue("username"),
-		}).Info("Client failed to logged in.")
-		renderer.Render(w, pages.Get(LoginPage))
+			"user":   username,
+			"wait":   wait,
+		}).Info("Client login throttled.")
+		renderThrottled(w, loginPage(), wait, locked)
+		return
+	}
+
+	user, err := authenticate(r.Context(), username, password)
+	if err != ErrUnknownUser && err != ErrWrongPassword {
+		throttle.Release(username, addr) //Only wrong credentials stay counted
+	}
+	if err == nil {
+		if len(user.TOTPSecret) > 0 || hasPasskeys(username) {
+			//Password is fine, but the second factor is still missing.
+			session.Values["pending"] = username
+			session.Values["pending_since"] = time.Now().Unix()
+			delete(session.Values, "pending_password")
+			session.Save(r, w)
+			renderSecondFactor(w, user, "")
+			return
+		}
+		completeLogin(w, r, session, username)
+		return
 	}
+
+	fields := logrus.Fields{
+		"method": r.Method,
+		"url":    r.URL,
+		"client": r.RemoteAddr,
+		"user":   username,
+		"err":    err,
+	}
+	page := loginPage()
+	switch err {
+	case ErrUnknownUser, ErrWrongPassword:
+		//Both look the same to the client, so usernames can not be probed for.
+		logger.WithFields(fields).Info("Client failed to log in.")
+		page.Message = "Wrong username or password."
+		if wait, locked := failLogin(r, username, err.Error()); locked {
+			page.Message = throttleMessage(wait, locked)
+		}
+		renderer.Render(w, page)
+		return
+	case ErrUnverified, ErrPending, ErrDisabled, ErrExpired:
+		page.Message = inactiveMessage(err)
+		if err == ErrUnverified && mailer != nil {
+			page.Message += " We have sent you a new link to confirm it."
+			if err := sendVerification(user); err != nil {
+				logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Sending verification mail")
+			}
+		}
+	default:
+		//The user store failed, which is no fault of the client and not counted against it.
+		logger.WithFields(fields).Error("Authenticating user")
+		page.Message = "Logging in is not possible right now. Please try again later."
+		audit(r, EventLoginFailed, username, "", err.Error())
+		w.WriteHeader(http.StatusServiceUnavailable)
+		renderer.Render(w, page)
+		return
+	}
+	logger.WithFields(fields).Info("Inactive user tried to log in.")
+	audit(r, EventLoginFailed, username, "", err.Error())
+	renderer.Render(w, page)
+}
+
+//inactiveMessage tells the user why an account that may not log in was refused.
+func inactiveMessage(reason error) string {
+	switch reason {
+	case ErrUnverified:
+		return "Your email address has not been confirmed yet."
+	case ErrPending:
+		return "Your account is waiting for an admin to approve it."
+	case ErrDisabled:
+		return "Your account has been disabled."
+	case ErrExpired:
+		return "Your account has expired."
+	}
+	return "Your account can not be used yet."
+}
+
+//failLogin records a failed login, which Throttle.Attempt has already counted. It returns the wait as Throttle.Check does.
+func failLogin(r *http.Request, username, reason string) (time.Duration, bool) {
+	audit(r, EventLoginFailed, username, "", reason)
+	wait, locked := throttle.Check(username, clientAddress(r))
+	if locked {
+		audit(r, EventLockout, username, "", "Locked out for "+throttle.Lockout.String()+" after repeated failures")
+	}
+	return wait, locked
+}
+
+//completeLogin marks the session as logged in once all required factors have been checked.
+func completeLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, username string) {
+	if passwordChangeRequired(w, r, session, username) {
+		renderNewPassword(w, "")
+		return
+	}
+	to := returnTo(session)
+	startSession(w, r, session, username)
+	renderLoginSuccess(w, r, to)
+}
+
+//returnTo takes the page that sent the user to log in, like the authorize endpoint of the OpenID Connect provider.
+//The caller saves the session.
+func returnTo(session *sessions.Session) string {
+	to, _ := session.Values["return_to"].(string)
+	delete(session.Values, "return_to")
+	if !strings.HasPrefix(to, "/proxy/") { //Only ever set to local paths, but never send the user elsewhere
+		return "/"
+	}
+	return to
+}
+
+//renderLoginSuccess sends the user on to where the login was started, or tells them they are logged in.
+func renderLoginSuccess(w http.ResponseWriter, r *http.Request, to string) {
+	if to != "/" {
+		http.Redirect(w, r, to, http.StatusSeeOther)
+		return
+	}
+	renderer.Render(w, pages.Get(LoginSuccessPage))
+}
+
+func startSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, username string) {
+	session.Values["loggedin"] = true
+	session.Values["user"] = username
+	registerSession(session, r, username)
+	session.Save(r, w)
+	throttle.Succeed(username)
+	audit(r, EventLogin, username, "", "")
+	logger.WithFields(logrus.Fields{
+		"method": r.Method,
+		"url":    r.URL,
+		"client": r.RemoteAddr,
+		"user":   username,
+	}).Info("Client logged in.")
+}
+
+//pendingUser returns the user that has given the right password but not yet the second factor.
+func pendingUser(r *http.Request) (string, bool) {
+	session, _ := store.Get(r, "auth")
+	username, _ := session.Values["pending"].(string)
+	since, _ := session.Values["pending_since"].(int64)
+	if username == "" || time.Since(time.Unix(since, 0)) > secondFactorTimeout {
+		return "", false
+	}
+	return username, true
+}
+
+//renderSecondFactor asks for whichever second factors the user has set up.
+func renderSecondFactor(w http.ResponseWriter, user User, message string) {
+	page := Page{Title: "Two-Factor Authentication"}
+	if len(user.TOTPSecret) > 0 {
+		page = pages.Get(TOTPPage)
+	}
+	if hasPasskeys(user.Name) {
+		page.Head += passkeyScript
+		page.Content = passkeyLoginContent + page.Content
+	}
+	page.Message = message
+	renderer.Render(w, page)
+}
+
+//loggedInUser returns the user of a logged in session.
+func loggedInUser(r *http.Request) (User, bool) {
+	session, _ := store.Get(r, "auth")
+	if loggedin, ok := session.Values["loggedin"].(bool); !(ok && loggedin) {
+		return User{}, false
+	}
+	name, ok := session.Values["user"].(string)
+	if !ok {
+		return User{}, false
+	}
+	user, err := users.Get(name)
+	return user, err == nil && user.Active()
+}
+
+//adminUser returns the user of a logged in session if it is an admin.
+func adminUser(r *http.Request) (User, bool) {
+	user, ok := loggedInUser(r)
+	return user, ok && user.Admin
 }
 
 func getRegister(w http.ResponseWriter, r *http.Request) {
 	//If they are logged in and want to register again, then fine.
 	//Can add measures against this if it becomes and issue.
+	if !inviteRequired(w, r) {
+		return
+	}
 	renderer.Render(w, pages.Get(RegistrationPage)) //Serve register page
 }
 
@@ -228,7 +622,53 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := users.Register(username, password)
+	user := User{Name: username, Email: strings.TrimSpace(r.PostFormValue("email"))}
+	if user.Email != "" || mailer != nil {
+		//With mail enabled the address is required, since the account is activated through it.
+		if _, err := mail.ParseAddress(user.Email); err != nil {
+			page := pages.Get(RegistrationPage)
+			page.Message = "Please enter a valid email address."
+			w.WriteHeader(http.StatusBadRequest)
+			renderer.Render(w, page)
+			return
+		}
+		user.Unverified = mailer != nil
+	}
+
+	if err := passwordPolicy.Check(username, password); err != nil {
+		page := pages.Get(RegistrationPage)
+		page.Message = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		renderer.Render(w, page)
+		return
+	}
+
+	first := noUsers()
+	var invite Invite
+	switch {
+	case first:
+		//The first user is let in whatever the mode, or nobody could ever manage the others.
+	case registrationMode == RegistrationApproval:
+		user.Pending = true
+	case registrationMode == RegistrationInvite:
+		session, _ := store.Get(r, "auth")
+		code, _ := session.Values["invite"].(string)
+		var err error
+		if invite, err = takeInvite(code); err != nil {
+			page := pages.Get(RegistrationPage)
+			page.Message = err.Error() + "."
+			w.WriteHeader(http.StatusForbidden)
+			renderer.Render(w, page)
+			return
+		}
+		delete(session.Values, "invite")
+		session.Save(r, w)
+	}
+
+	err := users.Register(user, password)
+	if err != nil && invite.Code != "" {
+		putInvite(invite) //Let them try again with another username.
+	}
 	switch err {
 	case nil:
 		//Success
@@ -238,7 +678,25 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 			"client": r.RemoteAddr,
 			"user":   username,
 		}).Info("User registration")
-		renderer.Render(w, pages.Get(RegistrationSuccessPage))
+		details := ""
+		switch {
+		case invite.Code != "":
+			details = "Invited by " + invite.CreatedBy
+		case user.Pending:
+			details = "Waiting for approval"
+		}
+		audit(r, EventRegister, username, "", details)
+		page := pages.Get(RegistrationSuccessPage)
+		if user.Unverified {
+			if err := sendVerification(user); err != nil {
+				logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Sending verification mail")
+			}
+			page.Message = "We have sent a link to " + user.Email + ". Please follow it to activate your account."
+		}
+		if user.Pending {
+			page.Message += " An admin has to approve your account before you can log in."
+		}
+		renderer.Render(w, page)
 	case ErrUserExists:
 		http.Error(w, "The user already exists. Please try again with a different username.", http.StatusPreconditionFailed)
 	default:
@@ -248,7 +706,12 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 
 func getLogout(w http.ResponseWriter, r *http.Request) {
 	session, _ := store.Get(r, "auth")
+	if name, ok := session.Values["user"].(string); ok && session.Values["loggedin"] == true {
+		audit(r, EventLogout, name, "", "")
+	}
 	session.Values["loggedin"] = false
+	delete(session.Values, "user")
+	endSession(session)
 	session.Save(r, w)
 	renderer.Render(w, pages.Get(LogoutPage))
 }
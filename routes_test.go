@@ -0,0 +1,140 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMainHandlerInactiveUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	um, err := NewJsonUserManager(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	users = um
+	store = sessions.NewCookieStore(securecookie.GenerateRandomKey(64))
+	um.Register(User{Name: "alice"}, "hunter2")
+
+	//A session cookie as left by a login of alice.
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.Get(r, "auth")
+	session.Values["loggedin"] = true
+	session.Values["user"] = "alice"
+	session.Save(r, rec)
+	cookie := rec.Header().Get("Set-Cookie")
+
+	for _, change := range []func(*User){
+		func(u *User) { u.Disabled = true },
+		func(u *User) { u.ExpiresAt = time.Now().Add(-time.Second) },
+	} {
+		alice, _ := um.Get("alice")
+		change(&alice)
+		um.Update(alice)
+
+		r := httptest.NewRequest("GET", "/app", nil)
+		r.Header.Set("Cookie", cookie)
+		r.Header.Set("Accept", "text/html,application/xhtml+xml")
+		w := httptest.NewRecorder()
+		mainHandler(w, r)
+		if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "/proxy/login" {
+			t.Errorf("Session of %+v: %d %s. Expected a redirect to the login", alice, w.Code, w.Header().Get("Location"))
+		}
+		if w.Header().Get("Set-Cookie") == "" {
+			t.Error("Session was not ended")
+		}
+		alice.Disabled, alice.ExpiresAt = false, time.Time{}
+		um.Update(alice)
+	}
+}
+
+func TestMainHandlerAuthorization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	um, err := NewJsonUserManager(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	users, stateDB = um, db
+	selectAPITokens()
+	if throttle, err = NewThrottle(stateDB); err != nil {
+		t.Fatal(err)
+	}
+	store = sessions.NewCookieStore(securecookie.GenerateRandomKey(64))
+	um.Register(User{Name: "alice"}, "hunter2")
+	um.Register(User{Name: "bob", TOTPSecret: Key("12345678901234567890")}, "hunter3")
+	proxyToken, _, _ := newAPIToken("alice", "CI", []string{ScopeProxy}, time.Time{})
+	adminToken, _, _ := newAPIToken("alice", "Script", []string{ScopeAdmin}, time.Time{})
+
+	destination := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			t.Error("The credentials for authprox were passed on to the destination")
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer destination.Close()
+	config.Destination = strings.TrimPrefix(destination.URL, "http://")
+	defer func() { config.Destination = "localhost:8080" }()
+
+	for _, c := range []struct {
+		name          string
+		accept        string
+		setAuth       func(r *http.Request)
+		want          int
+		wantChallenge bool
+	}{
+		{"browser", "text/html", nil, http.StatusTemporaryRedirect, false},
+		{"curl", "*/*", nil, http.StatusUnauthorized, true},
+		{"basic", "", func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") }, http.StatusOK, false},
+		{"second factor", "", func(r *http.Request) { r.SetBasicAuth("bob", "hunter3") }, http.StatusUnauthorized, true},
+		{"token", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+proxyToken) }, http.StatusOK, false},
+		{"admin token", "", func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+adminToken) }, http.StatusUnauthorized, true},
+		{"wrong password", "", func(r *http.Request) { r.SetBasicAuth("alice", "wrong") }, http.StatusUnauthorized, true},
+		{"throttled", "", func(r *http.Request) { r.SetBasicAuth("alice", "hunter2") }, http.StatusTooManyRequests, false},
+	} {
+		r := httptest.NewRequest("GET", "/app", nil)
+		r.Header.Set("Accept", c.accept)
+		if c.setAuth != nil {
+			c.setAuth(r)
+		}
+		w := httptest.NewRecorder()
+		mainHandler(w, r)
+		if w.Code != c.want || (w.Header().Get("WWW-Authenticate") != "") != c.wantChallenge {
+			t.Errorf("%s: %d, WWW-Authenticate %q. Expected %d", c.name, w.Code, w.Header().Get("WWW-Authenticate"), c.want)
+		}
+	}
+
+	//Verified credentials are remembered, but not past a change of the password.
+	if _, ok := basicAuthVerified.user("alice", "hunter2"); !ok {
+		t.Error("Verified credentials were not remembered")
+	}
+	alice, _ := um.Get("alice")
+	alice.SetPassword("correct horse battery staple")
+	um.Update(alice)
+	if _, ok := basicAuthVerified.user("alice", "hunter2"); ok {
+		t.Error("Remembered credentials still accepted after the password changed")
+	}
+}
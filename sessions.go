@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"net/http"
+	"sort"
+	"time"
+)
+
+//Sessions live in the cookie, so the server does not know them by itself.
+//Every login is recorded here under an ID kept in the session, so admins can see who is logged in from where.
+
+//A SessionInfo describes one login.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Client    string    `json:"client"`
+	UserAgent string    `json:"user_agent"`
+	Created   time.Time `json:"created"`
+}
+
+//The default lifetime of the session cookie. Records older than this are pruned.
+const sessionLifetime = 30 * 24 * time.Hour
+
+var BoltBucketSessions = []byte("sessions") //Session ID to SessionInfo
+
+func selectSessionRegistry() {
+	if err := ensureBuckets(stateDB, BoltBucketSessions); err != nil {
+		logger.WithField("err", err).Fatal("Unable to create session bucket.")
+	}
+}
+
+//registerSession records a login and remembers its ID in the session. The caller saves the session.
+func registerSession(session *sessions.Session, r *http.Request, username string) {
+	info := SessionInfo{
+		ID:        hex.EncodeToString(securecookie.GenerateRandomKey(16)),
+		User:      username,
+		Client:    clientAddress(r),
+		UserAgent: r.UserAgent(),
+		Created:   time.Now(),
+	}
+	data, err := json.Marshal(info)
+	if err == nil {
+		err = stateDB.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(BoltBucketSessions).Put([]byte(info.ID), data)
+		})
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Recording session")
+		return
+	}
+	session.Values["sid"] = info.ID
+}
+
+//endSession forgets the record of a session, as on logout.
+func endSession(session *sessions.Session) {
+	id, ok := session.Values["sid"].(string)
+	if !ok {
+		return
+	}
+	delete(session.Values, "sid")
+	stateDB.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketSessions).Delete([]byte(id))
+	})
+}
+
+//listSessions returns the recorded sessions, newest first, of one user or of everyone if username is empty.
+//Records that have outlived the cookie are pruned on the way.
+func listSessions(username string) (list []SessionInfo, err error) {
+	err = stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketSessions)
+		var stale [][]byte
+		b.ForEach(func(k, v []byte) error {
+			var info SessionInfo
+			if json.Unmarshal(v, &info) != nil || time.Since(info.Created) > sessionLifetime {
+				stale = append(stale, append([]byte(nil), k...))
+			} else if username == "" || info.User == username {
+				list = append(list, info)
+			}
+			return nil
+		})
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+	return
+}
+
+//deleteSessions forgets the sessions of a user, as when the account is deleted.
+func deleteSessions(username string) error {
+	list, err := listSessions(username)
+	if err != nil {
+		return err
+	}
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		for _, info := range list {
+			if err := tx.Bucket(BoltBucketSessions).Delete([]byte(info.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
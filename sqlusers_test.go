@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSQLUserManager_SQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	location := "sqlite3://" + filepath.Join(dir, "users.sqlite")
+
+	um, err := NewSQLUserManager(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := um.Register(User{Name: "alice"}, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.Register(User{Name: "alice"}, "hunter3"); err != ErrUserExists {
+		t.Errorf("Registering twice: %v. Expected ErrUserExists", err)
+	}
+	//As when another instance inserts the same name between the check and the insert.
+	if _, err := um.Exec(`INSERT INTO users (name, passhash, salt) VALUES ('alice', '', '')`); !isUniqueViolation(err) {
+		t.Errorf("Duplicate insert: %v. Expected a unique violation", err)
+	}
+	if err := um.Register(User{Name: "bob"}, "hunter3"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.Update(User{Name: "mallory"}); err != ErrUnknownUser {
+		t.Errorf("Updating unknown user: %v. Expected ErrUnknownUser", err)
+	}
+	um.Close()
+
+	//Reopening must not run the migrations again.
+	um, err = NewSQLUserManager(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+
+	if !um.Authenticate("alice", "hunter2") || um.Authenticate("alice", "hunter3") || um.Authenticate("carol", "") {
+		t.Error("Authentication failed")
+	}
+	alice, err := um.Get("alice")
+	if err != nil || !alice.Admin {
+		t.Errorf("First user not admin: %+v, %v", alice, err)
+	}
+	bob, err := um.Get("bob")
+	if err != nil || bob.Admin {
+		t.Errorf("Second user is admin: %+v, %v", bob, err)
+	}
+
+	legacy := User{Name: "bob", Salt: Key("saltsaltsaltsaltsaltsaltsaltsalt")}
+	legacy.Passhash = HashAndSalt("hunter3", legacy.Salt)
+	if err := um.Update(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if !um.Authenticate("bob", "hunter3") {
+		t.Fatal("Legacy hash rejected")
+	}
+	if bob, _ := um.Get("bob"); HashAlgorithm(bob.Passhash) != passwordHasher.Name() {
+		t.Errorf("Legacy hash was not upgraded, still %s", HashAlgorithm(bob.Passhash))
+	}
+
+	if err := um.Register(User{Name: "carol", Email: "carol@example.com", Pending: true}, "hunter4"); err != nil {
+		t.Fatal(err)
+	}
+	if um.Authenticate("carol", "hunter4") {
+		t.Error("Pending user authenticated")
+	}
+	if list, err := um.List(); err != nil || len(list) != 3 || list[2].Name != "carol" || !list[2].Pending || list[2].Email != "carol@example.com" {
+		t.Errorf("List = %+v, %v", list, err)
+	}
+
+	carol, _ := um.Get("carol")
+	if carol.CreatedAt.IsZero() {
+		t.Error("Registration time not recorded")
+	}
+	carol.Pending, carol.ExpiresAt = false, time.Now().Add(-time.Minute)
+	if err := um.Update(carol); err != nil {
+		t.Fatal(err)
+	}
+	if um.Authenticate("carol", "hunter4") {
+		t.Error("Expired user authenticated")
+	}
+	if carol, _ = um.Get("carol"); !carol.Expired() {
+		t.Errorf("Expiry not stored: %v", carol.ExpiresAt)
+	}
+	if err := um.Delete("carol"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.Delete("carol"); err != ErrUnknownUser {
+		t.Errorf("Deleting twice: %v. Expected ErrUnknownUser", err)
+	}
+}
+
+func TestSQLUserManager_ConcurrentStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	location := "sqlite3://" + filepath.Join(dir, "users.sqlite")
+
+	//Instances starting at once on a fresh database, each registering a first user.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			um, err := NewSQLUserManager(location)
+			if err != nil {
+				t.Error("Starting instance:", err)
+				return
+			}
+			defer um.Close()
+			if err := um.Register(User{Name: fmt.Sprint("user", i)}, "hunter2"); err != nil {
+				t.Error("Registering:", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	um, err := NewSQLUserManager(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	list, err := um.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admins := 0
+	for _, u := range list {
+		if u.Admin {
+			admins++
+		}
+	}
+	if len(list) != 4 || admins != 1 {
+		t.Errorf("%d users with %d admins. Expected 4 with 1", len(list), admins)
+	}
+}
+
+func TestSQLUserManager_Rebind(t *testing.T) {
+	um := &SQLUserManager{driver: "postgres"}
+	if q := um.rebind("UPDATE users SET a = ?, b = ? WHERE name = ?"); q != "UPDATE users SET a = $1, b = $2 WHERE name = $3" {
+		t.Error("Unexpected query", q)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"time"
+)
+
+//stateDB holds everything authprox keeps besides the users themselves, one bucket per feature.
+//When the users are kept in Bolt the same database is used, otherwise a separate file is opened.
+var stateDB *bolt.DB
+
+//boltOptions makes a second authprox, like a user command while the server runs, give up on a locked database
+//instead of waiting forever.
+var boltOptions = &bolt.Options{Timeout: 5 * time.Second}
+
+func openStateDB() {
+	if bum, ok := users.(*BoltUserManager); ok {
+		stateDB = bum.DB
+		return
+	}
+	var err error
+	stateDB, err = bolt.Open(config.Database.State, 0600, boltOptions)
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"err":  err,
+			"file": config.Database.State,
+		}).Fatal("Unable to open state database.")
+	}
+}
+
+//ensureBuckets creates the top-level buckets a feature needs.
+func ensureBuckets(db *bolt.DB, names ...[]byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range names {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+//PasswordStrength estimates how hard a password is to guess, in the spirit of zxcvbn.
+//The password is split into the cheapest sequence of patterns an attacker would try: common passwords and words,
+//including l33t spellings, keyboard runs, sequences like abcd or 4321, repeated characters and years.
+//Whatever is left is brute forced character by character.
+//The score goes from 0 (guessed within a thousand tries) to 4 (more than ten billion).
+func PasswordStrength(password string) int {
+	guesses := passwordGuessesLog10(password)
+	for score, limit := range []float64{3, 6, 8, 10} {
+		if guesses < limit {
+			return score
+		}
+	}
+	return 4
+}
+
+//passwordGuessesLog10 is the base 10 logarithm of the estimated number of guesses needed.
+func passwordGuessesLog10(password string) float64 {
+	pw := []rune(password)
+	if len(pw) > 100 {
+		pw = pw[:100] //Long enough to be strong, and keeps the estimate quick
+	}
+	n := len(pw)
+
+	//best[j] is the cheapest way to guess the first j characters.
+	best := make([]float64, n+1)
+	for j := 1; j <= n; j++ {
+		best[j] = best[j-1] + math.Log10(runeCardinality(pw[j-1]))
+		for i := 0; i < j; i++ {
+			if g := patternGuesses(pw[i:j]); g > 0 && best[i]+math.Log10(g) < best[j] {
+				best[j] = best[i] + math.Log10(g)
+			}
+		}
+	}
+	return best[n]
+}
+
+//runeCardinality is the size of the character class a brute force attack would try for the rune.
+func runeCardinality(r rune) float64 {
+	switch {
+	case r >= '0' && r <= '9':
+		return 10
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		return 26
+	case r < 128:
+		return 33
+	}
+	return 100
+}
+
+//patternGuesses is the number of guesses for a segment matching a known pattern, or 0 if it matches none.
+func patternGuesses(seg []rune) float64 {
+	if len(seg) < 3 {
+		return 0
+	}
+	var guesses float64
+	try := func(g float64) {
+		if g > 0 && (guesses == 0 || g < guesses) {
+			guesses = g
+		}
+	}
+	try(dictionaryGuesses(seg))
+	try(repeatGuesses(seg))
+	try(sequenceGuesses(seg))
+	try(keyboardGuesses(seg))
+	try(yearGuesses(seg))
+	return guesses
+}
+
+var unleet = strings.NewReplacer("4", "a", "@", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t", "+", "t")
+
+func dictionaryGuesses(seg []rune) float64 {
+	word := string(seg)
+	lower := strings.ToLower(word)
+	var g float64
+	if rank, ok := commonPasswordRank[lower]; ok {
+		g = float64(rank)
+	} else if rank, ok := commonPasswordRank[unleet.Replace(lower)]; ok {
+		g = float64(rank) * 4 //Few people bother with more than the usual substitutions
+	} else {
+		return 0
+	}
+	if word != lower {
+		if word == strings.ToUpper(word) || word == string(unicode.ToUpper(seg[0]))+strings.ToLower(string(seg[1:])) {
+			g *= 2 //Capitalized or all upper case
+		} else {
+			g *= 20
+		}
+	}
+	return g
+}
+
+func repeatGuesses(seg []rune) float64 {
+	for _, r := range seg[1:] {
+		if r != seg[0] {
+			return 0
+		}
+	}
+	return runeCardinality(seg[0]) * float64(len(seg))
+}
+
+func sequenceGuesses(seg []rune) float64 {
+	delta := seg[1] - seg[0]
+	if delta != 1 && delta != -1 {
+		return 0
+	}
+	for i := 2; i < len(seg); i++ {
+		if seg[i]-seg[i-1] != delta {
+			return 0
+		}
+	}
+	start := 26.0
+	switch seg[0] {
+	case 'a', 'A', 'z', 'Z', '0', '1', '9':
+		start = 4
+	}
+	if delta < 0 {
+		start *= 2
+	}
+	return start * float64(len(seg))
+}
+
+var keyboardRows = []string{"qwertyuiop", "asdfghjkl", "zxcvbnm", "1234567890", "!@#$%^&*()", "qazwsxedcrfvtgbyhnujmikolp"}
+
+func keyboardGuesses(seg []rune) float64 {
+	if len(seg) < 4 {
+		return 0
+	}
+	s := strings.ToLower(string(seg))
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(reverseString(row), s) {
+			return 40 * float64(len(seg))
+		}
+	}
+	return 0
+}
+
+func yearGuesses(seg []rune) float64 {
+	s := string(seg)
+	if len(s) == 4 && (strings.HasPrefix(s, "19") || strings.HasPrefix(s, "20")) && strings.Trim(s, "0123456789") == "" {
+		return 130
+	}
+	return 0
+}
+
+func reverseString(s string) string {
+	r := []rune(s)
+	for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+		r[i], r[j] = r[j], r[i]
+	}
+	return string(r)
+}
+
+//The most common passwords and password words, most common first.
+var commonPasswords = strings.Fields(`
+	password 123456 qwerty letmein dragon monkey football baseball welcome admin login iloveyou sunshine princess
+	master shadow superman batman trustno1 starwars freedom whatever michael jennifer jordan hunter ranger buster
+	soccer hockey killer george charlie andrew thomas jessica pepper daniel summer winter spring autumn secret love
+	hello test guest root changeme default access flower computer internet cheese chocolate orange banana apple
+	purple silver golden tigger ginger maggie cookie matrix mustang harley corvette yankees lakers liverpool arsenal
+	chelsea google facebook samsung london paris berlin america canada family forever friends blessed angel jesus
+	heaven money dollar pass secure passwd abc123 asdf zxcv qazwsx monday friday august september october
+	november december january february march april june july cat dog fish bird horse tiger lion bear wolf eagle
+	red blue green black white yellow pink star moon sun sky fire water earth heart baby boy girl man woman
+	king queen prince lucky happy sexy hot cool super magic music rock jazz game play player gamer ninja pirate
+	dragons wizard hacker mother father sister brother school college work office company server network user
+`)
+
+var commonPasswordRank = func() map[string]int {
+	m := make(map[string]int, len(commonPasswords))
+	for i, w := range commonPasswords {
+		if _, ok := m[w]; !ok {
+			m[w] = i + 1
+		}
+	}
+	return m
+}()
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//A Throttle slows down password guessing.
+//Failed logins are counted per username and per client address. Every failure doubles the time before the next
+//attempt is accepted, and once a threshold is reached the username or address is locked out for a while.
+//An attempt is counted as a failure before the password is checked, in the same transaction that checks the wait,
+//so requests sent in parallel can not all get past the check. Attempts that did not fail are released afterwards.
+//The counters live in Bolt, so restarting authprox does not hand out a fresh set of guesses.
+type Throttle struct {
+	db               *bolt.DB
+	Threshold        int           //Failures before a username is locked out
+	AddressThreshold int           //Failures before a client address is locked out
+	Backoff          time.Duration //Delay after the first failure, doubled with every further one
+	Lockout          time.Duration //How long a lockout lasts. Failures older than this are forgotten
+	now              func() time.Time
+}
+
+//A throttleRecord is the state kept for one username or address.
+type throttleRecord struct {
+	Failures    int
+	Last        time.Time
+	LockedUntil time.Time
+}
+
+//A Lockout is a username or address that may not log in at the moment.
+type Lockout struct {
+	Key   string //user/<name> or address/<ip>
+	Until time.Time
+}
+
+var BoltBucketThrottle = []byte("throttle")
+
+const (
+	defaultThrottleThreshold = 5
+	defaultAddressThreshold  = 20
+	defaultThrottleBackoff   = time.Second
+	defaultThrottleLockout   = 15 * time.Minute
+	maxThrottleDelay         = time.Minute //The backoff never grows beyond this before the lockout kicks in
+)
+
+var throttle *Throttle
+
+func selectThrottle() {
+	var err error
+	throttle, err = NewThrottle(stateDB)
+	if err != nil {
+		logger.WithField("err", err).Fatal("Unable to create throttle bucket.")
+	}
+	c := config.Throttle
+	if c.Threshold > 0 {
+		throttle.Threshold = c.Threshold
+	}
+	if c.AddressThreshold > 0 {
+		throttle.AddressThreshold = c.AddressThreshold
+	}
+	if c.Backoff > 0 {
+		throttle.Backoff = time.Duration(c.Backoff)
+	}
+	if c.Lockout > 0 {
+		throttle.Lockout = time.Duration(c.Lockout)
+	}
+}
+
+func NewThrottle(db *bolt.DB) (*Throttle, error) {
+	if err := ensureBuckets(db, BoltBucketThrottle); err != nil {
+		return nil, err
+	}
+	return &Throttle{
+		db:               db,
+		Threshold:        defaultThrottleThreshold,
+		AddressThreshold: defaultAddressThreshold,
+		Backoff:          defaultThrottleBackoff,
+		Lockout:          defaultThrottleLockout,
+		now:              time.Now,
+	}, nil
+}
+
+func userThrottleKey(username string) string { return "user/" + username }
+func addressThrottleKey(addr string) string  { return "address/" + addr }
+
+//clientAddress is the IP address of the client, without the port.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//wait is how long the record forbids another attempt, and whether that is because of a lockout.
+func (t *Throttle) wait(rec throttleRecord, now time.Time) (time.Duration, bool) {
+	if now.Before(rec.LockedUntil) {
+		return rec.LockedUntil.Sub(now), true
+	}
+	if rec.Failures == 0 || now.Sub(rec.Last) > t.Lockout {
+		return 0, false
+	}
+	delay := maxThrottleDelay
+	if rec.Failures < 32 && t.Backoff<<uint(rec.Failures-1) < delay {
+		delay = t.Backoff << uint(rec.Failures-1)
+	}
+	if next := rec.Last.Add(delay); now.Before(next) {
+		return next.Sub(now), false
+	}
+	return 0, false
+}
+
+func (t *Throttle) get(b *bolt.Bucket, key string) (rec throttleRecord) {
+	if data := b.Get([]byte(key)); data != nil {
+		json.Unmarshal(data, &rec)
+	}
+	return
+}
+
+//Check reports how long the username and address must wait before trying again. Zero means go ahead.
+//Locked is set when the wait is a lockout rather than the backoff between attempts.
+func (t *Throttle) Check(username, addr string) (wait time.Duration, locked bool) {
+	now := t.now()
+	t.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketThrottle)
+		for _, key := range []string{userThrottleKey(username), addressThrottleKey(addr)} {
+			if w, l := t.wait(t.get(b, key), now); w > wait || (l && !locked) {
+				wait, locked = w, l || locked
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (t *Throttle) put(b *bolt.Bucket, key string, rec throttleRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func (t *Throttle) thresholds(username, addr string) map[string]int {
+	return map[string]int{
+		userThrottleKey(username): t.Threshold,
+		addressThrottleKey(addr):  t.AddressThreshold,
+	}
+}
+
+//Attempt reports the wait as Check does. If there is none, the attempt is allowed and counted as a failure right away.
+//Call Release once the attempt turns out not to have failed, as after the right password.
+func (t *Throttle) Attempt(username, addr string) (wait time.Duration, locked bool) {
+	now := t.now()
+	err := t.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketThrottle)
+		for key := range t.thresholds(username, addr) {
+			if w, l := t.wait(t.get(b, key), now); w > wait || (l && !locked) {
+				wait, locked = w, l || locked
+			}
+		}
+		if wait > 0 {
+			return nil
+		}
+		for key, threshold := range t.thresholds(username, addr) {
+			rec := t.get(b, key)
+			if now.Sub(rec.Last) > t.Lockout {
+				rec.Failures = 0
+			}
+			rec.Failures++
+			rec.Last = now
+			if rec.Failures >= threshold {
+				rec.LockedUntil = now.Add(t.Lockout)
+				logger.WithFields(logrus.Fields{"key": key, "until": rec.LockedUntil}).Warn("Locked out after repeated failed logins")
+			}
+			if err := t.put(b, key, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": username, "client": addr, "err": err}).Error("Recording login attempt")
+	}
+	return
+}
+
+//Release takes back an attempt that did not fail, along with the lockout it may have started.
+func (t *Throttle) Release(username, addr string) {
+	err := t.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketThrottle)
+		for key, threshold := range t.thresholds(username, addr) {
+			rec := t.get(b, key)
+			if rec.Failures == 0 {
+				continue
+			}
+			if rec.Failures >= threshold {
+				rec.LockedUntil = time.Time{}
+			}
+			rec.Failures--
+			if err := t.put(b, key, rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": username, "client": addr, "err": err}).Error("Releasing login attempt")
+	}
+}
+
+//Succeed forgets the failures of a username once it has logged in.
+//The address keeps its count, so one valid account can not be used to reset it.
+func (t *Throttle) Succeed(username string) {
+	t.Unlock(userThrottleKey(username))
+}
+
+//Unlock removes all failures and any lockout of a key as listed by Lockouts.
+func (t *Throttle) Unlock(key string) error {
+	return t.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketThrottle).Delete([]byte(key))
+	})
+}
+
+//Prune deletes the records that no longer slow anybody down: the last failure is older than the lockout
+//and any lockout has ended. It returns how many were deleted.
+func (t *Throttle) Prune() (n int, err error) {
+	now := t.now()
+	err = t.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketThrottle)
+		var old [][]byte
+		b.ForEach(func(k, v []byte) error {
+			var rec throttleRecord
+			if json.Unmarshal(v, &rec) != nil {
+				return nil //Kept for someone to look at
+			}
+			if now.Sub(rec.Last) > t.Lockout && !now.Before(rec.LockedUntil) {
+				old = append(old, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		for _, k := range old {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	return
+}
+
+//pruneThrottle prunes once an hour for as long as the server runs.
+func pruneThrottle() {
+	for ; ; time.Sleep(time.Hour) {
+		n, err := throttle.Prune()
+		if err != nil {
+			logger.WithField("err", err).Error("Pruning throttle")
+		} else if n > 0 {
+			logger.WithField("records", n).Info("Pruned throttle")
+		}
+	}
+}
+
+//Lockouts lists the usernames and addresses that are currently locked out.
+func (t *Throttle) Lockouts() (list []Lockout, err error) {
+	now := t.now()
+	err = t.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(BoltBucketThrottle).ForEach(func(k, v []byte) error {
+			var rec throttleRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return err
+			}
+			if now.Before(rec.LockedUntil) {
+				list = append(list, Lockout{Key: string(k), Until: rec.LockedUntil})
+			}
+			return nil
+		})
+	})
+	return
+}
+
+//throttleMessage explains to the user why the login was refused.
+func throttleMessage(wait time.Duration, locked bool) string {
+	if locked {
+		minutes := int((wait + time.Minute - 1) / time.Minute)
+		if minutes == 1 {
+			return "Too many failed logins. Please try again in a minute."
+		}
+		return fmt.Sprintf("Too many failed logins. Please try again in %d minutes.", minutes)
+	}
+	return fmt.Sprintf("Please wait %d seconds before trying again.", int((wait+time.Second-1)/time.Second))
+}
+
+//setRetryAfter tells the client the wait in whole seconds, rounded up.
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", fmt.Sprint(int((wait+time.Second-1)/time.Second)))
+}
+
+//renderThrottled answers a login attempt that is not allowed yet.
+func renderThrottled(w http.ResponseWriter, page Page, wait time.Duration, locked bool) {
+	page.Message = throttleMessage(wait, locked)
+	setRetryAfter(w, wait)
+	w.WriteHeader(http.StatusTooManyRequests)
+	renderer.Render(w, page)
+}
+
+var lockoutsContent = template.Must(template.New("lockouts").Parse(`
+	<table>
+	{{range .Lockouts}}
+		<tr>
+			<td>{{.Key}}</td>
+			<td>Until {{.Until.Format "2006-01-02 15:04:05"}}</td>
+			<td>
+				<form method="POST" action="/proxy/admin/unlock">
+					<input type="hidden" name="key" value="{{.Key}}">
+					<input type="hidden" name="csrf" value="{{$.CSRF}}">
+					<input type="submit" value="Unlock">
+				</form>
+			</td>
+		</tr>
+	{{else}}
+		<tr><td>Nobody is locked out.</td></tr>
+	{{end}}
+	</table>`))
+
+func getAdminLockouts(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminUser(r); !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	list, err := throttle.Lockouts()
+	if err != nil {
+		logger.WithField("err", err).Error("Listing lockouts")
+	}
+	renderer.Render(w, Page{
+		Title:   "Lockouts",
+		Content: renderContent(lockoutsContent, map[string]interface{}{"CSRF": csrfToken(w, r), "Lockouts": list}),
+	})
+}
+
+func postAdminUnlock(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	key := r.PostFormValue("key")
+	if !strings.HasPrefix(key, "user/") && !strings.HasPrefix(key, "address/") {
+		http.Error(w, "No such lockout.", http.StatusBadRequest)
+		return
+	}
+	if err := throttle.Unlock(key); err != nil {
+		http.Error(w, "Unable to unlock: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "key": key}).Info("Lockout lifted")
+	audit(r, EventAdmin, strings.TrimPrefix(key, "user/"), admin.Name, "Lifted the lockout of "+key)
+	http.Redirect(w, r, "/proxy/admin/lockouts", http.StatusSeeOther)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	th, err := NewThrottle(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2016, 1, 1, 12, 0, 0, 0, time.UTC)
+	th.now = func() time.Time { return now }
+	th.Threshold, th.AddressThreshold = 3, 5
+
+	if wait, _ := th.Check("alice", "10.0.0.1"); wait != 0 {
+		t.Fatalf("Fresh user has to wait %v", wait)
+	}
+	if wait, _ := th.Attempt("alice", "10.0.0.1"); wait != 0 {
+		t.Fatalf("First attempt has to wait %v", wait)
+	}
+	if wait, locked := th.Attempt("alice", "10.0.0.1"); wait != time.Second || locked {
+		t.Errorf("Attempt in parallel with the first: wait %v, locked %v. Expected 1s backoff", wait, locked)
+	}
+	now = now.Add(time.Second)
+	th.Attempt("alice", "10.0.0.1")
+	if wait, _ := th.Check("alice", "10.0.0.2"); wait != 2*time.Second {
+		t.Errorf("After two failures: wait %v. Expected 2s backoff", wait)
+	}
+	now = now.Add(2 * time.Second)
+	th.Attempt("alice", "10.0.0.1")
+	if wait, locked := th.Check("alice", "10.0.0.1"); !locked || wait != th.Lockout {
+		t.Errorf("After three failures: wait %v, locked %v. Expected lockout", wait, locked)
+	}
+	if wait, locked := th.Check("bob", "10.0.0.2"); wait != 0 || locked {
+		t.Error("Lockout of alice affects bob on another address")
+	}
+
+	list, err := th.Lockouts()
+	if err != nil || len(list) != 1 || list[0].Key != "user/alice" {
+		t.Errorf("Lockouts: %v, %v. Expected user/alice", list, err)
+	}
+
+	//The lockout is kept in the database, so a new throttle sees it.
+	th2, _ := NewThrottle(db)
+	th2.now = th.now
+	if _, locked := th2.Check("alice", "10.0.0.3"); !locked {
+		t.Error("Lockout lost when reopening")
+	}
+
+	if err := th.Unlock("user/alice"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := th.Check("alice", "10.0.0.3"); wait != 0 {
+		t.Errorf("After unlock alice still has to wait %v", wait)
+	}
+
+	//Failures for many usernames from one address lock out the address.
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		now = now.Add(time.Minute)
+		th.Attempt(name, "10.0.0.9")
+	}
+	if _, locked := th.Check("alice", "10.0.0.9"); !locked {
+		t.Error("Address not locked out after repeated failures")
+	}
+	now = now.Add(th.Lockout + time.Second)
+	if wait, _ := th.Check("alice", "10.0.0.9"); wait != 0 {
+		t.Errorf("Lockout did not expire, wait %v", wait)
+	}
+
+	//An attempt with the right password is taken back, lockout and all.
+	now = now.Add(th.Lockout + time.Second)
+	for _, step := range []time.Duration{0, time.Second, 2 * time.Second} {
+		now = now.Add(step)
+		th.Attempt("bob", "10.0.0.4")
+	}
+	th.Release("bob", "10.0.0.4")
+	if _, locked := th.Check("bob", "10.0.0.4"); locked {
+		t.Error("Still locked out after the attempt that caused the lockout was released")
+	}
+
+	//Records nobody is held back by any more are pruned.
+	now = now.Add(time.Minute)
+	th.Attempt("carol", "10.0.0.5")
+	if _, err := th.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := th.Check("carol", "10.0.0.5"); wait == 0 {
+		t.Error("Pruned a failure that still counts")
+	}
+	now = now.Add(th.Lockout + time.Second)
+	if _, err := th.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket(BoltBucketThrottle).Stats().KeyN; n != 0 {
+			t.Errorf("%d records left after pruning", n)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/securecookie"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//API tokens let scripts act as a user without the password. A token looks like apx_<id>_<secret>.
+//Only a hash of the secret is stored, so the token is shown once when it is made and can not be recovered.
+
+//An APIToken is the stored part of a token.
+type APIToken struct {
+	ID       string
+	User     string
+	Name     string
+	Scopes   []string
+	Hash     Key //SHA-256 of the secret
+	Created  time.Time
+	Expires  time.Time //Zero if the token does not expire
+	LastUsed time.Time
+}
+
+const (
+	ScopeAdmin = "admin" //The admin API under /proxy/api/v1
+	ScopeProxy = "proxy" //The services behind authprox, instead of the session cookie
+
+	tokenPrefix = "apx"
+
+	tokenUseResolution = time.Minute //LastUsed is written at most this often, so every request does not write to the database
+)
+
+var (
+	BoltBucketTokens     = []byte("tokens")    //Sub-bucket per user, token ID to APIToken
+	BoltBucketTokenIndex = []byte("token_ids") //Token ID to user
+)
+
+var (
+	ErrInvalidToken = errors.New("The token is invalid, expired or revoked")
+	ErrTokenExpiry  = errors.New("The number of days must be a positive number.")
+)
+
+func selectAPITokens() {
+	if err := ensureBuckets(stateDB, BoltBucketTokens, BoltBucketTokenIndex); err != nil {
+		logger.WithField("err", err).Fatal("Unable to create token buckets.")
+	}
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (t APIToken) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+func tokenHash(secret string) Key {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+//newAPIToken makes and stores a token for a user. The returned string is the token to hand out.
+func newAPIToken(username, name string, scopes []string, expires time.Time) (string, APIToken, error) {
+	secret := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	t := APIToken{
+		ID:      hex.EncodeToString(securecookie.GenerateRandomKey(8)),
+		User:    username,
+		Name:    name,
+		Scopes:  scopes,
+		Hash:    tokenHash(secret),
+		Created: time.Now(),
+		Expires: expires,
+	}
+	if err := putAPIToken(t); err != nil {
+		return "", t, err
+	}
+	return tokenPrefix + "_" + t.ID + "_" + secret, t, nil
+}
+
+func putAPIToken(t APIToken) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(BoltBucketTokens).CreateBucketIfNotExists([]byte(t.User))
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(t.ID), data); err != nil {
+			return err
+		}
+		return tx.Bucket(BoltBucketTokenIndex).Put([]byte(t.ID), []byte(t.User))
+	})
+}
+
+//checkAPIToken returns the stored token a presented one belongs to, and records that it was used.
+func checkAPIToken(token string) (t APIToken, err error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != tokenPrefix {
+		return t, ErrInvalidToken
+	}
+	err = stateDB.View(func(tx *bolt.Tx) error {
+		user := tx.Bucket(BoltBucketTokenIndex).Get([]byte(parts[1]))
+		if user == nil {
+			return ErrInvalidToken
+		}
+		b := tx.Bucket(BoltBucketTokens).Bucket(user)
+		if b == nil {
+			return ErrInvalidToken
+		}
+		data := b.Get([]byte(parts[1]))
+		if data == nil || json.Unmarshal(data, &t) != nil {
+			return ErrInvalidToken
+		}
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if subtle.ConstantTimeCompare(t.Hash, tokenHash(parts[2])) != 1 || t.Expired() {
+		return APIToken{}, ErrInvalidToken
+	}
+	if now := time.Now(); now.Sub(t.LastUsed) >= tokenUseResolution {
+		t.LastUsed = now
+		if err := touchAPIToken(t); err != nil {
+			logger.WithFields(logrus.Fields{"user": t.User, "token": t.ID, "err": err}).Error("Updating token last use")
+		}
+	}
+	return t, nil
+}
+
+//touchAPIToken stores the LastUsed of a token, unless the token has been revoked in the meantime.
+func touchAPIToken(t APIToken) error {
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketTokens).Bucket([]byte(t.User))
+		if b == nil {
+			return nil
+		}
+		var stored APIToken
+		if data := b.Get([]byte(t.ID)); data == nil || json.Unmarshal(data, &stored) != nil {
+			return nil
+		}
+		stored.LastUsed = t.LastUsed
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(t.ID), data)
+	})
+}
+
+//proxyTokenUser returns the user of a token that may be used with the proxy. An account that may not log in
+//gives the error inactiveReason does.
+func proxyTokenUser(token string) (User, error) {
+	t, err := checkAPIToken(token)
+	if err != nil {
+		return User{}, err
+	}
+	if !t.HasScope(ScopeProxy) {
+		return User{}, ErrInvalidToken
+	}
+	user, err := users.Get(t.User)
+	switch {
+	case err == ErrUnknownUser:
+		return User{}, ErrInvalidToken
+	case err != nil:
+		return User{}, err
+	}
+	return user, user.inactiveReason()
+}
+
+func userAPITokens(username string) (list []APIToken, err error) {
+	err = stateDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketTokens).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var t APIToken
+			if err := json.Unmarshal(v, &t); err != nil {
+				return err
+			}
+			list = append(list, t)
+			return nil
+		})
+	})
+	return
+}
+
+func revokeAPIToken(username, id string) error {
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketTokens).Bucket([]byte(username))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return ErrInvalidToken
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket(BoltBucketTokenIndex).Delete([]byte(id))
+	})
+}
+
+//deleteAPITokens revokes all tokens of a user, as when the account is deleted.
+func deleteAPITokens(username string) error {
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketTokens).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		index := tx.Bucket(BoltBucketTokenIndex)
+		if err := b.ForEach(func(k, v []byte) error { return index.Delete(k) }); err != nil {
+			return err
+		}
+		return tx.Bucket(BoltBucketTokens).DeleteBucket([]byte(username))
+	})
+}
+
+//tokensContent lists the tokens of a user on the admin and the account pages. The page posts new tokens to Action
+//and revocations to Action/revoke. With Scopes set the scopes are shown, and can be picked for a new token.
+var tokensContent = template.Must(template.New("tokens").Parse(`
+	{{with .New}}<p>Copy your new token now, it will not be shown again: <code>{{.}}</code></p>{{end}}
+	<p>{{.Intro}}</p>
+	<table{{with .Class}} class="{{.}}"{{end}}>
+	{{range .Tokens}}
+		<tr>
+			<td>{{.Name}}</td>
+			{{- if $.Scopes}}
+			<td>{{range $i, $s := .Scopes}}{{if $i}}, {{end}}{{$s}}{{end}}</td>
+			{{- end}}
+			<td>
+				Made {{.Created.Format "2006-01-02"}}
+				{{- if not .Expires.IsZero}}, expires {{.Expires.Format "2006-01-02"}}{{end}}
+				{{- if not .LastUsed.IsZero}}, last used {{.LastUsed.Format "2006-01-02 15:04"}}{{end}}
+			</td>
+			<td>
+				<form method="POST" action="{{$.Action}}/revoke">
+					<input type="hidden" name="id" value="{{.ID}}">
+					<input type="hidden" name="csrf" value="{{$.CSRF}}">
+					<input type="submit" value="Revoke">
+				</form>
+			</td>
+		</tr>
+	{{else}}
+		<tr><td>{{.Empty}}</td></tr>
+	{{end}}
+	</table>
+	<form method="POST" action="{{.Action}}">
+		<input type="hidden" name="csrf" value="{{.CSRF}}">
+		<input type="text" name="name" placeholder="{{.Placeholder}}" required>
+		<input type="number" name="days" min="1" placeholder="Days valid, empty for no expiry">
+		{{- if .Scopes}}
+		<label><input type="checkbox" name="scope" value="proxy" checked> Services behind authprox</label>
+		{{if .Admin}}<label><input type="checkbox" name="scope" value="admin"> Admin API</label>{{end}}
+		{{- end}}
+		<input type="submit" value="New token">
+	</form>`))
+
+func renderAdminTokens(w http.ResponseWriter, r *http.Request, admin User, newToken, message string) {
+	var list []APIToken
+	all, err := userAPITokens(admin.Name)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": admin.Name, "err": err}).Error("Listing tokens")
+	}
+	for _, t := range all {
+		if t.HasScope(ScopeAdmin) {
+			list = append(list, t)
+		}
+	}
+	renderer.Render(w, Page{
+		Title: "API Tokens",
+		Content: renderContent(tokensContent, map[string]interface{}{
+			"New":         newToken,
+			"Tokens":      list,
+			"CSRF":        csrfToken(w, r),
+			"Action":      "/proxy/admin/tokens",
+			"Class":       "admin",
+			"Intro":       template.HTML(`Tokens for the admin API under <code>/proxy/api/v1</code>. Send them as <code>Authorization: Bearer &lt;token&gt;</code>.`),
+			"Empty":       "You have no API tokens.",
+			"Placeholder": "Name, like 'Onboarding script'",
+		}),
+		Message: message,
+	})
+}
+
+func getAdminTokens(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	renderAdminTokens(w, r, admin, "", "")
+}
+
+func postAdminTokens(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	expires, err := parseTokenExpiry(r.PostFormValue("days"))
+	if err != nil {
+		renderAdminTokens(w, r, admin, "", err.Error())
+		return
+	}
+	token, t, err := newAPIToken(admin.Name, r.PostFormValue("name"), []string{ScopeAdmin}, expires)
+	if err != nil {
+		http.Error(w, "Unable to create token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "token": t.ID, "name": t.Name}).Info("API token created")
+	audit(r, EventAdmin, admin.Name, admin.Name, "Created API token "+t.ID)
+	renderAdminTokens(w, r, admin, token, "")
+}
+
+func postAdminTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	admin, ok := adminUser(r)
+	if !ok {
+		http.Error(w, "Only admins may do this.", http.StatusForbidden)
+		return
+	}
+	r.ParseForm()
+	id := r.PostFormValue("id")
+	if err := revokeAPIToken(admin.Name, id); err != nil {
+		http.Error(w, "No such token.", http.StatusNotFound)
+		return
+	}
+	logger.WithFields(logrus.Fields{"admin": admin.Name, "token": id}).Info("API token revoked")
+	audit(r, EventAdmin, admin.Name, admin.Name, "Revoked API token "+id)
+	http.Redirect(w, r, "/proxy/admin/tokens", http.StatusSeeOther)
+}
+
+//parseTokenExpiry reads the days a new token is valid from a form. Empty means the token does not expire.
+func parseTokenExpiry(days string) (time.Time, error) {
+	if days == "" {
+		return time.Time{}, nil
+	}
+	n, err := strconv.Atoi(days)
+	if err != nil || n < 1 {
+		return time.Time{}, ErrTokenExpiry
+	}
+	return time.Now().AddDate(0, 0, n), nil
+}
+
+//Personal access tokens are the tokens users make for themselves on the account page, mostly to use the proxy from
+//scripts and CI without their password. They are the same API tokens, so admins can also give them the admin scope.
+
+func renderAccountTokens(w http.ResponseWriter, r *http.Request, user User, newToken, message string) {
+	list, err := userAPITokens(user.Name)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Listing tokens")
+	}
+	renderer.Render(w, Page{
+		Title: "Access Tokens",
+		Content: renderContent(tokensContent, map[string]interface{}{
+			"New":    newToken,
+			"Tokens": list,
+			"Admin":  user.Admin,
+			"CSRF":   csrfToken(w, r),
+			"Action": "/proxy/account/tokens",
+			"Scopes": true,
+			"Intro": template.HTML(`Send a token as <code>Authorization: Bearer &lt;token&gt;</code> instead of logging in, like
+	<code>curl -H "Authorization: Bearer &lt;token&gt;"</code>.`),
+			"Empty":       "You have no access tokens.",
+			"Placeholder": "Name, like 'CI deploy job'",
+		}),
+		Message: message,
+	})
+}
+
+func getAccountTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	renderAccountTokens(w, r, user, "", "")
+}
+
+func postAccountTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if name == "" {
+		renderAccountTokens(w, r, user, "", "The token needs a name.")
+		return
+	}
+	expires, err := parseTokenExpiry(r.PostFormValue("days"))
+	if err != nil {
+		renderAccountTokens(w, r, user, "", err.Error())
+		return
+	}
+	var scopes []string
+	for _, s := range r.PostForm["scope"] {
+		if s != ScopeProxy && !(s == ScopeAdmin && user.Admin) {
+			renderAccountTokens(w, r, user, "", "You may not give a token the scope "+s+".")
+			return
+		}
+		scopes = append(scopes, s)
+	}
+	if len(scopes) == 0 {
+		renderAccountTokens(w, r, user, "", "The token needs at least one scope.")
+		return
+	}
+	token, t, err := newAPIToken(user.Name, name, scopes, expires)
+	if err != nil {
+		http.Error(w, "Unable to create token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.WithFields(logrus.Fields{"user": user.Name, "token": t.ID, "name": t.Name, "scopes": t.Scopes}).Info("Personal access token created")
+	audit(r, EventToken, user.Name, "", "Created token "+t.ID+" for "+strings.Join(t.Scopes, ", "))
+	renderAccountTokens(w, r, user, token, "")
+}
+
+func postAccountTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	id := r.PostFormValue("id")
+	if err := revokeAPIToken(user.Name, id); err != nil {
+		http.Error(w, "No such token.", http.StatusNotFound)
+		return
+	}
+	logger.WithFields(logrus.Fields{"user": user.Name, "token": id}).Info("Personal access token revoked")
+	audit(r, EventToken, user.Name, "", "Revoked token "+id)
+	http.Redirect(w, r, "/proxy/account/tokens", http.StatusSeeOther)
+}
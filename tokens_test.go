@@ -0,0 +1,75 @@
+package main
+
+import (
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestAccountTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	um, err := NewBoltUserManager(filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	users, stateDB = um, um.DB
+	selectAPITokens()
+	store = sessions.NewCookieStore(securecookie.GenerateRandomKey(64))
+	pages, renderer = constPages, &TemplateRenderer{}
+	um.Register(User{Name: "root"}, "correct horse battery staple") //The first user is made admin
+	um.Register(User{Name: "alice"}, "hunter2")
+
+	rec := httptest.NewRecorder()
+	session, _ := store.Get(httptest.NewRequest("GET", "/", nil), "auth")
+	session.Values["loggedin"] = true
+	session.Values["user"] = "alice"
+	session.Save(httptest.NewRequest("GET", "/", nil), rec)
+	cookie := rec.Header().Get("Set-Cookie")
+	post := func(h http.HandlerFunc, form string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/proxy/account/tokens", strings.NewReader(form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.Header.Set("Cookie", cookie)
+		w := httptest.NewRecorder()
+		h(w, r)
+		return w
+	}
+
+	if w := post(postAccountTokens, "name=CI&scope=admin"); strings.Contains(w.Body.String(), "<code>apx_") {
+		t.Error("A user who is not an admin made a token with the admin scope")
+	}
+	w := post(postAccountTokens, "name=CI&days=30&scope=proxy")
+	token := regexp.MustCompile(`<code>(apx_[^<]+)</code>`).FindStringSubmatch(w.Body.String())
+	if token == nil {
+		t.Fatalf("No token shown: %s", w.Body)
+	}
+	tok, err := checkAPIToken(token[1])
+	if err != nil || tok.Name != "CI" || tok.Expires.IsZero() || !tok.HasScope(ScopeProxy) {
+		t.Fatalf("Made token %+v, %v", tok, err)
+	}
+	if user, err := proxyTokenUser(token[1]); err != nil || user.Name != "alice" {
+		t.Errorf("Proxy accepted token as %q, %v", user.Name, err)
+	}
+
+	if w := post(postAccountTokenRevoke, "id="+tok.ID); w.Code != http.StatusSeeOther {
+		t.Errorf("Revoking: %d", w.Code)
+	}
+	if _, err := proxyTokenUser(token[1]); err != ErrInvalidToken {
+		t.Errorf("Revoked token: %v. Expected ErrInvalidToken", err)
+	}
+	touchAPIToken(tok) //As a request that checked the token just before the revoke would
+	if _, err := checkAPIToken(token[1]); err != ErrInvalidToken {
+		t.Errorf("Revoked token came back after its use was recorded: %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/securecookie"
+	"github.com/skip2/go-qrcode"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Time-based one-time passwords as described in RFC 6238, with the parameters every authenticator app supports:
+//HMAC-SHA1, 6 digits and a 30 second period.
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 //Periods before and after the current one that are still accepted
+	totpIssuer = "AuthProx"
+
+	secondFactorTimeout = 5 * time.Minute //How long a password-verified login may wait for its second factor
+
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewTOTPSecret() Key {
+	return securecookie.GenerateRandomKey(20)
+}
+
+//TOTPCode computes the code for a secret at a given time.
+func TOTPCode(secret []byte, t time.Time) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/totpPeriod))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+//ValidateTOTP checks a code against the secret, allowing for some clock skew, and returns the time step it belongs to.
+//Codes of steps up to and including after are refused, so a code can only be used once (RFC 6238, section 5.2).
+func ValidateTOTP(secret []byte, code string, t time.Time, after int64) (step int64, ok bool) {
+	if len(secret) == 0 || len(code) != totpDigits {
+		return 0, false
+	}
+	for i := -totpSkew; i <= totpSkew; i++ {
+		at := t.Add(time.Duration(i*totpPeriod) * time.Second)
+		expected := TOTPCode(secret, at)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 && at.Unix()/totpPeriod > after {
+			return at.Unix() / totpPeriod, true
+		}
+	}
+	return 0, false
+}
+
+//TOTPURI builds the otpauth URI that authenticator apps import, usually through a QR code.
+func TOTPURI(username string, secret []byte) string {
+	v := url.Values{}
+	v.Set("secret", totpEncoding.EncodeToString(secret))
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + totpIssuer + ":" + username,
+		RawQuery: v.Encode(),
+	}).String()
+}
+
+//NewRecoveryCodes generates single-use recovery codes.
+//The plain codes are shown to the user once, only their hashes are stored.
+func NewRecoveryCodes() (codes []string, hashes []Key) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		code := strings.ToLower(totpEncoding.EncodeToString(securecookie.GenerateRandomKey(10)))
+		code = code[:8] + "-" + code[8:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return
+}
+
+func hashRecoveryCode(code string) Key {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
+
+//useRecoveryCode removes the matching recovery code from the user and reports whether there was one.
+//The caller must store the user afterwards so the code can not be used again.
+func (u *User) useRecoveryCode(code string) bool {
+	return u.removeRecoveryCode(hashRecoveryCode(code)) == nil
+}
+
+func (u *User) removeRecoveryCode(hash Key) error {
+	for i, stored := range u.RecoveryCodes {
+		if bytes.Equal(stored, hash) {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrCodeUsed
+}
+
+func (u *User) useTOTPStep(step int64) error {
+	if step <= u.TOTPLastStep {
+		return ErrCodeUsed
+	}
+	u.TOTPLastStep = step
+	return nil
+}
+
+//useSecondFactor records the use of a code in the store, through SecondFactorStore if it can.
+//Other stores only get the change checked against the user read just before.
+func useSecondFactor(um UserManager, username string, totpStep int64, recoveryCode Key) error {
+	if s, ok := um.(SecondFactorStore); ok {
+		if recoveryCode != nil {
+			return s.UseRecoveryCode(username, recoveryCode)
+		}
+		return s.UseTOTPStep(username, totpStep)
+	}
+	user, err := um.Get(username)
+	if err != nil {
+		return err
+	}
+	if recoveryCode != nil {
+		err = user.removeRecoveryCode(recoveryCode)
+	} else {
+		err = user.useTOTPStep(totpStep)
+	}
+	if err != nil {
+		return err
+	}
+	return um.Update(user)
+}
+
+//checkSecondFactor accepts either a current TOTP code that has not been used yet or an unused recovery code.
+//The code is used up in the store before it is accepted.
+func checkSecondFactor(user *User, code string) bool {
+	code = strings.TrimSpace(code)
+	if step, ok := ValidateTOTP(user.TOTPSecret, strings.Replace(code, " ", "", -1), time.Now(), user.TOTPLastStep); ok {
+		if err := useSecondFactor(users, user.Name, step, nil); err != nil {
+			if err != ErrCodeUsed {
+				logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Unable to record used TOTP code")
+			}
+			return false
+		}
+		user.TOTPLastStep = step
+		return true
+	}
+	hash := hashRecoveryCode(code)
+	if user.removeRecoveryCode(hash) == nil {
+		if err := useSecondFactor(users, user.Name, 0, hash); err != nil {
+			if err != ErrCodeUsed {
+				logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Unable to consume recovery code")
+			}
+			return false
+		}
+		logger.WithFields(logrus.Fields{"user": user.Name, "left": len(user.RecoveryCodes)}).Info("Recovery code used")
+		return true
+	}
+	return false
+}
+
+func postLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	username, ok := pendingUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+
+	addr := clientAddress(r)
+	if wait, locked := throttle.Attempt(username, addr); wait > 0 {
+		renderThrottled(w, pages.Get(TOTPPage), wait, locked)
+		return
+	}
+
+	r.ParseForm()
+	user, err := users.Get(username)
+	if err != nil || !checkSecondFactor(&user, r.PostFormValue("code")) {
+		logger.WithFields(logrus.Fields{
+			"method": r.Method,
+			"url":    r.URL,
+			"client": r.RemoteAddr,
+			"user":   username,
+		}).Info("Client failed second factor.")
+		message := "The code was not accepted. Please try again."
+		if wait, locked := failLogin(r, username, "Wrong second factor code"); locked {
+			message = throttleMessage(wait, locked)
+		}
+		renderSecondFactor(w, user, message)
+		return
+	}
+
+	throttle.Release(username, addr)
+	session, _ := store.Get(r, "auth")
+	delete(session.Values, "pending")
+	delete(session.Values, "pending_since")
+	completeLogin(w, r, session, username)
+}
+
+var (
+	totpEnrollContent = template.Must(template.New("totp_enroll").Parse(`
+	<p>
+		Scan the code with your authenticator app, or enter the key manually.
+		Then enter the 6-digit code it shows to finish.
+	</p>
+	<p><img src="data:image/png;base64,{{.QR}}" alt="{{.URI}}" width="200" height="200"></p>
+	<p><code>{{.Secret}}</code></p>
+	<form method="POST" action="/proxy/account/totp">
+		<input type="text" name="code" placeholder="123456" autocomplete="one-time-code" required>
+		<input type="submit" value="Enable">
+	</form>`))
+
+	totpEnabledContent = template.Must(template.New("totp_enabled").Parse(`
+	<p>
+		Two-factor authentication is enabled for your account.
+		You have {{.}} unused recovery codes.
+	</p>
+	<form method="POST" action="/proxy/account/totp/disable">
+		<input type="text" name="code" placeholder="Code to disable" autocomplete="one-time-code" required>
+		<input type="submit" value="Disable">
+	</form>`))
+
+	recoveryCodesContent = template.Must(template.New("recovery_codes").Parse(`
+	<p>
+		Two-factor authentication is now enabled.
+		Store these recovery codes somewhere safe. Each can be used once instead of a code if you lose your device.
+		They will not be shown again.
+	</p>
+	<pre>{{range .}}{{.}}
+{{end}}</pre>
+	<p><a href="/proxy/">Continue</a></p>`))
+)
+
+//renderContent executes a content template into HTML that can be placed in a Page.
+func renderContent(tmpl *template.Template, data interface{}) template.HTML {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		logger.WithFields(logrus.Fields{"template": tmpl.Name(), "err": err}).Error("Rendering page content")
+	}
+	return template.HTML(buf.String())
+}
+
+func getAccountTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	if len(user.TOTPSecret) > 0 {
+		renderer.Render(w, Page{
+			Title:   "Two-Factor Authentication",
+			Content: renderContent(totpEnabledContent, len(user.RecoveryCodes)),
+		})
+		return
+	}
+
+	//The secret is kept in the session until the user proves the app has it.
+	session, _ := store.Get(r, "auth")
+	secret := NewTOTPSecret()
+	session.Values["totp_enroll"] = []byte(secret)
+	session.Save(r, w)
+	renderTOTPEnrollment(w, user, secret, "")
+}
+
+func renderTOTPEnrollment(w http.ResponseWriter, user User, secret Key, message string) {
+	uri := TOTPURI(user.Name, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 200)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"err": err}).Error("Encoding TOTP QR code")
+	}
+	renderer.Render(w, Page{
+		Title: "Enable Two-Factor Authentication",
+		Content: renderContent(totpEnrollContent, map[string]string{
+			"QR":     base64.StdEncoding.EncodeToString(png),
+			"URI":    uri,
+			"Secret": totpEncoding.EncodeToString(secret),
+		}),
+		Message: message,
+	})
+}
+
+func postAccountTOTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	session, _ := store.Get(r, "auth")
+	secret, ok := session.Values["totp_enroll"].([]byte)
+	if !ok || len(user.TOTPSecret) > 0 {
+		http.Redirect(w, r, "/proxy/account/totp", http.StatusSeeOther)
+		return
+	}
+
+	r.ParseForm()
+	step, ok := ValidateTOTP(secret, strings.TrimSpace(r.PostFormValue("code")), time.Now(), 0)
+	if !ok {
+		renderTOTPEnrollment(w, user, secret, "The code was not accepted. Check the clock of your device and try again.")
+		return
+	}
+
+	codes, hashes := NewRecoveryCodes()
+	user.TOTPSecret, user.TOTPLastStep, user.RecoveryCodes = secret, step, hashes
+	if err := users.Update(user); err != nil {
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Enabling two-factor authentication")
+		http.Error(w, "Unable to enable two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	delete(session.Values, "totp_enroll")
+	session.Save(r, w)
+
+	logger.WithFields(logrus.Fields{"user": user.Name, "client": r.RemoteAddr}).Info("Two-factor authentication enabled")
+	renderer.Render(w, Page{
+		Title:   "Recovery Codes",
+		Content: renderContent(recoveryCodesContent, codes),
+	})
+}
+
+func postAccountTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	if !checkSecondFactor(&user, r.PostFormValue("code")) {
+		renderer.Render(w, Page{
+			Title:   "Two-Factor Authentication",
+			Content: renderContent(totpEnabledContent, len(user.RecoveryCodes)),
+			Message: "The code was not accepted.",
+		})
+		return
+	}
+	user.TOTPSecret, user.RecoveryCodes = nil, nil
+	if err := users.Update(user); err != nil {
+		http.Error(w, "Unable to disable two-factor authentication: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.WithFields(logrus.Fields{"user": user.Name, "client": r.RemoteAddr}).Info("Two-factor authentication disabled")
+	http.Redirect(w, r, "/proxy/account/totp", http.StatusSeeOther)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+//Test vectors from RFC 6238, appendix B, truncated to 6 digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		if code := TOTPCode(secret, time.Unix(unix, 0)); code != expected {
+			t.Errorf("TOTPCode at %d = %s, expected %s", unix, code, expected)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := NewTOTPSecret()
+	now := time.Now()
+	step, ok := ValidateTOTP(secret, TOTPCode(secret, now), now, 0)
+	if !ok || step != now.Unix()/totpPeriod {
+		t.Errorf("Current code rejected, step %d", step)
+	}
+	if _, ok := ValidateTOTP(secret, TOTPCode(secret, now.Add(-totpPeriod*time.Second)), now, 0); !ok {
+		t.Error("Previous code rejected")
+	}
+	if _, ok := ValidateTOTP(secret, TOTPCode(secret, now.Add(-5*totpPeriod*time.Second)), now, 0); ok {
+		t.Error("Old code accepted")
+	}
+	if _, ok := ValidateTOTP(nil, "000000", now, 0); ok {
+		t.Error("Code accepted without secret")
+	}
+	if _, ok := ValidateTOTP(secret, TOTPCode(secret, now), now, step); ok {
+		t.Error("Code accepted twice")
+	}
+	if _, ok := ValidateTOTP(secret, TOTPCode(secret, now.Add(-totpPeriod*time.Second)), now, step); ok {
+		t.Error("Code older than the last used one accepted")
+	}
+	if _, ok := ValidateTOTP(secret, TOTPCode(secret, now.Add(totpPeriod*time.Second)), now, step); !ok {
+		t.Error("Next code rejected")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, hashes := NewRecoveryCodes()
+	user := User{RecoveryCodes: hashes}
+	if !user.useRecoveryCode(codes[3]) {
+		t.Fatal("Recovery code rejected")
+	}
+	if user.useRecoveryCode(codes[3]) {
+		t.Error("Recovery code accepted twice")
+	}
+	if len(user.RecoveryCodes) != recoveryCodeCount-1 {
+		t.Errorf("%d recovery codes left, expected %d", len(user.RecoveryCodes), recoveryCodeCount-1)
+	}
+	if !user.useRecoveryCode(" " + codes[0] + " ") {
+		t.Error("Recovery code with whitespace rejected")
+	}
+}
+
+//Of parallel requests with the same code only one may get in, whatever the store.
+func TestSecondFactorUsedOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	jum, err := NewJsonUserManager(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jum.Close()
+	bum, err := NewBoltUserManager(filepath.Join(dir, "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bum.Close()
+	sum, err := NewSQLUserManager("sqlite3://" + filepath.Join(dir, "users.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sum.Close()
+	defer func(old UserManager) { users = old }(users)
+
+	secret := NewTOTPSecret()
+	codes, hashes := NewRecoveryCodes()
+	for name, um := range map[string]UserManager{"json": jum, "bolt": bum, "sql": sum} {
+		users = um
+		if err := um.Register(User{Name: "alice", TOTPSecret: secret, RecoveryCodes: hashes}, "hunter2"); err != nil {
+			t.Fatal(name, err)
+		}
+		for _, code := range []string{TOTPCode(secret, time.Now()), codes[0]} {
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			accepted := 0
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					user, err := um.Get("alice")
+					if err == nil && checkSecondFactor(&user, code) {
+						mu.Lock()
+						accepted++
+						mu.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if accepted != 1 {
+				t.Errorf("%s: code %s accepted %d times", name, code, accepted)
+			}
+		}
+		if alice, _ := um.Get("alice"); len(alice.RecoveryCodes) != recoveryCodeCount-1 || alice.TOTPLastStep == 0 {
+			t.Errorf("%s: stored %d recovery codes and TOTP step %d", name, len(alice.RecoveryCodes), alice.TOTPLastStep)
+		}
+	}
+}
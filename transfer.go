@@ -0,0 +1,338 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/securecookie"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Users are exported together with their password hashes, so they can be moved between backends, used to seed a
+//test environment or kept as a backup without anyone choosing a new password. The hash algorithm is recorded
+//next to each hash as a check. Exports also hold TOTP secrets and should be guarded like the database itself.
+
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+var (
+	ErrUnknownFormat = errors.New("Unknown format. Expected json or csv")
+	ErrNoUserName    = errors.New("A user without a name can not be imported")
+)
+
+//An exportedUser is a user as it appears in an export.
+type exportedUser struct {
+	Name               string     `json:"name"`
+	Email              string     `json:"email,omitempty"`
+	Admin              bool       `json:"admin,omitempty"`
+	Unverified         bool       `json:"unverified,omitempty"`
+	Pending            bool       `json:"pending,omitempty"`
+	Disabled           bool       `json:"disabled,omitempty"`
+	MustChangePassword bool       `json:"must_change_password,omitempty"`
+	CreatedAt          *time.Time `json:"created_at,omitempty"`
+	ExpiresAt          *time.Time `json:"expires_at,omitempty"`
+	HashAlgorithm      string     `json:"hash_algorithm"`
+	Passhash           Key        `json:"passhash"`
+	Salt               Key        `json:"salt,omitempty"` //Only legacy sha512 hashes have a separate salt
+	TOTPSecret         Key        `json:"totp_secret,omitempty"`
+	TOTPLastStep       int64      `json:"totp_last_step,omitempty"`
+	RecoveryCodes      []Key      `json:"recovery_codes,omitempty"`
+}
+
+var csvColumns = []string{"name", "email", "admin", "unverified", "pending", "disabled", "must_change_password",
+	"created_at", "expires_at", "hash_algorithm", "passhash", "salt", "totp_secret", "totp_last_step", "recovery_codes"}
+
+func newExportedUser(u User) exportedUser {
+	return exportedUser{
+		Name:               u.Name,
+		Email:              u.Email,
+		Admin:              u.Admin,
+		Unverified:         u.Unverified,
+		Pending:            u.Pending,
+		Disabled:           u.Disabled,
+		MustChangePassword: u.MustChangePassword,
+		CreatedAt:          timeOrNil(u.CreatedAt),
+		ExpiresAt:          timeOrNil(u.ExpiresAt),
+		HashAlgorithm:      HashAlgorithm(u.Passhash),
+		Passhash:           u.Passhash,
+		Salt:               u.Salt,
+		TOTPSecret:         u.TOTPSecret,
+		TOTPLastStep:       u.TOTPLastStep,
+		RecoveryCodes:      u.RecoveryCodes,
+	}
+}
+
+//user turns the exported user back into a User, checking that the hash is one authprox can verify.
+func (e exportedUser) user() (User, error) {
+	if e.Name == "" {
+		return User{}, ErrNoUserName
+	}
+	algorithm := HashAlgorithm(e.Passhash)
+	if algorithm == "unknown" {
+		return User{}, fmt.Errorf("user %s: the password hash is of an unknown algorithm", e.Name)
+	}
+	if e.HashAlgorithm != "" && e.HashAlgorithm != algorithm {
+		return User{}, fmt.Errorf("user %s: the password hash is %s, not %s", e.Name, algorithm, e.HashAlgorithm)
+	}
+	if err := CheckHash(e.Passhash); err != nil {
+		return User{}, fmt.Errorf("user %s: %v", e.Name, err)
+	}
+	u := User{
+		Name:               e.Name,
+		Email:              e.Email,
+		Admin:              e.Admin,
+		Unverified:         e.Unverified,
+		Pending:            e.Pending,
+		Disabled:           e.Disabled,
+		MustChangePassword: e.MustChangePassword,
+		Passhash:           e.Passhash,
+		Salt:               e.Salt,
+		TOTPSecret:         e.TOTPSecret,
+		TOTPLastStep:       e.TOTPLastStep,
+		RecoveryCodes:      e.RecoveryCodes,
+	}
+	if e.CreatedAt != nil {
+		u.CreatedAt = *e.CreatedAt
+	}
+	if e.ExpiresAt != nil {
+		u.ExpiresAt = *e.ExpiresAt
+	}
+	return u, nil
+}
+
+//formatOf picks the format from a file name, unless one was given.
+func formatOf(format, file string) (string, error) {
+	if format == "" {
+		format = FormatJSON
+		if strings.HasSuffix(strings.ToLower(file), ".csv") {
+			format = FormatCSV
+		}
+	}
+	if format != FormatJSON && format != FormatCSV {
+		return "", ErrUnknownFormat
+	}
+	return format, nil
+}
+
+//exportUsers writes all users to w and returns how many there were.
+func exportUsers(w io.Writer, format string) (int, error) {
+	list, err := users.List()
+	if err != nil {
+		return 0, err
+	}
+	exported := make([]exportedUser, len(list))
+	for i, u := range list {
+		exported[i] = newExportedUser(u)
+	}
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		return len(list), enc.Encode(exported)
+	case FormatCSV:
+		return len(list), writeUsersCSV(w, exported)
+	}
+	return 0, ErrUnknownFormat
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func writeUsersCSV(w io.Writer, list []exportedUser) error {
+	cw := csv.NewWriter(w)
+	cw.Write(csvColumns)
+	for _, e := range list {
+		cw.Write([]string{
+			e.Name, e.Email, strconv.FormatBool(e.Admin), strconv.FormatBool(e.Unverified), strconv.FormatBool(e.Pending),
+			strconv.FormatBool(e.Disabled), strconv.FormatBool(e.MustChangePassword), csvTime(e.CreatedAt), csvTime(e.ExpiresAt),
+			e.HashAlgorithm, keyText(e.Passhash), keyText(e.Salt), keyText(e.TOTPSecret), strconv.FormatInt(e.TOTPLastStep, 10),
+			keyListText(e.RecoveryCodes),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+//readUsersCSV reads users written by writeUsersCSV. The columns are found by the header, so they may be in any order
+//and all but name and passhash may be left out, as when seeding a test environment from a spreadsheet.
+func readUsersCSV(r io.Reader) (list []exportedUser, err error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	column := make(map[string]int)
+	for i, name := range records[0] {
+		column[strings.TrimSpace(name)] = i
+	}
+	for _, required := range []string{"name", "passhash"} {
+		if _, ok := column[required]; !ok {
+			return nil, fmt.Errorf("the CSV header has no %s column", required)
+		}
+	}
+	for line, record := range records[1:] {
+		field := func(name string) string {
+			if i, ok := column[name]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		e, err := parseCSVUser(field)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line+2, err)
+		}
+		list = append(list, e)
+	}
+	return
+}
+
+func parseCSVUser(field func(string) string) (e exportedUser, err error) {
+	e.Name, e.Email, e.HashAlgorithm = field("name"), field("email"), field("hash_algorithm")
+	for name, b := range map[string]*bool{"admin": &e.Admin, "unverified": &e.Unverified, "pending": &e.Pending,
+		"disabled": &e.Disabled, "must_change_password": &e.MustChangePassword} {
+		if s := field(name); s != "" {
+			if *b, err = strconv.ParseBool(s); err != nil {
+				return e, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+	}
+	for name, t := range map[string]**time.Time{"created_at": &e.CreatedAt, "expires_at": &e.ExpiresAt} {
+		if s := field(name); s != "" {
+			parsed, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return e, fmt.Errorf("%s: %v", name, err)
+			}
+			*t = &parsed
+		}
+	}
+	for name, k := range map[string]*Key{"passhash": &e.Passhash, "salt": &e.Salt, "totp_secret": &e.TOTPSecret} {
+		if err = k.UnmarshalText([]byte(field(name))); err != nil {
+			return e, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if s := field("totp_last_step"); s != "" {
+		if e.TOTPLastStep, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return e, fmt.Errorf("totp_last_step: %v", err)
+		}
+	}
+	if e.RecoveryCodes, err = parseKeyList(field("recovery_codes")); err != nil {
+		return e, fmt.Errorf("recovery_codes: %v", err)
+	}
+	return
+}
+
+//An importResult tells what importUsers did.
+type importResult struct {
+	Added   int      `json:"added"`
+	Updated int      `json:"updated"`
+	Skipped []string `json:"skipped"` //Users that already existed
+}
+
+//readUsers reads and checks an export. Reading all of it before importing means a bad line is found
+//before any user is stored.
+func readUsers(r io.Reader, format string) (list []User, err error) {
+	var exported []exportedUser
+	switch format {
+	case FormatJSON:
+		err = json.NewDecoder(r).Decode(&exported)
+	case FormatCSV:
+		exported, err = readUsersCSV(r)
+	default:
+		err = ErrUnknownFormat
+	}
+	if err != nil {
+		return
+	}
+	list = make([]User, len(exported))
+	for i, e := range exported {
+		if list[i], err = e.user(); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+//importUsers adds users read by readUsers. Existing users are left alone, unless overwrite is set.
+//If a user can not be stored, the users added and replaced before it are put back, so a failed import changes nothing.
+//The error names the users that could not be put back, if any, and the result counts them.
+func importUsers(list []User, overwrite bool) (res importResult, err error) {
+	res.Skipped = []string{}
+	var added []string
+	var replaced []User
+	for _, u := range list {
+		old, err := users.Get(u.Name)
+		switch err {
+		case nil:
+			if !overwrite {
+				res.Skipped = append(res.Skipped, u.Name)
+				continue
+			}
+			if err := users.Update(u); err != nil {
+				return undoImport(res, added, replaced, fmt.Errorf("user %s: %v", u.Name, err))
+			}
+			replaced = append(replaced, old)
+			res.Updated++
+		case ErrUnknownUser:
+			if err := importUser(u); err != nil {
+				return undoImport(res, added, replaced, fmt.Errorf("user %s: %v", u.Name, err))
+			}
+			added = append(added, u.Name)
+			res.Added++
+		default:
+			return undoImport(res, added, replaced, fmt.Errorf("user %s: %v", u.Name, err))
+		}
+	}
+	return
+}
+
+//undoImport puts back the users a failed import added or replaced.
+func undoImport(res importResult, added []string, replaced []User, cause error) (importResult, error) {
+	var left []string
+	for _, name := range added {
+		if err := users.Delete(name); err != nil {
+			left = append(left, name)
+			continue
+		}
+		res.Added--
+	}
+	for _, u := range replaced {
+		if err := users.Update(u); err != nil {
+			left = append(left, u.Name)
+			continue
+		}
+		res.Updated--
+	}
+	if len(left) > 0 {
+		return res, fmt.Errorf("%v. These users were imported and could not be put back: %s", cause, strings.Join(left, ", "))
+	}
+	return res, cause
+}
+
+//importUser adds a user with the hash it already has. The UserManager only registers users with a password,
+//so the user is registered with a throwaway one that the update replaces. If the update fails, the user is removed
+//again, rather than left with the throwaway password and maybe the admin rights the first user is given.
+func importUser(u User) error {
+	throwaway := keyText(securecookie.GenerateRandomKey(32))
+	if err := users.Register(u, throwaway); err != nil {
+		return err
+	}
+	if err := users.Update(u); err != nil { //Also undoes the admin rights the first user is given
+		if derr := users.Delete(u.Name); derr != nil {
+			return fmt.Errorf("%v, and the user could not be removed again: %v", err, derr)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source, err := NewJsonUserManager(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	expires := time.Date(2030, 6, 16, 0, 0, 0, 0, time.UTC)
+	source.Register(User{Name: "alice", Email: "alice@example.com", TOTPSecret: NewTOTPSecret(), TOTPLastStep: 55555555}, "correct horse battery staple")
+	source.Register(User{Name: "bob", ExpiresAt: expires, Disabled: true}, "tr0ub4dor&3 is long")
+	legacy := User{Name: "carol", Salt: Key("saltsaltsaltsaltsaltsaltsaltsalt"), CreatedAt: time.Now()}
+	legacy.Passhash = HashAndSalt("hunter2", legacy.Salt)
+	source.Register(User{Name: "carol"}, "placeholder")
+	source.Update(legacy)
+
+	for _, format := range []string{FormatJSON, FormatCSV} {
+		users = source
+		var buf bytes.Buffer
+		if n, err := exportUsers(&buf, format); err != nil || n != 3 {
+			t.Fatalf("%s: exported %d users, %v", format, n, err)
+		}
+		if !strings.Contains(buf.String(), "argon2id") || !strings.Contains(buf.String(), "sha512") {
+			t.Errorf("%s: the hash algorithms are missing from the export", format)
+		}
+
+		target, err := NewBoltUserManager(filepath.Join(dir, format+".db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = target
+		list, err := readUsers(bytes.NewReader(buf.Bytes()), format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if res, err := importUsers(list, false); err != nil || res.Added != 3 {
+			t.Errorf("%s: import = %+v, %v", format, res, err)
+		}
+		alice, _ := target.Get("alice")
+		if !alice.Admin || alice.Email != "alice@example.com" || alice.TOTPLastStep != 55555555 || !target.Authenticate("alice", "correct horse battery staple") {
+			t.Errorf("%s: alice = %+v changed in the import", format, alice)
+		}
+		bob, _ := target.Get("bob")
+		if bob.Admin || !bob.Disabled || !bob.ExpiresAt.Equal(expires) {
+			t.Errorf("%s: bob = %+v changed in the import", format, bob)
+		}
+		if carol, _ := target.Get("carol"); !bytes.Equal(carol.Salt, legacy.Salt) {
+			t.Errorf("%s: the legacy salt of carol was lost", format)
+		} else if ok, _ := VerifyPassword(carol, "hunter2"); !ok {
+			t.Errorf("%s: carol can not log in after the import", format)
+		}
+
+		if res, err := importUsers(list, false); err != nil || len(res.Skipped) != 3 {
+			t.Errorf("%s: second import = %+v, %v. Expected all users skipped", format, res, err)
+		}
+		if res, err := importUsers(list, true); err != nil || res.Updated != 3 {
+			t.Errorf("%s: overwriting import = %+v, %v", format, res, err)
+		}
+		target.Close()
+
+		//An import that fails partway takes back what it did.
+		empty, err := NewBoltUserManager(filepath.Join(dir, format+"-failing.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		users = failingUpdates{empty, "carol"}
+		if res, err := importUsers(list, false); err == nil || res.Added != 0 {
+			t.Errorf("%s: failing import = %+v, %v", format, res, err)
+		}
+		if left, _ := empty.List(); len(left) != 0 {
+			t.Errorf("%s: %d users left behind by a failed import", format, len(left))
+		}
+		empty.Close()
+	}
+
+	bad := "name,passhash,hash_algorithm\ndave," + keyText(HashAndSalt("x", nil)) + ",argon2id\n"
+	if _, err := readUsers(strings.NewReader(bad), FormatCSV); err == nil {
+		t.Error("A hash that does not match its algorithm was accepted")
+	}
+	crafted := "name,passhash\ndave," + keyText(Key("$argon2id$v=19$m=4294967295,t=1,p=4$c2FsdHNhbHQ$aGFzaGhhc2g")) + "\n"
+	if _, err := readUsers(strings.NewReader(crafted), FormatCSV); err == nil {
+		t.Error("A hash with out of bounds parameters was accepted")
+	}
+	if _, err := readUsers(strings.NewReader("name,email\ndave,\n"), FormatCSV); err == nil {
+		t.Error("A CSV without hashes was accepted")
+	}
+}
+
+//failingUpdates fails to update one user, like a store that went away halfway through.
+type failingUpdates struct {
+	UserManager
+	name string
+}
+
+func (f failingUpdates) Update(user User) error {
+	if user.Name == f.name {
+		return BackendError{errors.New("gone")}
+	}
+	return f.UserManager.Update(user)
+}
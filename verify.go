@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/securecookie"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//Email verification. New accounts are Unverified until the user follows a link sent to the address given when registering.
+//The link carries the username and address signed with the authentication key, so nothing has to be stored until it is used.
+
+const verificationTimeout = 48 * time.Hour
+
+func verificationCodec() *securecookie.SecureCookie {
+	sc := securecookie.New(config.Keys.AuthenticationKey, nil)
+	sc.MaxAge(int(verificationTimeout / time.Second))
+	return sc
+}
+
+//verificationToken signs the address of the user. It is only valid for that address.
+func verificationToken(user User) (string, error) {
+	return verificationCodec().Encode("verify", map[string]string{"user": user.Name, "email": user.Email})
+}
+
+//checkVerificationToken returns the user and address a token was made for.
+func checkVerificationToken(token string) (username, email string, err error) {
+	var v map[string]string
+	if err = verificationCodec().Decode("verify", token, &v); err != nil {
+		return
+	}
+	return v["user"], v["email"], nil
+}
+
+const verificationMailBody = `Hello %s,
+
+Welcome to AuthProx. Please follow this link within two days to confirm your email address and activate your account:
+
+%s
+
+If you did not register, you can ignore this message.
+`
+
+func sendVerification(user User) error {
+	token, err := verificationToken(user)
+	if err != nil {
+		return err
+	}
+	link := strings.TrimSuffix(config.PublicURL, "/") + "/proxy/verify?token=" + url.QueryEscape(token)
+	return mailer.Send(user.Email, "Confirm your email address", fmt.Sprintf(verificationMailBody, user.Name, link))
+}
+
+func getVerify(w http.ResponseWriter, r *http.Request) {
+	page := loginPage()
+	username, email, err := checkVerificationToken(r.URL.Query().Get("token"))
+	var user User
+	if err == nil {
+		user, err = users.Get(username)
+	}
+	if err != nil || user.Email != email {
+		page.Message = "The verification link is invalid or has expired. Log in to get a new one."
+		renderer.Render(w, page)
+		return
+	}
+	if user.Unverified {
+		user.Unverified = false
+		if err := users.Update(user); err != nil {
+			logger.WithFields(logrus.Fields{"user": username, "err": err}).Error("Verifying email address")
+			http.Error(w, "Unable to verify the email address: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.WithFields(logrus.Fields{"user": username, "client": r.RemoteAddr}).Info("Email address verified")
+	}
+	page.Message = "Your email address is confirmed. You can now log in."
+	renderer.Render(w, page)
+}
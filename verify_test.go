@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"github.com/gorilla/securecookie"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerificationToken(t *testing.T) {
+	config.Keys.AuthenticationKey = securecookie.GenerateRandomKey(64)
+	token, err := verificationToken(User{Name: "alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, email, err := checkVerificationToken(token); err != nil || user != "alice" || email != "alice@example.com" {
+		t.Errorf("checkVerificationToken = %q, %q, %v", user, email, err)
+	}
+	if _, _, err := checkVerificationToken(token[:len(token)-4] + "AAAA"); err == nil {
+		t.Error("Tampered token accepted")
+	}
+
+	config.Keys.AuthenticationKey = securecookie.GenerateRandomKey(64)
+	if _, _, err := checkVerificationToken(token); err == nil {
+		t.Error("Token accepted with another key")
+	}
+}
+
+func TestUnverifiedLogin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authprox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	um, err := NewJsonUserManager(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.Close()
+	users = um
+
+	if err := um.Register(User{Name: "alice", Email: "alice@example.com", Unverified: true}, "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if um.Authenticate("alice", "hunter2") {
+		t.Error("Unverified user authenticated")
+	}
+	if _, err := authenticate(context.Background(), "alice", "hunter3"); err != ErrWrongPassword {
+		t.Errorf("Wrong password reported as %v", err)
+	}
+	alice, err := authenticate(context.Background(), "alice", "hunter2")
+	if err != ErrUnverified {
+		t.Errorf("Unverified login reported as %v", err)
+	}
+
+	alice.Unverified = false
+	um.Update(alice)
+	if !um.Authenticate("alice", "hunter2") {
+		t.Error("Verified user not authenticated")
+	}
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/Sirupsen/logrus"
+	"github.com/boltdb/bolt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gorilla/securecookie"
+	"html/template"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Passkeys through the Web Authentication API.
+//Only what authprox needs is implemented: no attestation is requested, so a new passkey is trusted as the
+//authenticator presents it, and ES256 and RS256 keys are accepted, which covers platform and roaming authenticators.
+
+//A RelyingParty verifies WebAuthn ceremonies for one domain.
+type RelyingParty struct {
+	ID      string   //The domain passkeys are bound to
+	Origins []string //Origins the browser may report, like https://example.com
+}
+
+//The relying party of this server. Nil when passkeys are disabled.
+var relyingParty *RelyingParty
+
+//A Passkey is a WebAuthn credential registered by a user.
+type Passkey struct {
+	ID        Key
+	User      string
+	Name      string
+	PublicKey Key //COSE_Key as sent by the authenticator
+	SignCount uint32
+	CreatedAt time.Time
+	LastUsed  time.Time
+}
+
+var (
+	BoltBucketPasskeys     = []byte("passkeys")    //Sub-bucket per user, credential ID to Passkey
+	BoltBucketPasskeyIndex = []byte("passkey_ids") //Credential ID to user
+)
+
+var (
+	ErrWebAuthnClientData = errors.New("WebAuthn client data does not match the ceremony")
+	ErrWebAuthnAuthData   = errors.New("WebAuthn authenticator data is invalid")
+	ErrWebAuthnSignature  = errors.New("WebAuthn signature is invalid")
+	ErrWebAuthnSignCount  = errors.New("WebAuthn signature counter did not increase, the authenticator may be cloned")
+	ErrWebAuthnKey        = errors.New("Unsupported WebAuthn public key")
+	ErrUnknownPasskey     = errors.New("Passkey does not exist")
+)
+
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+
+	coseAlgES256    = -7
+	coseAlgRS256    = -257
+	webauthnTimeout = 2 * time.Minute
+)
+
+func selectRelyingParty() {
+	if config.WebAuthn.RPID == "" {
+		return
+	}
+	rp := &RelyingParty{
+		ID:      config.WebAuthn.RPID,
+		Origins: config.WebAuthn.Origins,
+	}
+	if len(rp.Origins) == 0 {
+		rp.Origins = []string{"https://" + rp.ID}
+	}
+	if err := ensureBuckets(stateDB, BoltBucketPasskeys, BoltBucketPasskeyIndex); err != nil {
+		logger.WithField("err", err).Fatal("Unable to create passkey buckets.")
+	}
+	relyingParty = rp
+	logger.WithFields(logrus.Fields{"rp": rp.ID, "origins": rp.Origins}).Info("Passkeys enabled")
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, typ string, challenge []byte) error {
+	var cd clientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return ErrWebAuthnClientData
+	}
+	if cd.Type != typ {
+		return ErrWebAuthnClientData
+	}
+	got, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(cd.Challenge, "="))
+	if err != nil || len(challenge) == 0 || subtle.ConstantTimeCompare(got, challenge) != 1 {
+		return ErrWebAuthnClientData
+	}
+	for _, origin := range rp.Origins {
+		if cd.Origin == origin {
+			return nil
+		}
+	}
+	return ErrWebAuthnClientData
+}
+
+type authenticatorData struct {
+	Flags        byte
+	SignCount    uint32
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func (rp *RelyingParty) parseAuthData(raw []byte, userVerification bool) (ad authenticatorData, err error) {
+	if len(raw) < 37 {
+		return ad, ErrWebAuthnAuthData
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(raw[:32], rpIDHash[:]) {
+		return ad, ErrWebAuthnAuthData
+	}
+	ad.Flags, ad.SignCount = raw[32], binary.BigEndian.Uint32(raw[33:37])
+	if ad.Flags&authDataUserPresent == 0 {
+		return ad, ErrWebAuthnAuthData
+	}
+	if userVerification && ad.Flags&authDataUserVerified == 0 {
+		return ad, ErrWebAuthnAuthData
+	}
+	if ad.Flags&authDataAttested != 0 {
+		rest := raw[37:]
+		if len(rest) < 18 { //AAGUID and credential ID length
+			return ad, ErrWebAuthnAuthData
+		}
+		n := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < n {
+			return ad, ErrWebAuthnAuthData
+		}
+		ad.CredentialID = rest[:n]
+		var key cbor.RawMessage
+		if _, err = cbor.UnmarshalFirst(rest[n:], &key); err != nil {
+			return ad, ErrWebAuthnAuthData
+		}
+		ad.PublicKey = key
+	}
+	return
+}
+
+//parseCOSEKey decodes the public key of a credential. Only ES256 on P-256 and RS256 are supported.
+func parseCOSEKey(raw []byte) (crypto.PublicKey, error) {
+	var m map[int]interface{}
+	if err := cbor.Unmarshal(raw, &m); err != nil {
+		return nil, ErrWebAuthnKey
+	}
+	kty, _ := coseInt(m[1])
+	alg, _ := coseInt(m[3])
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		crv, _ := coseInt(m[-1])
+		x, _ := m[-2].([]byte)
+		y, _ := m[-3].([]byte)
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, ErrWebAuthnKey
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, ErrWebAuthnKey
+		}
+		return key, nil
+	case kty == 3 && alg == coseAlgRS256:
+		n, _ := m[-1].([]byte)
+		e, _ := m[-2].([]byte)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrWebAuthnKey
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, ErrWebAuthnKey
+}
+
+func coseInt(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+	case int64:
+		return i, true
+	case uint64:
+		return int64(i), true
+	}
+	return 0, false
+}
+
+//VerifyRegistration checks the response to a navigator.credentials.create call and returns the new passkey.
+func (rp *RelyingParty) VerifyRegistration(challenge, clientDataJSON, attestationObject []byte, userVerification bool) (Passkey, error) {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return Passkey{}, err
+	}
+	var att struct {
+		Fmt      string          `cbor:"fmt"`
+		AttStmt  cbor.RawMessage `cbor:"attStmt"`
+		AuthData []byte          `cbor:"authData"`
+	}
+	if err := cbor.Unmarshal(attestationObject, &att); err != nil {
+		return Passkey{}, ErrWebAuthnAuthData
+	}
+	ad, err := rp.parseAuthData(att.AuthData, userVerification)
+	if err != nil {
+		return Passkey{}, err
+	}
+	if len(ad.CredentialID) == 0 {
+		return Passkey{}, ErrWebAuthnAuthData
+	}
+	if _, err := parseCOSEKey(ad.PublicKey); err != nil {
+		return Passkey{}, err
+	}
+	return Passkey{
+		ID:        ad.CredentialID,
+		PublicKey: ad.PublicKey,
+		SignCount: ad.SignCount,
+		CreatedAt: time.Now(),
+	}, nil
+}
+
+//VerifyAssertion checks the response to a navigator.credentials.get call against a stored passkey.
+//On success the signature counter and last use of the passkey are updated, and it should be saved.
+func (rp *RelyingParty) VerifyAssertion(challenge []byte, passkey *Passkey, clientDataJSON, authData, signature []byte, userVerification bool) error {
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return err
+	}
+	ad, err := rp.parseAuthData(authData, userVerification)
+	if err != nil {
+		return err
+	}
+	pub, err := parseCOSEKey(passkey.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return ErrWebAuthnSignature
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return ErrWebAuthnSignature
+		}
+	}
+
+	//Authenticators without a counter always send zero.
+	if (ad.SignCount != 0 || passkey.SignCount != 0) && ad.SignCount <= passkey.SignCount {
+		return ErrWebAuthnSignCount
+	}
+	passkey.SignCount, passkey.LastUsed = ad.SignCount, time.Now()
+	return nil
+}
+
+func savePasskey(pk Passkey) error {
+	data, err := json.Marshal(pk)
+	if err != nil {
+		return err
+	}
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(BoltBucketPasskeys).CreateBucketIfNotExists([]byte(pk.User))
+		if err != nil {
+			return err
+		}
+		if err := b.Put(pk.ID, data); err != nil {
+			return err
+		}
+		return tx.Bucket(BoltBucketPasskeyIndex).Put(pk.ID, []byte(pk.User))
+	})
+}
+
+func findPasskey(id []byte) (pk Passkey, err error) {
+	err = stateDB.View(func(tx *bolt.Tx) error {
+		user := tx.Bucket(BoltBucketPasskeyIndex).Get(id)
+		if user == nil {
+			return ErrUnknownPasskey
+		}
+		b := tx.Bucket(BoltBucketPasskeys).Bucket(user)
+		if b == nil {
+			return ErrUnknownPasskey
+		}
+		data := b.Get(id)
+		if data == nil {
+			return ErrUnknownPasskey
+		}
+		return json.Unmarshal(data, &pk)
+	})
+	return
+}
+
+func userPasskeys(username string) (list []Passkey, err error) {
+	err = stateDB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketPasskeys).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var pk Passkey
+			if err := json.Unmarshal(v, &pk); err != nil {
+				return err
+			}
+			list = append(list, pk)
+			return nil
+		})
+	})
+	return
+}
+
+func hasPasskeys(username string) bool {
+	if relyingParty == nil {
+		return false
+	}
+	list, _ := userPasskeys(username)
+	return len(list) > 0
+}
+
+func deletePasskey(username string, id []byte) error {
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketPasskeys).Bucket([]byte(username))
+		if b == nil || b.Get(id) == nil {
+			return ErrUnknownPasskey
+		}
+		if err := b.Delete(id); err != nil {
+			return err
+		}
+		return tx.Bucket(BoltBucketPasskeyIndex).Delete(id)
+	})
+}
+
+//deletePasskeys removes all passkeys of a user, as when the account is deleted.
+func deletePasskeys(username string) error {
+	if relyingParty == nil {
+		return nil
+	}
+	return stateDB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BoltBucketPasskeys).Bucket([]byte(username))
+		if b == nil {
+			return nil
+		}
+		index := tx.Bucket(BoltBucketPasskeyIndex)
+		if err := b.ForEach(func(k, v []byte) error { return index.Delete(k) }); err != nil {
+			return err
+		}
+		return tx.Bucket(BoltBucketPasskeys).DeleteBucket([]byte(username))
+	})
+}
+
+//The user handle identifies the account to the authenticator without revealing the username.
+func passkeyUserHandle(username string) []byte {
+	sum := sha256.Sum256([]byte(username))
+	return sum[:]
+}
+
+type credentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+func passkeyDescriptors(username string) []credentialDescriptor {
+	list, _ := userPasskeys(username)
+	descriptors := []credentialDescriptor{}
+	for _, pk := range list {
+		descriptors = append(descriptors, credentialDescriptor{"public-key", base64.RawURLEncoding.EncodeToString(pk.ID)})
+	}
+	return descriptors
+}
+
+//newCeremony stores a fresh challenge in the session. A challenge can only be used once.
+func newCeremony(w http.ResponseWriter, r *http.Request, ceremony string) []byte {
+	session, _ := store.Get(r, "auth")
+	challenge := securecookie.GenerateRandomKey(32)
+	session.Values["webauthn_ceremony"] = ceremony
+	session.Values["webauthn_challenge"] = challenge
+	session.Values["webauthn_since"] = time.Now().Unix()
+	session.Save(r, w)
+	return challenge
+}
+
+func takeCeremony(w http.ResponseWriter, r *http.Request, ceremony string) []byte {
+	session, _ := store.Get(r, "auth")
+	typ, _ := session.Values["webauthn_ceremony"].(string)
+	challenge, _ := session.Values["webauthn_challenge"].([]byte)
+	since, _ := session.Values["webauthn_since"].(int64)
+	delete(session.Values, "webauthn_ceremony")
+	delete(session.Values, "webauthn_challenge")
+	delete(session.Values, "webauthn_since")
+	session.Save(r, w)
+	if typ != ceremony || time.Since(time.Unix(since, 0)) > webauthnTimeout {
+		return nil
+	}
+	return challenge
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func postPasskeyRegisterBegin(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Error(w, "You need to login first.", http.StatusUnauthorized)
+		return
+	}
+	challenge := newCeremony(w, r, "register")
+	writeJSON(w, map[string]interface{}{
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"rp":        map[string]string{"id": relyingParty.ID, "name": totpIssuer},
+		"user": map[string]string{
+			"id":          base64.RawURLEncoding.EncodeToString(passkeyUserHandle(user.Name)),
+			"name":        user.Name,
+			"displayName": user.Name,
+		},
+		"pubKeyCredParams": []map[string]interface{}{
+			{"type": "public-key", "alg": coseAlgES256},
+			{"type": "public-key", "alg": coseAlgRS256},
+		},
+		"timeout":            webauthnTimeout / time.Millisecond,
+		"attestation":        "none",
+		"excludeCredentials": passkeyDescriptors(user.Name),
+		"authenticatorSelection": map[string]string{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+	})
+}
+
+type passkeyResponse struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+		UserHandle        string `json:"userHandle"`
+	} `json:"response"`
+}
+
+func b64url(s string) []byte {
+	data, _ := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	return data
+}
+
+func postPasskeyRegisterFinish(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Error(w, "You need to login first.", http.StatusUnauthorized)
+		return
+	}
+	var res passkeyResponse
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, "Malformed response.", http.StatusBadRequest)
+		return
+	}
+	challenge := takeCeremony(w, r, "register")
+	pk, err := relyingParty.VerifyRegistration(challenge, b64url(res.Response.ClientDataJSON), b64url(res.Response.AttestationObject), false)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": user.Name, "client": r.RemoteAddr, "err": err}).Info("Passkey registration failed")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := findPasskey(pk.ID); err == nil {
+		http.Error(w, "The passkey is already registered.", http.StatusConflict)
+		return
+	}
+	pk.User, pk.Name = user.Name, strings.TrimSpace(res.Name)
+	if pk.Name == "" {
+		pk.Name = "Passkey added " + pk.CreatedAt.Format("2006-01-02")
+	}
+	if err := savePasskey(pk); err != nil {
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Saving passkey")
+		http.Error(w, "Unable to save the passkey.", http.StatusInternalServerError)
+		return
+	}
+	logger.WithFields(logrus.Fields{"user": user.Name, "client": r.RemoteAddr, "passkey": pk.Name}).Info("Passkey registered")
+	writeJSON(w, map[string]string{"redirect": "/proxy/account/passkeys"})
+}
+
+func postPasskeyLoginBegin(w http.ResponseWriter, r *http.Request) {
+	options := map[string]interface{}{
+		"rpId":             relyingParty.ID,
+		"timeout":          webauthnTimeout / time.Millisecond,
+		"allowCredentials": []credentialDescriptor{},
+	}
+	if pending, ok := pendingUser(r); ok {
+		//Second factor for a user that has already given the password.
+		options["allowCredentials"] = passkeyDescriptors(pending)
+		options["userVerification"] = "discouraged"
+	} else if config.WebAuthn.Passwordless {
+		//The passkey is the only factor, so the authenticator must verify the user itself.
+		options["userVerification"] = "required"
+	} else {
+		http.Error(w, "Log in with your password first.", http.StatusForbidden)
+		return
+	}
+	options["challenge"] = base64.RawURLEncoding.EncodeToString(newCeremony(w, r, "login"))
+	writeJSON(w, options)
+}
+
+func postPasskeyLoginFinish(w http.ResponseWriter, r *http.Request) {
+	var res passkeyResponse
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		http.Error(w, "Malformed response.", http.StatusBadRequest)
+		return
+	}
+	challenge := takeCeremony(w, r, "login")
+	pk, err := findPasskey(b64url(res.ID))
+	pending, isSecondFactor := pendingUser(r)
+	username := pk.User
+	if err != nil {
+		username = pending //Unknown passkeys still count against the address
+	}
+	addr := clientAddress(r)
+	if wait, locked := throttle.Attempt(username, addr); wait > 0 {
+		logger.WithFields(logrus.Fields{
+			"method": r.Method,
+			"url":    r.URL,
+			"client": r.RemoteAddr,
+			"user":   username,
+			"wait":   wait,
+		}).Info("Client passkey login throttled.")
+		setRetryAfter(w, wait)
+		http.Error(w, throttleMessage(wait, locked), http.StatusTooManyRequests)
+		return
+	}
+	if err == nil {
+		switch {
+		case isSecondFactor && pk.User != pending:
+			err = ErrUnknownPasskey
+		case !isSecondFactor && !config.WebAuthn.Passwordless:
+			err = ErrUnknownPasskey
+		case !isSecondFactor && len(res.Response.UserHandle) > 0 && !bytes.Equal(b64url(res.Response.UserHandle), passkeyUserHandle(pk.User)):
+			err = ErrUnknownPasskey
+		}
+	}
+	if err == nil {
+		err = relyingParty.VerifyAssertion(challenge, &pk,
+			b64url(res.Response.ClientDataJSON), b64url(res.Response.AuthenticatorData), b64url(res.Response.Signature),
+			!isSecondFactor)
+	}
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"method": r.Method,
+			"url":    r.URL,
+			"client": r.RemoteAddr,
+			"user":   pk.User,
+			"err":    err,
+		}).Info("Client failed passkey login.")
+		message := "The passkey was not accepted."
+		if wait, locked := failLogin(r, username, "Passkey not accepted: "+err.Error()); locked {
+			message = throttleMessage(wait, locked)
+		}
+		http.Error(w, message, http.StatusUnauthorized)
+		return
+	}
+	throttle.Release(username, addr)
+	if err := savePasskey(pk); err != nil {
+		logger.WithFields(logrus.Fields{"user": pk.User, "err": err}).Error("Updating passkey sign count")
+	}
+	user, err := users.Get(pk.User)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": pk.User, "err": err}).Error("Looking up passkey user")
+		http.Error(w, "Logging in is not possible right now. Please try again later.", http.StatusServiceUnavailable)
+		return
+	}
+	if reason := user.inactiveReason(); reason != nil {
+		logger.WithFields(logrus.Fields{"client": r.RemoteAddr, "user": pk.User}).Info("Inactive user tried to log in.")
+		audit(r, EventLoginFailed, pk.User, "", reason.Error())
+		http.Error(w, inactiveMessage(reason), http.StatusForbidden)
+		return
+	}
+
+	session, _ := store.Get(r, "auth")
+	delete(session.Values, "pending")
+	delete(session.Values, "pending_since")
+	if passwordChangeRequired(w, r, session, pk.User) {
+		writeJSON(w, map[string]string{"redirect": "/proxy/login/password"})
+		return
+	}
+	to := returnTo(session)
+	startSession(w, r, session, pk.User)
+	writeJSON(w, map[string]string{"redirect": to})
+}
+
+var passkeysContent = template.Must(template.New("passkeys").Parse(`
+	<p id="passkey-message"></p>
+	<table>
+	{{range .Passkeys}}
+		<tr>
+			<td>{{.Name}}</td>
+			<td>Added {{.CreatedAt.Format "2006-01-02"}}{{if not .LastUsed.IsZero}}, last used {{.LastUsed.Format "2006-01-02"}}{{end}}</td>
+			<td>
+				<form method="POST" action="/proxy/account/passkeys/delete">
+					<input type="hidden" name="id" value="{{.ID}}">
+					<input type="hidden" name="csrf" value="{{$.CSRF}}">
+					<input type="submit" value="Remove">
+				</form>
+			</td>
+		</tr>
+	{{else}}
+		<tr><td>You have no passkeys yet.</td></tr>
+	{{end}}
+	</table>
+	<form onsubmit="registerPasskey(); return false;">
+		<input type="text" id="passkey-name" placeholder="Name, like 'Work laptop'">
+		<input type="submit" value="Add passkey">
+	</form>`))
+
+func getAccountPasskeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	list, err := userPasskeys(user.Name)
+	if err != nil {
+		logger.WithFields(logrus.Fields{"user": user.Name, "err": err}).Error("Listing passkeys")
+	}
+	renderer.Render(w, Page{
+		Title:   "Passkeys",
+		Head:    passkeyScript,
+		Content: renderContent(passkeysContent, map[string]interface{}{"CSRF": csrfToken(w, r), "Passkeys": list}),
+	})
+}
+
+func postAccountPasskeyDelete(w http.ResponseWriter, r *http.Request) {
+	user, ok := loggedInUser(r)
+	if !ok {
+		http.Redirect(w, r, "/proxy/login", http.StatusSeeOther)
+		return
+	}
+	r.ParseForm()
+	var id Key
+	if err := id.UnmarshalText([]byte(r.PostFormValue("id"))); err != nil || deletePasskey(user.Name, id) != nil {
+		http.Error(w, "No such passkey.", http.StatusNotFound)
+		return
+	}
+	logger.WithFields(logrus.Fields{"user": user.Name, "client": r.RemoteAddr}).Info("Passkey removed")
+	http.Redirect(w, r, "/proxy/account/passkeys", http.StatusSeeOther)
+}
+
+//passkeyLoginContent is added to the login page when passkeys may be used on their own,
+//and to the second factor page of users that have passkeys.
+const passkeyLoginContent = `
+	<p id="passkey-message"></p>
+	<form onsubmit="loginPasskey(); return false;">
+		<input type="submit" value="Sign in with a passkey">
+	</form>`
+
+//passkeyScript bridges the JSON endpoints and the browser API, which wants ArrayBuffers instead of base64.
+const passkeyScript = template.HTML(`<script>
+function b64u(buf) {
+	return btoa(String.fromCharCode.apply(null, new Uint8Array(buf))).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+function unb64u(s) {
+	s = s.replace(/-/g, '+').replace(/_/g, '/');
+	while (s.length % 4) s += '=';
+	return Uint8Array.from(atob(s), function(c) { return c.charCodeAt(0); });
+}
+function postJSON(url, body) {
+	return fetch(url, {method: 'POST', credentials: 'same-origin', headers: {'Content-Type': 'application/json'}, body: JSON.stringify(body || {})})
+		.then(function(r) { return r.ok ? r.json() : r.text().then(function(t) { throw new Error(t); }); });
+}
+function passkeyFailed(e) {
+	document.getElementById('passkey-message').textContent = e.message;
+}
+function registerPasskey() {
+	postJSON('/proxy/webauthn/register/begin').then(function(o) {
+		o.challenge = unb64u(o.challenge);
+		o.user.id = unb64u(o.user.id);
+		o.excludeCredentials.forEach(function(c) { c.id = unb64u(c.id); });
+		return navigator.credentials.create({publicKey: o});
+	}).then(function(c) {
+		return postJSON('/proxy/webauthn/register/finish', {id: c.id, name: document.getElementById('passkey-name').value, response: {
+			clientDataJSON: b64u(c.response.clientDataJSON),
+			attestationObject: b64u(c.response.attestationObject)}});
+	}).then(function(r) { location = r.redirect; }, passkeyFailed);
+}
+function loginPasskey() {
+	postJSON('/proxy/webauthn/login/begin').then(function(o) {
+		o.challenge = unb64u(o.challenge);
+		o.allowCredentials.forEach(function(c) { c.id = unb64u(c.id); });
+		return navigator.credentials.get({publicKey: o});
+	}).then(function(c) {
+		return postJSON('/proxy/webauthn/login/finish', {id: c.id, response: {
+			clientDataJSON: b64u(c.response.clientDataJSON),
+			authenticatorData: b64u(c.response.authenticatorData),
+			signature: b64u(c.response.signature),
+			userHandle: c.response.userHandle ? b64u(c.response.userHandle) : ''}});
+	}).then(function(r) { location = r.redirect; }, passkeyFailed);
+}
+</script>`)
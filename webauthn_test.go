@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/fxamacker/cbor/v2"
+	"testing"
+)
+
+//softAuthenticator is a software stand-in for a security key or platform authenticator.
+type softAuthenticator struct {
+	rpID      string
+	origin    string
+	key       *ecdsa.PrivateKey
+	id        []byte
+	signCount uint32
+}
+
+func newSoftAuthenticator(t *testing.T, rpID, origin string) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{rpID: rpID, origin: origin, key: key, id: id}
+}
+
+func (a *softAuthenticator) clientData(typ string, challenge []byte) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      typ,
+		"challenge": base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":    a.origin,
+	})
+	return data
+}
+
+func (a *softAuthenticator) authData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], a.signCount)
+	data = append(data, count[:]...)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) create(challenge []byte) (clientDataJSON, attestationObject []byte) {
+	coseKey, _ := cbor.Marshal(map[int]interface{}{
+		1:  2,  //EC2
+		3:  -7, //ES256
+		-1: 1,  //P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	attested := make([]byte, 16) //AAGUID
+	attested = append(attested, byte(len(a.id)>>8), byte(len(a.id)))
+	attested = append(attested, a.id...)
+	attested = append(attested, coseKey...)
+
+	attestationObject, _ = cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(authDataUserPresent|authDataUserVerified|authDataAttested, attested),
+	})
+	return a.clientData("webauthn.create", challenge), attestationObject
+}
+
+func (a *softAuthenticator) get(challenge []byte, flags byte) (clientDataJSON, authData, signature []byte) {
+	a.signCount++
+	clientDataJSON = a.clientData("webauthn.get", challenge)
+	authData = a.authData(flags, nil)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, _ = ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	return
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	rp := &RelyingParty{ID: "example.com", Origins: []string{"https://example.com"}}
+	auth := newSoftAuthenticator(t, "example.com", "https://example.com")
+
+	challenge := []byte("registration challenge, 32 bytes")
+	clientDataJSON, attestationObject := auth.create(challenge)
+	if _, err := rp.VerifyRegistration([]byte("another challenge"), clientDataJSON, attestationObject, false); err != ErrWebAuthnClientData {
+		t.Errorf("Registration with wrong challenge: %v. Expected ErrWebAuthnClientData", err)
+	}
+	pk, err := rp.VerifyRegistration(challenge, clientDataJSON, attestationObject, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pk.ID) != string(auth.id) {
+		t.Error("Credential ID was not taken from the authenticator data")
+	}
+
+	challenge = []byte("authentication challenge")
+	clientDataJSON, authData, signature := auth.get(challenge, authDataUserPresent|authDataUserVerified)
+	if err := rp.VerifyAssertion(challenge, &pk, clientDataJSON, authData, signature, true); err != nil {
+		t.Fatal(err)
+	}
+	if pk.SignCount != 1 {
+		t.Errorf("Sign count %d, expected 1", pk.SignCount)
+	}
+
+	//A replayed assertion has a counter that did not increase.
+	if err := rp.VerifyAssertion(challenge, &pk, clientDataJSON, authData, signature, true); err != ErrWebAuthnSignCount {
+		t.Errorf("Replayed assertion: %v. Expected ErrWebAuthnSignCount", err)
+	}
+
+	clientDataJSON, authData, signature = auth.get(challenge, authDataUserPresent)
+	if err := rp.VerifyAssertion(challenge, &pk, clientDataJSON, authData, signature, true); err != ErrWebAuthnAuthData {
+		t.Errorf("Assertion without user verification: %v. Expected ErrWebAuthnAuthData", err)
+	}
+	if err := rp.VerifyAssertion(challenge, &pk, clientDataJSON, authData, signature, false); err != nil {
+		t.Errorf("Assertion as second factor: %v", err)
+	}
+
+	clientDataJSON, authData, signature = auth.get(challenge, authDataUserPresent)
+	signature[len(signature)-1] ^= 0xff
+	if err := rp.VerifyAssertion(challenge, &pk, clientDataJSON, authData, signature, false); err != ErrWebAuthnSignature {
+		t.Errorf("Tampered signature: %v. Expected ErrWebAuthnSignature", err)
+	}
+
+	phishing := newSoftAuthenticator(t, "example.com", "https://examp1e.com")
+	phishing.key, phishing.signCount = auth.key, auth.signCount
+	clientDataJSON, authData, signature = phishing.get(challenge, authDataUserPresent)
+	if err := rp.VerifyAssertion(challenge, &pk, clientDataJSON, authData, signature, false); err != ErrWebAuthnClientData {
+		t.Errorf("Assertion from other origin: %v. Expected ErrWebAuthnClientData", err)
+	}
+}